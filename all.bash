@@ -7,15 +7,15 @@ DIR=$(PWD)
 
 for target in "clean" "install"
 do
-  for d in stats attr cba fs termite \
+  for d in stats attr cba fs termite reapi \
       bin/coordinator \
-      bin/worker bin/master bin/shell-wrapper ; \
+      bin/worker bin/master bin/shell-wrapper bin/reapi ; \
   do
     (cd $d && go $target . )
   done
 done
 
-for d in stats attr cba termite
+for d in stats attr cba termite reapi
 do
   (cd $d && go test . )
 done
@@ -17,6 +17,12 @@ type Command struct {
 	Command   string
 	Filename  string
 
+	// Differences found when the command was run twice.
+	Nondeterminism []string
+
+	// Files outside the allowed roots that the command read.
+	UndeclaredReads []string
+
 	target *Target
 }
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -81,6 +82,30 @@ func (d *dupWrite) HTML(g *Graph) string {
 	return fmt.Sprintf("file %q written by <ul>%s</ul>", d.write, s)
 }
 
+type nondeterministic struct {
+	command *Command
+}
+
+func (n *nondeterministic) HTML(g *Graph) string {
+	s := ""
+	for _, d := range n.command.Nondeterminism {
+		s += fmt.Sprintf("<li>%s\n", html.EscapeString(d))
+	}
+	return fmt.Sprintf("command %s is nondeterministic <ul>%s</ul>", commandRef(n.command), s)
+}
+
+type undeclaredReads struct {
+	command *Command
+}
+
+func (u *undeclaredReads) HTML(g *Graph) string {
+	s := ""
+	for _, r := range u.command.UndeclaredReads {
+		s += fmt.Sprintf("<li>%s\n", html.EscapeString(r))
+	}
+	return fmt.Sprintf("command %s read undeclared files <ul>%s</ul>", commandRef(u.command), s)
+}
+
 /* parse a "target: dep" file. */
 func ParseDepFile(content []byte) ([]string, []string) {
 	content = bytes.Replace(content, []byte("\\\n"), nil, -1)
@@ -254,6 +279,12 @@ func (g *Graph) addError(e Error) {
 
 func (g *Graph) addCommand(ann *Command) {
 	g.CommandByID[g.Intern(ann.ID())] = ann
+	if len(ann.Nondeterminism) > 0 {
+		g.addError(&nondeterministic{ann})
+	}
+	if len(ann.UndeclaredReads) > 0 {
+		g.addError(&undeclaredReads{ann})
+	}
 	for _, w := range ann.Writes {
 		if exist, ok := g.CommandByWrite[w]; ok {
 			g.addError(&dupWrite{w, []*Command{exist, ann}})
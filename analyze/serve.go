@@ -120,6 +120,24 @@ func (g *Graph) writeCommand(w http.ResponseWriter, a *Command) {
 	}
 	fmt.Fprintf(w, "</ul>\n")
 
+	if len(a.UndeclaredReads) > 0 {
+		fmt.Fprintf(w, "<p>undeclared reads</p>\n")
+		fmt.Fprintf(w, "<ul>\n")
+		for _, k := range a.UndeclaredReads {
+			fmt.Fprintf(w, "<li>%s\n", html.EscapeString(k))
+		}
+		fmt.Fprintf(w, "</ul>\n")
+	}
+
+	if len(a.Nondeterminism) > 0 {
+		fmt.Fprintf(w, "<p>differences between runs</p>\n")
+		fmt.Fprintf(w, "<ul>\n")
+		for _, d := range a.Nondeterminism {
+			fmt.Fprintf(w, "<li>%s\n", html.EscapeString(d))
+		}
+		fmt.Fprintf(w, "</ul>\n")
+	}
+
 	fmt.Fprintf(w, "<p>command</p>\n")
 	fmt.Fprintf(w, "<pre>\n")
 	w.Write([]byte(html.EscapeString(a.Command) + "\n"))
@@ -190,6 +190,13 @@ func (me *AttributeCache) Have(name string) bool {
 	return ok
 }
 
+// Len returns the number of cached entries.
+func (me *AttributeCache) Len() int {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	return len(me.attributes)
+}
+
 func (me *AttributeCache) Get(name string) (rep *FileAttr) {
 	return me.get(name, false)
 }
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/hanwen/termite/termite"
 )
@@ -32,6 +33,14 @@ func main() {
 	port := flag.Int("port", 1230, "Where to listen for work requests.")
 	webPassword := flag.String("web-password", "killkillkill", "password for authorizing worker kills.")
 	secretFile := flag.String("secret", "secret.txt", "file containing password or SSH identity.")
+	scaleCommand := flag.String("autoscale-command", "", "command to run as 'CMD up N' or 'CMD down ADDR..' for resizing the worker pool.")
+	scaleWebhook := flag.String("autoscale-webhook", "", "URL to POST worker pool resize requests to.")
+	scaleMin := flag.Int("autoscale-min", 0, "minimum number of workers when autoscaling.")
+	scaleMax := flag.Int("autoscale-max", 0, "maximum number of workers when autoscaling; 0 is unlimited.")
+	scaleCooldown := flag.Duration("autoscale-cooldown", 5*time.Minute, "minimum time between resizing the worker pool.")
+	scaleIdle := flag.Duration("autoscale-idle", 10*time.Minute, "how long a worker must be unused before removing it.")
+	quarantineRate := flag.Float64("quarantine-rate", 0, "fraction of failing tasks above which a worker is not handed out, eg. 0.5; 0, the default, disables.")
+	quarantineBackoff := flag.Duration("quarantine-backoff", time.Minute, "initial duration of worker quarantine; doubles on each repeat.")
 	flag.Parse()
 	log.SetPrefix("C")
 
@@ -43,6 +52,26 @@ func main() {
 	opts := termite.CoordinatorOptions{
 		Secret:      secret,
 		WebPassword: *webPassword,
+		Quarantine: termite.QuarantineOptions{
+			FailureRate: *quarantineRate,
+			Backoff:     *quarantineBackoff,
+		},
+	}
+
+	var scaler termite.Scaler
+	if *scaleCommand != "" {
+		scaler = &termite.CommandScaler{Command: *scaleCommand}
+	} else if *scaleWebhook != "" {
+		scaler = &termite.WebhookScaler{URL: *scaleWebhook}
+	}
+	if scaler != nil {
+		opts.Autoscale = &termite.AutoscaleOptions{
+			Scaler:     scaler,
+			MinWorkers: *scaleMin,
+			MaxWorkers: *scaleMax,
+			Cooldown:   *scaleCooldown,
+			IdleTime:   *scaleIdle,
+		}
 	}
 	c := termite.NewCoordinator(&opts)
 	c.Mux.HandleFunc("/bin/worker", serveBin("worker"))
@@ -50,5 +79,6 @@ func main() {
 
 	log.Println(termite.Version())
 	go c.PeriodicCheck()
+	go c.PeriodicAutoscale()
 	c.ServeHTTP(*port)
 }
@@ -7,10 +7,14 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"google.golang.org/grpc"
+
 	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/reapi"
 	"github.com/hanwen/termite/termite"
 )
 
@@ -26,12 +30,32 @@ func main() {
 	logfile := flag.String("logfile", "", "where to send log output.")
 	paranoia := flag.Bool("paranoia", false, "Check attribute cache.")
 	port := flag.Int("port", 1231, "http status port")
-	retry := flag.Int("retry", 3, "how often to retry faulty jobs")
+	retry := flag.Int("retry", 3, "how often to retry tasks that failed because of termite or the worker")
+	retryPolicy := flag.String("retry-policy", "", "JSON file with the retry policy per failure class; overrides -retry.")
 	secretFile := flag.String("secret", "secret.txt", "file containing password or SSH identity.")
 	socket := flag.String("socket", ".termite-socket", "socket to listen for commands")
 	srcRoot := flag.String("sourcedir", "", "root of corresponding source directory")
 	xattr := flag.Bool("xattr", true, "cache hashes in filesystem attribute.")
 	analysisDir := flag.String("analysis-dir", "", "where to store dumps of the action graph")
+	quarantineRate := flag.Float64("quarantine-rate", 0, "fraction of failing tasks above which a worker is not used, eg. 0.5; 0, the default, disables.")
+	quarantineBackoff := flag.Duration("quarantine-backoff", time.Minute, "initial duration of worker quarantine; doubles on each repeat.")
+	rootImage := flag.String("root-image", "", "tar file or directory to use as root file system on the workers.")
+	mountPolicy := flag.String("mount-policy", "", "JSON file with additions to the sandbox mounts of the workers.")
+	envPolicy := flag.String("env-policy", "", "JSON file with the policy for environment variables of tasks.")
+	reproducible := flag.Bool("reproducible", false, "give tasks deterministic randomness and SOURCE_DATE_EPOCH, and normalize output attributes.")
+	sourceDateEpoch := flag.Int64("source-date-epoch", termite.DefaultSourceDateEpoch, "SOURCE_DATE_EPOCH for -reproducible.")
+	verifyRate := flag.Float64("verify-rate", 0, "fraction of tasks to run twice, on different workers, to find nondeterministic commands.")
+	verifyRegexp := flag.String("verify-regexp", "", "always run commands matching this regexp twice.")
+	hermeticRoots := flag.String("hermetic-roots", "", "comma-separated directories outside the writable root that tasks may read. If set, reads elsewhere are reported.")
+	hermeticFail := flag.Bool("hermetic-fail", false, "fail tasks that read outside -hermetic-roots, rather than only reporting them.")
+	remoteExecutor := flag.String("remote-executor", "", "address of a Remote Execution API service to run tasks on, instead of termite workers.")
+	remoteInstance := flag.String("remote-instance", "", "instance name for -remote-executor.")
+	remoteTLS := flag.Bool("remote-tls", false, "connect to -remote-executor with TLS.")
+	remoteCA := flag.String("remote-ca", "", "file with the CA certificates for -remote-executor; implies -remote-tls.")
+	remoteSecret := flag.String("remote-secret", "", "file containing the password to send to -remote-executor in the "+reapi.SecretHeader+" header.")
+	pump := flag.Bool("pump", false, "scan the includes of C and C++ compiles, and send the headers to the worker along with the task.")
+	idleTimeout := flag.Duration("idle-timeout", 0, "exit after this long without commands; 0 disables.")
+	jobserver := flag.Bool("jobserver", false, "serve a make jobserver next to the socket, with a token for each reserved job slot.")
 	flag.Parse()
 
 	if *logfile != "" {
@@ -50,6 +74,49 @@ func main() {
 		log.Fatal("ReadFile", err)
 	}
 
+	var policy *termite.MountPolicy
+	if *mountPolicy != "" {
+		policy, err = termite.ReadMountPolicy(*mountPolicy)
+		if err != nil {
+			log.Fatal("ReadMountPolicy: ", err)
+		}
+	}
+
+	var env *termite.EnvPolicy
+	if *envPolicy != "" {
+		env, err = termite.ReadEnvPolicy(*envPolicy)
+		if err != nil {
+			log.Fatal("ReadEnvPolicy: ", err)
+		}
+	}
+
+	var retries *termite.RetryPolicy
+	if *retryPolicy != "" {
+		retries, err = termite.ReadRetryPolicy(*retryPolicy)
+		if err != nil {
+			log.Fatal("ReadRetryPolicy: ", err)
+		}
+	}
+
+	var verifyCommands *regexp.Regexp
+	if *verifyRegexp != "" {
+		verifyCommands, err = regexp.Compile(*verifyRegexp)
+		if err != nil {
+			log.Fatal("-verify-regexp: ", err)
+		}
+	}
+
+	var hermeticity *termite.HermeticityPolicy
+	if *hermeticRoots != "" || *hermeticFail {
+		if *remoteExecutor != "" {
+			log.Fatal("-hermetic-roots and -hermetic-fail can't be used with -remote-executor.")
+		}
+		hermeticity = &termite.HermeticityPolicy{Enforce: *hermeticFail}
+		if *hermeticRoots != "" {
+			hermeticity.Allow = strings.Split(*hermeticRoots, ",")
+		}
+	}
+
 	excludeList := strings.Split(*exclude, ",")
 	root, sock := absSocket(*socket)
 
@@ -68,10 +135,51 @@ func main() {
 			Dir: *cachedir,
 		},
 		RetryCount:  *retry,
+		Retry:       retries,
 		XAttrCache:  *xattr,
 		LogFile:     *logfile,
 		Socket:      sock,
 		AnalysisDir: *analysisDir,
+		Quarantine: termite.QuarantineOptions{
+			FailureRate: *quarantineRate,
+			Backoff:     *quarantineBackoff,
+		},
+		MountPolicy: policy,
+		RootImage:   *rootImage,
+		EnvPolicy:   env,
+
+		Reproducible:    *reproducible,
+		SourceDateEpoch: *sourceDateEpoch,
+
+		VerifyRate:     *verifyRate,
+		VerifyCommands: verifyCommands,
+		Hermeticity:    hermeticity,
+		IdleTimeout:    *idleTimeout,
+		Pump:           *pump,
+		Jobserver:      *jobserver,
+	}
+	if *remoteExecutor != "" {
+		dial := reapi.DialOptions{
+			TLS:    *remoteTLS,
+			CAFile: *remoteCA,
+		}
+		if *remoteSecret != "" {
+			content, err := ioutil.ReadFile(*remoteSecret)
+			if err != nil {
+				log.Fatal("ReadFile: ", err)
+			}
+			// Headers can't hold newlines.
+			dial.Secret = []byte(strings.TrimSpace(string(content)))
+		}
+		grpcOpts, err := dial.GRPCOptions()
+		if err != nil {
+			log.Fatal("remote executor: ", err)
+		}
+		conn, err := grpc.Dial(*remoteExecutor, grpcOpts...)
+		if err != nil {
+			log.Fatal("grpc.Dial: ", err)
+		}
+		opts.Backend = reapi.NewBackend(conn, *remoteInstance)
 	}
 	master := termite.NewMaster(&opts)
 
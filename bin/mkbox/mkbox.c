@@ -27,6 +27,9 @@
 #include <sys/types.h>
 #include <sys/mount.h>
 #include <sys/wait.h>
+#include <sys/ioctl.h>
+#include <sys/socket.h>
+#include <net/if.h>
 #include <fcntl.h>
 #include <linux/capability.h>
 
@@ -56,20 +59,61 @@ int dropcaps(void) {
 	return capset(&header, data);
 }
 
+/* bring up the loopback interface in a new network namespace. */
+int loopback_up(void) {
+	struct ifreq ifr;
+	int fd = socket(AF_INET, SOCK_DGRAM, 0);
+	if (fd < 0)
+		return fd;
+	memset(&ifr, 0, sizeof(ifr));
+	strcpy(ifr.ifr_name, "lo");
+	int res = ioctl(fd, SIOCGIFFLAGS, &ifr);
+	if (res >= 0) {
+		ifr.ifr_flags |= IFF_UP;
+		res = ioctl(fd, SIOCSIFFLAGS, &ifr);
+	}
+	close(fd);
+	return res;
+}
+
+#define OPTSTRING "+b:B:d:D:g:L:nqr:s:t:T:u:Z"
+
 int main(int argc, char **argv) {
 	uid_t uid = getuid();
 	gid_t gid = getgid();
 	const char* child_dir = NULL;
 	const char* binary = NULL;
 	int verbose = 1;
+	int share_net = 0;
+	int opt;
+
+	/* the namespaces must be set up before processing the other
+	 * options, so look for -n first. */
+	opterr = 0;
+	while ((opt = getopt(argc, argv, OPTSTRING)) != -1) {
+		if (opt == 'n') {
+			share_net = 1;
+		}
+	}
+	optind = 1;
+	opterr = 1;
+
 	int unshare_flags = CLONE_NEWNS|CLONE_NEWUTS|
-		CLONE_NEWIPC|CLONE_NEWUSER|CLONE_NEWNET;
+		CLONE_NEWIPC|CLONE_NEWUSER;
+	if (!share_net) {
+		unshare_flags |= CLONE_NEWNET;
+	}
 	ok(unshare, unshare_flags);
+	if (!share_net) {
+		ok(loopback_up);
+	}
 
 	int root_set = 0;
-	int opt;
-	while ((opt = getopt(argc, argv, "+b:B:d:D:g:qr:s:t:u:Z")) != -1) {
+	const char *tmp_size = NULL;
+	while ((opt = getopt(argc, argv, OPTSTRING)) != -1) {
 		switch (opt) {
+		case 'n': /* share network; handled above. */
+			break;
 		case 'q':	/* quiet */
 			verbose = 0;
 			break;
@@ -130,9 +174,21 @@ int main(int argc, char **argv) {
 				ok(mkdir, optarg, 0755);
 			}
 			
-			ok(mount, "sandbox-dev", optarg, "tmpfs",
-			   MS_NOSUID|MS_NOEXEC|MS_NOATIME,
-			   "size=64k,nr_inodes=16,mode=755");
+			if (tmp_size == NULL) {
+				ok(mount, "sandbox-dev", optarg, "tmpfs",
+				   MS_NOSUID|MS_NOEXEC|MS_NOATIME,
+				   "size=64k,nr_inodes=16,mode=755");
+			} else {
+				char opts[1024];
+				snprintf(opts, sizeof(opts), "size=%s,mode=755", tmp_size);
+				ok(mount, "sandbox-dev", optarg, "tmpfs",
+				   MS_NOSUID|MS_NOEXEC|MS_NOATIME, opts);
+				tmp_size = NULL;
+			}
+			break;
+
+		case 'T': /* size of the next tmpfs */
+			tmp_size = optarg;
 			break;
 
 		case 'r': // remount as readonly.
@@ -183,6 +239,18 @@ int main(int argc, char **argv) {
 		case 'D':	/* create dir. Needed for creating dirs inside tmp/ */
 			ok(mkdir, optarg, 0755);
 			break;
+
+		case 'L':	/* create symlink */
+		{
+			char *dst = strchr(optarg, '=');
+			if (dst == NULL) {
+				errorf("argument must have '=': %s", optarg);
+			}
+			*dst = '\0';
+			dst++;
+			ok(symlink, optarg, dst);
+		}
+		break;
 			
 		case 'Z':
 			sleep(100);
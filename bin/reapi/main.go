@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/hanwen/termite/reapi"
+	"github.com/hanwen/termite/termite"
+)
+
+func main() {
+	home := os.Getenv("HOME")
+	cachedir := flag.String("cachedir", filepath.Join(home, ".cache", "termite-reapi"), "content cache")
+	host := flag.String("host", "localhost", "address to listen on. Other than loopback addresses need -secret.")
+	port := flag.Int("port", 8980, "gRPC port")
+	secretFile := flag.String("secret", "", "file containing the password that clients must send in the "+reapi.SecretHeader+" header.")
+	tlsCert := flag.String("tls-cert", "", "certificate file to serve TLS with; needs -tls-key.")
+	tlsKey := flag.String("tls-key", "", "private key file for -tls-cert.")
+	socket := flag.String("socket", "", "socket of the master; found from the current directory if unset.")
+	workdir := flag.String("workdir", "", "where to unpack input roots; must be inside the master's writable root. Defaults to .termite-reapi next to the socket.")
+	flag.Parse()
+
+	var secret []byte
+	if *secretFile != "" {
+		content, err := ioutil.ReadFile(*secretFile)
+		if err != nil {
+			log.Fatal("ReadFile: ", err)
+		}
+		// Headers can't hold newlines.
+		secret = []byte(strings.TrimSpace(string(content)))
+	}
+	if ip := net.ParseIP(*host); len(secret) == 0 && *host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Fatalf("listening on %q needs -secret", *host)
+	}
+
+	if *socket == "" {
+		*socket = termite.FindSocket()
+	}
+	if *socket == "" {
+		log.Fatal("could not find .termite-socket")
+	}
+	if *workdir == "" {
+		*workdir = filepath.Join(filepath.Dir(*socket), ".termite-reapi")
+	}
+
+	server, err := reapi.NewServer(&reapi.Options{
+		CacheDir: *cachedir,
+		WorkDir:  *workdir,
+		Runner:   &reapi.MasterRunner{Socket: *socket},
+		Secret:   secret,
+	})
+	if err != nil {
+		log.Fatal("NewServer: ", err)
+	}
+
+	addr := net.JoinHostPort(*host, fmt.Sprint(*port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	grpcOpts := server.GRPCOptions()
+	if *tlsCert != "" || *tlsKey != "" {
+		creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal("TLS: ", err)
+		}
+		grpcOpts = append(grpcOpts, grpc.Creds(creds))
+	}
+	g := grpc.NewServer(grpcOpts...)
+	server.Register(g)
+
+	log.Println(termite.Version())
+	log.Printf("serving Remote Execution API on %s for master %s", addr, *socket)
+	log.Fatal(g.Serve(listener))
+}
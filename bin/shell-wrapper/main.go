@@ -3,12 +3,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/rpc"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -21,15 +25,26 @@ import (
 const _TIMEOUT = 10 * time.Second
 
 var socketRpc *rpc.Client
+var socketPath string
 var topDir string
 
+// Options before -c when running as make's SHELL, from .SHELLFLAGS.
+var shellOptions []string
+
 func Rpc() (*rpc.Client, error) {
 	if socketRpc == nil {
 		socket := termite.FindSocket()
+		if socket != "" && termite.RemoveStaleSocket(socket) {
+			socket = ""
+		}
 		if socket == "" {
-			wd, _ := os.Getwd()
-			return nil, fmt.Errorf("Could not find .termite-socket; cwd: %s", wd)
+			var err error
+			socket, err = autoStartMaster()
+			if err != nil {
+				return nil, err
+			}
 		}
+		socketPath = socket
 		topDir, _ = filepath.Split(socket)
 		topDir = filepath.Clean(topDir)
 		conn := termite.OpenSocketConnection(socket, termite.RPC_CHANNEL, _TIMEOUT)
@@ -38,6 +53,43 @@ func Rpc() (*rpc.Client, error) {
 	return socketRpc, nil
 }
 
+// autoStartMaster starts a master for the current tree if there is a
+// per-user config. The tree is $TERMITE_ROOT, or the nearest
+// directory with a .termite-localrc, or the working directory.
+func autoStartMaster() (string, error) {
+	wd, _ := os.Getwd()
+	confFile := termite.DaemonConfigFile()
+	if _, err := os.Stat(confFile); err != nil {
+		return "", fmt.Errorf("Could not find .termite-socket, and no %s to start a master; cwd: %s", confFile, wd)
+	}
+	conf, err := termite.ReadDaemonConfig(confFile)
+	if err != nil {
+		return "", err
+	}
+
+	root := os.Getenv("TERMITE_ROOT")
+	for dir := wd; root == "" && dir != "/"; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".termite-localrc")); err == nil {
+			root = dir
+		}
+	}
+	if root == "" {
+		root = wd
+	}
+	return termite.StartMaster(root, conf)
+}
+
+// TopDir returns the directory holding the .termite-socket, or "" if
+// there is none.
+func TopDir() string {
+	if topDir == "" {
+		if socket := termite.FindSocket(); socket != "" {
+			topDir = filepath.Clean(filepath.Dir(socket))
+		}
+	}
+	return topDir
+}
+
 func TryRunDirect(req *termite.WorkRequest) {
 	if req.Argv[0] == "echo" {
 		fmt.Println(strings.Join(req.Argv[1:], " "))
@@ -65,15 +117,16 @@ var bashInternals = []string{
 }
 
 func NewWorkRequest(cmd string, dir string, topdir string) *termite.WorkRequest {
+	argv := append([]string{Shell()}, shellOptions...)
 	req := &termite.WorkRequest{
 		Binary: Shell(),
-		Argv:   []string{Shell(), "-c", cmd},
+		Argv:   append(argv, "-c", cmd),
 		Env:    cleanEnv(os.Environ()),
 		Dir:    dir,
 	}
 
 	parsed := termite.ParseCommand(cmd)
-	if len(parsed) > 0 {
+	if len(parsed) > 0 && directOptions() {
 		// Is this really necessary?
 		for _, c := range bashInternals {
 			if parsed[0] == c {
@@ -104,10 +157,26 @@ func PrepareRun(cmd string, dir string, topdir string) (*termite.WorkRequest, *t
 	req := NewWorkRequest(cmd, dir, topdir)
 	TryRunDirect(req)
 
-	decider := termite.NewLocalDecider(topdir)
-	rule := decider.ShouldRunLocally(cmd)
+	decider, err := termite.NewLocalDecider(topdir)
+	if err != nil {
+		log.Fatalf("reading rules in %s: %v", topdir, err)
+	}
+	rule := decider.Match(termite.NewLocalCommand(cmd, dir, os.Getenv("MAKE_TARGET")))
 	if rule != nil {
 		req.Debug = rule.Debug
+		req.Timeout = rule.TimeoutDuration()
+		req.ShareNetwork = rule.ShareNetwork
+		req.RootImage = rule.RootImage
+		if req.RootImage != "" && !filepath.IsAbs(req.RootImage) {
+			req.RootImage = filepath.Join(topdir, req.RootImage)
+		}
+		if rule.Env != nil {
+			var stripped []string
+			req.Env, stripped = rule.Env.Apply(req.Env)
+			if req.Debug && len(stripped) > 0 {
+				log.Printf("stripped environment variables: %v", stripped)
+			}
+		}
 		return req, rule
 	}
 
@@ -133,6 +202,10 @@ func cleanEnv(input []string) []string {
 			v = fmt.Sprintf("%s=%s", comps[0], "make")
 		} else if comps[0] == "MAKE_SHELL" {
 			continue
+		} else if comps[0] == "TERMITE_SESSION" || comps[0] == "TERMITE_SESSION_JOBS" {
+			// Sent as fields of the request; they differ
+			// for every build.
+			continue
 		}
 		env = append(env, v)
 	}
@@ -170,12 +243,60 @@ func Inspect(files []string) {
 
 func Shell() string {
 	shell := os.Getenv("SHELL")
-	if shell == "" {
+	// If we are $SHELL, running commands through it would recurse.
+	if shell == "" || filepath.Base(shell) == filepath.Base(os.Args[0]) {
 		shell = "/bin/sh"
 	}
 	return shell
 }
 
+// directOptions returns whether a command can run without a shell
+// given shellOptions. Only -e makes no difference for a single
+// command.
+func directOptions() bool {
+	for _, o := range shellOptions {
+		if strings.Trim(o, "-e") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// parseShellArgs recognizes the arguments make passes to $SHELL with
+// a .SHELLFLAGS other than -c, eg. "-ec cmd" or "-e -o pipefail -c
+// cmd". It returns the options without the c, and the command.
+func parseShellArgs(args []string) (options []string, cmd string, ok bool) {
+	for i := 0; i < len(args)-1; i++ {
+		a := args[i]
+		if a == "-o" || a == "+o" {
+			if i+1 >= len(args)-1 {
+				return nil, "", false
+			}
+			options = append(options, a, args[i+1])
+			i++
+			continue
+		}
+		if len(a) < 2 || a[0] != '-' || flag.Lookup(a[1:]) != nil {
+			return nil, "", false
+		}
+		letters := a[1:]
+		if strings.Trim(letters, "aefhuvxc") != "" {
+			return nil, "", false
+		}
+		if strings.Contains(letters, "c") {
+			if i != len(args)-2 {
+				return nil, "", false
+			}
+			if rest := strings.Replace(letters, "c", "", -1); rest != "" {
+				options = append(options, "-"+rest)
+			}
+			return options, args[len(args)-1], true
+		}
+		options = append(options, a)
+	}
+	return nil, "", false
+}
+
 func RunLocally(req *termite.WorkRequest, rule *termite.LocalRule) syscall.WaitStatus {
 	env := os.Environ()
 	if !rule.Recurse {
@@ -184,11 +305,18 @@ func RunLocally(req *termite.WorkRequest, rule *termite.LocalRule) syscall.WaitS
 
 	proc, err := os.StartProcess(req.Binary, req.Argv, &os.ProcAttr{
 		Env:   env,
-		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, jobserverFiles()...),
 	})
 	if err != nil {
 		log.Fatalf("os.StartProcess() for %v: %v", req, err)
 	}
+	if req.Timeout > 0 {
+		timer := time.AfterFunc(req.Timeout, func() {
+			log.Printf("killing %v after timeout of %v", req.Argv, req.Timeout)
+			proc.Kill()
+		})
+		defer timer.Stop()
+	}
 	msg, err := proc.Wait()
 	if err != nil {
 		log.Fatalf("proc.Wait() for %v: %v", req, err)
@@ -196,6 +324,220 @@ func RunLocally(req *termite.WorkRequest, rule *termite.LocalRule) syscall.WaitS
 	return msg.Sys().(syscall.WaitStatus)
 }
 
+var jobserverRegexp = regexp.MustCompile(`--jobserver-(?:auth|fds)=([0-9]+),([0-9]+)`)
+
+// jobserverFiles returns the files to pass from fd 3 onwards, so a
+// recursive make finds the jobserver pipe of $MAKEFLAGS at the same
+// fds.
+func jobserverFiles() []*os.File {
+	m := jobserverRegexp.FindStringSubmatch(os.Getenv("MAKEFLAGS"))
+	if m == nil {
+		return nil
+	}
+	var files []*os.File
+	for _, s := range m[1:] {
+		fd, _ := strconv.Atoi(s)
+		var st syscall.Stat_t
+		if fd < 3 || syscall.Fstat(fd, &st) != nil {
+			continue
+		}
+		for len(files) < fd-2 {
+			files = append(files, nil)
+		}
+		files[fd-3] = os.NewFile(uintptr(fd), "jobserver")
+	}
+	return files
+}
+
+// JobserverPath prints the jobserver FIFO of the master, if it
+// serves one.
+func JobserverPath() {
+	if _, err := Rpc(); err != nil {
+		return
+	}
+	p := termite.JobserverPath(socketPath)
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		fmt.Println(p)
+	}
+}
+
+// readTestFilters returns the filters of a comma-separated list, or
+// of a file with one per line if the list is "@file".
+func readTestFilters(list string) []string {
+	sep := ","
+	if strings.HasPrefix(list, "@") {
+		content, err := ioutil.ReadFile(list[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		list = string(content)
+		sep = "\n"
+	}
+	var filters []string
+	for _, f := range strings.Split(list, sep) {
+		if f = strings.TrimSpace(f); f != "" {
+			filters = append(filters, f)
+		}
+	}
+	return filters
+}
+
+func parseShardList(list string) []int {
+	var shards []int
+	for _, s := range strings.Split(list, ",") {
+		if s == "" {
+			continue
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("bad shard %q: %v", s, err)
+		}
+		shards = append(shards, i)
+	}
+	return shards
+}
+
+func joinShards(shards []int) string {
+	var s []string
+	for _, i := range shards {
+		s = append(s, strconv.Itoa(i))
+	}
+	return strings.Join(s, ",")
+}
+
+// RunTests runs a test binary in shards on the workers, and writes
+// the merged JUnit XML to report. It returns the exit status.
+func RunTests(req *termite.TestRequest, report string) int {
+	binary, err := exec.LookPath(req.Argv[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !filepath.IsAbs(binary) {
+		binary = filepath.Join(req.Dir, binary)
+	}
+	req.Binary = binary
+
+	rep := termite.TestResponse{}
+	rpc, err := Rpc()
+	if err != nil {
+		log.Fatalf("rpc connection problem: %v", err)
+	}
+	if err := rpc.Call("LocalMaster.RunTests", req, &rep); err != nil {
+		log.Fatal("LocalMaster.RunTests: ", err)
+	}
+
+	for _, s := range rep.Shards {
+		status := "PASS"
+		if s.Error != "" || s.Exit != 0 {
+			status = "FAIL"
+			os.Stdout.Write([]byte(s.Stdout))
+			os.Stderr.Write([]byte(s.Stderr))
+		}
+		fmt.Printf("shard %d: %s on %s in %v", s.Index, status, s.WorkerId, s.Duration)
+		if s.Retries > 0 {
+			fmt.Printf(", %d retries", s.Retries)
+		}
+		if s.Failure != "" {
+			fmt.Printf(", %s failure", s.Failure)
+		}
+		if s.Error != "" {
+			fmt.Printf(": %s", s.Error)
+		}
+		fmt.Println()
+	}
+	if report != "" {
+		if err := ioutil.WriteFile(report, rep.Report, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(rep.Failed) > 0 {
+		fmt.Printf("failed shards: %s; rerun them with -test-only %s\n",
+			joinShards(rep.Failed), joinShards(rep.Failed))
+		return 1
+	}
+	return 0
+}
+
+// CheckRules validates a rule file. If cmd is given, it explains
+// which rule the command hits.
+func CheckRules(rules string, cmd string, dir string) {
+	if rules == "" {
+		rules = filepath.Join(TopDir(), ".termite-localrc")
+	}
+	decider, err := termite.ReadLocalRules(rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: %d rules OK\n", rules, decider.RuleCount())
+	if cmd == "" {
+		return
+	}
+	c := termite.NewLocalCommand(termite.MakeUnescape(cmd), dir, os.Getenv("MAKE_TARGET"))
+	for _, l := range decider.Explain(c) {
+		fmt.Println(l)
+	}
+}
+
+// ListSessions prints the build sessions of the master.
+func ListSessions() {
+	req := 1
+	rep := termite.SessionListResponse{}
+	rpc, err := Rpc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := rpc.Call("LocalMaster.Sessions", &req, &rep); err != nil {
+		log.Fatal("LocalMaster.Sessions: ", err)
+	}
+	for _, s := range rep.Sessions {
+		id := s.Id
+		if id == "" {
+			id = "(default)"
+		}
+		state := ""
+		if s.Cancelled {
+			state = " cancelled"
+		}
+		fmt.Printf("%s: started %s, %d running, %d waiting, %d done, %d failed%s\n",
+			id, s.Start.Format(time.RFC3339), s.Running, s.Waiting, s.Done, s.Failed, state)
+	}
+}
+
+// CancelSession stops the tasks of a build session.
+func CancelSession(id string) {
+	req := termite.CancelSessionRequest{Session: id}
+	rep := termite.CancelSessionResponse{}
+	rpc, err := Rpc()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := rpc.Call("LocalMaster.CancelSession", &req, &rep); err != nil {
+		log.Fatal("LocalMaster.CancelSession: ", err)
+	}
+	fmt.Printf("cancelled session %q, killed %d tasks\n", id, rep.Killed)
+}
+
+// streamTerminal asks for a pseudo-terminal for the request if our
+// stdout is a terminal. The returned channel is closed once the
+// output of the task has been copied.
+func streamTerminal(req *termite.WorkRequest) chan struct{} {
+	size := termite.TerminalSize(os.Stdout.Fd())
+	if size == nil {
+		return nil
+	}
+	req.Terminal = size
+	req.StdinId = termite.RandomConnectionId()
+
+	done := make(chan struct{})
+	go func() {
+		conn := termite.OpenSocketConnection(socketPath, req.StdinId, _TIMEOUT)
+		io.Copy(os.Stdout, conn)
+		conn.Close()
+		close(done)
+	}()
+	return done
+}
+
 func DumpAnnotations(req *termite.WorkRequest, rep *termite.WorkResponse, dur time.Duration) {
 }
 
@@ -208,8 +550,29 @@ func main() {
 	directory := flag.String("dir", "", "directory from where to run (default: cwd).")
 	worker := flag.String("worker", "", "request to run on a worker explicitly")
 	debug := flag.Bool("dbg", false, "set on debugging in request.")
-
-	flag.Parse()
+	checkRules := flag.Bool("check-rules", false, "validate the local rules, and with -c, explain which rule the command hits.")
+	tty := flag.Bool("tty", true, "if stdout is a terminal, run remote commands on a pseudo-terminal.")
+	sessions := flag.Bool("sessions", false, "list the build sessions of the master.")
+	cancelSession := flag.String("cancel-session", "", "cancel the tasks of this build session.")
+	jobserverPath := flag.Bool("jobserver-path", false, "print the path of the make jobserver of the master, if it serves one.")
+	test := flag.Bool("test", false, "run the args as a test binary, in shards on the workers.")
+	shards := flag.Int("shards", 0, "number of test shards (default: one per filter).")
+	testFilters := flag.String("test-filters", "", "comma-separated test filters to deal over the shards, or @file with one per line.")
+	testFilterFormat := flag.String("test-filter-format", "--gtest_filter=%s", "argument passing the filters of a shard.")
+	testFilterSep := flag.String("test-filter-sep", ":", "separator for the filters of a shard.")
+	testOnly := flag.String("test-only", "", "comma-separated shards to run, eg. to retry failed ones.")
+	testResults := flag.String("test-results", "", "directory where shards write JUnit XML (default: .termite-test-results).")
+	testReport := flag.String("test-report", "", "file for the merged JUnit XML report.")
+	rules := flag.String("rules", "", "rule file for -check-rules (default: .termite-localrc next to .termite-socket).")
+
+	// As make's SHELL, we get eg. "-ec cmd", which the flag package
+	// does not understand. Plain "-c cmd" is parsed as a flag.
+	if options, cmd, ok := parseShellArgs(os.Args[1:]); ok && len(options) > 0 {
+		shellOptions = options
+		*command = cmd
+	} else {
+		flag.Parse()
+	}
 	log.SetPrefix("S")
 
 	if *shutdown {
@@ -225,6 +588,18 @@ func main() {
 	if *refresh {
 		Refresh()
 	}
+	if *sessions {
+		ListSessions()
+		return
+	}
+	if *cancelSession != "" {
+		CancelSession(*cancelSession)
+		return
+	}
+	if *jobserverPath {
+		JobserverPath()
+		return
+	}
 
 	if *inspect {
 		Inspect(flag.Args())
@@ -239,6 +614,32 @@ func main() {
 		directory = &wd
 	}
 
+	if *checkRules {
+		CheckRules(*rules, *command, *directory)
+		return
+	}
+
+	if *test {
+		if flag.NArg() == 0 {
+			log.Fatal("-test needs a test binary")
+		}
+		shardJobs, _ := strconv.Atoi(os.Getenv("TERMITE_SESSION_JOBS"))
+		os.Exit(RunTests(&termite.TestRequest{
+			Argv:            flag.Args(),
+			Env:             cleanEnv(os.Environ()),
+			Dir:             *directory,
+			Filters:         readTestFilters(*testFilters),
+			FilterFormat:    *testFilterFormat,
+			FilterSeparator: *testFilterSep,
+			Shards:          *shards,
+			Only:            parseShardList(*testOnly),
+			ResultDir:       *testResults,
+			Session:         os.Getenv("TERMITE_SESSION"),
+			SessionJobs:     shardJobs,
+			Debug:           *debug || os.Getenv("TERMITE_DEBUG") != "",
+		}, *testReport))
+	}
+
 	var req *termite.WorkRequest
 	var rule *termite.LocalRule
 	if *exec {
@@ -249,7 +650,13 @@ func main() {
 			Env:    os.Environ(),
 		}
 	} else {
-		req, rule = PrepareRun(*command, *directory, topDir)
+		cmd := *command
+		if cmd == "" && flag.NArg() > 0 && !*inspect {
+			// Compiler launcher: "shell-wrapper gcc -c foo.c".
+			cmd = termite.ShellQuote(flag.Args())
+			*command = cmd
+		}
+		req, rule = PrepareRun(cmd, *directory, TopDir())
 	}
 	var waitMsg syscall.WaitStatus
 	rep := termite.WorkResponse{}
@@ -266,17 +673,36 @@ func main() {
 		req.TrackReads = true
 		req.DeclaredDeps = strings.Split(os.Getenv("MAKE_DEPS"), " ")
 		req.DeclaredTarget = os.Getenv("MAKE_TARGET")
+		req.Session = os.Getenv("TERMITE_SESSION")
+		req.SessionJobs, _ = strconv.Atoi(os.Getenv("TERMITE_SESSION_JOBS"))
 
 		rpc, err := Rpc()
 		if err != nil {
 			log.Fatalf("rpc connection problem (%s): %v", *command, err)
 		}
 
+		var output chan struct{}
+		if *tty {
+			output = streamTerminal(req)
+		}
 		err = rpc.Call("LocalMaster.Run", req, &rep)
 		if err != nil {
 			log.Fatal("LocalMaster.Run: ", err)
 		}
+		if output != nil {
+			select {
+			case <-output:
+			case <-time.After(_TIMEOUT):
+				log.Printf("timeout waiting for terminal output")
+			}
+		}
 
+		if req.Debug {
+			for _, a := range rep.Retries {
+				log.Printf("Retried: %s failure on %q in %v, exit %v %s",
+					a.Failure, a.Worker, a.Duration, a.Exit, a.Error)
+			}
+		}
 		os.Stdout.Write([]byte(rep.Stdout))
 		os.Stderr.Write([]byte(rep.Stderr))
 
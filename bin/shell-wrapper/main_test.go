@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseShellArgs(t *testing.T) {
+	for _, c := range []struct {
+		args    []string
+		ok      bool
+		options []string
+		cmd     string
+		direct  bool
+	}{
+		{[]string{"-ec", "echo hi"}, true, []string{"-e"}, "echo hi", true},
+		{[]string{"-ce", "echo hi"}, true, []string{"-e"}, "echo hi", true},
+		{[]string{"-e", "-o", "pipefail", "-c", "cmd"}, true, []string{"-e", "-o", "pipefail"}, "cmd", false},
+		{[]string{"-ecx", "cmd"}, true, []string{"-ex"}, "cmd", false},
+		// Plain -c is left to the flag package.
+		{[]string{"-c", "cmd"}, true, nil, "cmd", true},
+		{[]string{"-e", "-c", "cmd", "extra"}, false, nil, "", false},
+		{[]string{"-e", "-o", "-c", "cmd"}, false, nil, "", false},
+		{[]string{"-ek", "cmd"}, false, nil, "", false},
+		{[]string{"cmd"}, false, nil, "", false},
+	} {
+		options, cmd, ok := parseShellArgs(c.args)
+		if ok != c.ok || cmd != c.cmd || !reflect.DeepEqual(options, c.options) {
+			t.Errorf("parseShellArgs(%q): got %q %q %v, want %q %q %v",
+				c.args, options, cmd, ok, c.options, c.cmd, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		shellOptions = options
+		if direct := directOptions(); direct != c.direct {
+			t.Errorf("directOptions() for %q: got %v, want %v", c.args, direct, c.direct)
+		}
+	}
+	shellOptions = nil
+}
+
+func TestCleanEnv(t *testing.T) {
+	got := cleanEnv([]string{
+		"MAKE=termite-make",
+		"MAKE_SHELL=/bin/sh",
+		"PATH=/bin",
+		"TERMITE_SESSION=host-1-2",
+		"TERMITE_SESSION_JOBS=4",
+	})
+	want := []string{"MAKE=make", "PATH=/bin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
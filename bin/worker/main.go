@@ -52,8 +52,11 @@ func OpenUniqueLog(base string) *os.File {
 }
 
 func main() {
+	termite.MaybeRunSandbox()
+
 	version := flag.Bool("version", false, "print version and exit.")
 	mkbox := flag.String("mkbox_path", "termite-mkbox", "path to the termite-mkbox binary.")
+	sandbox := flag.String("sandbox", "", "sandbox mode: mkbox or userns. If empty, use mkbox when running as root, and userns otherwise.")
 	cachedir := flag.String("cachedir", "/var/tmp/_termite_cache_"+os.Getenv("USER"), "termite worker content cache")
 	tmpdir := flag.String("tmpdir", "/var/tmp",
 		"where to create FUSE mounts; should be on same partition as cachedir.")
@@ -67,6 +70,8 @@ func main() {
 	logfile := flag.String("logfile", "", "Output log file to use.")
 	stderrFile := flag.String("stderr", "", "File to write stderr output to.")
 	paranoia := flag.Bool("paranoia", false, "Check attribute cache.")
+	mountPolicy := flag.String("mount-policy", "", "JSON file with the sandbox mount policy. If empty, use the default policy.")
+	shareNetwork := flag.Bool("share-network", false, "let tasks use the worker's network. By default, they only have loopback.")
 	cpus := flag.Int("cpus", 1, "Number of CPUs to use.")
 	heap := flag.Int("heap-size", 0, "Maximum heap size in MB.")
 	flag.Parse()
@@ -102,22 +107,38 @@ func main() {
 		f.Close()
 	}
 
-	if _, err := os.Lstat(*mkbox); err != nil {
+	if *sandbox == termite.SandboxUserNS {
+		*mkbox = ""
+	} else if _, err := os.Lstat(*mkbox); err != nil {
 		if path, err := exec.LookPath(*mkbox); err == nil {
 			*mkbox = path
-		} else {
+		} else if *sandbox == termite.SandboxMkbox || os.Geteuid() == 0 {
 			log.Fatalf("could not find %q", *mkbox)
+		} else {
+			*mkbox = ""
+		}
+	}
+
+	var policy *termite.MountPolicy
+	if *mountPolicy != "" {
+		var err error
+		policy, err = termite.ReadMountPolicy(*mountPolicy)
+		if err != nil {
+			log.Fatalf("ReadMountPolicy: %v", err)
 		}
 	}
 
 	opts := termite.WorkerOptions{
-		Mkbox:       *mkbox,
-		Secret:      secret,
-		TempDir:     *tmpdir,
-		Jobs:        *jobs,
-		Paranoia:    *paranoia,
-		ReapCount:   *reapcount,
-		LogFileName: *logfile,
+		Mkbox:        *mkbox,
+		Sandbox:      *sandbox,
+		Secret:       secret,
+		TempDir:      *tmpdir,
+		Jobs:         *jobs,
+		Paranoia:     *paranoia,
+		ShareNetwork: *shareNetwork,
+		MountPolicy:  policy,
+		ReapCount:    *reapcount,
+		LogFileName:  *logfile,
 		StoreOptions: cba.StoreOptions{
 			Dir: *cachedir,
 		},
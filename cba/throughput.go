@@ -53,6 +53,14 @@ func (st *Store) ThroughputStats() []stats.Sample {
 	return st.throughput.Diffs()
 }
 
+// TotalThroughput returns the number of content bytes received and
+// served since startup.
+func (st *Store) TotalThroughput() (received, served uint64) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return uint64(st.bytesReceived), uint64(st.bytesServed)
+}
+
 func (st *Store) addThroughput(received, served int64) {
 	st.mutex.Lock()
 	defer st.mutex.Unlock()
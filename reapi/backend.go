@@ -0,0 +1,794 @@
+package reapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/hanwen/go-fuse/fuse"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/termite"
+)
+
+// Blobs up to this size are sent with BatchUpdateBlobs; larger ones
+// use ByteStream.
+const maxBatchSize = 1 << 20
+
+// Backend runs termite requests on a Remote Execution API service.
+//
+// The input root of an action is the writable root of the master;
+// other files, such as compilers in /usr, must be present on the
+// remote side. The whole input root is collected as output, and
+// compared with the input to find the changes.
+//
+// Like a worker, the backend is a client of the attribute cache, so
+// it only rebuilds the directories that changed since the last
+// task. Blobs the service has are not offered again, and output
+// directories that equal the input are not downloaded.
+type Backend struct {
+	instance   string
+	exec       repb.ExecutionClient
+	cas        repb.ContentAddressableStorageClient
+	byteStream bspb.ByteStreamClient
+
+	mu sync.Mutex
+	// Store hash => SHA-256 digest.
+	digests map[string]*repb.Digest
+
+	// Hashes of the blobs the service has.
+	uploaded map[string]bool
+
+	// Input directories by path, dropped when the attributes
+	// below them change.
+	dirs map[string]*dirNode
+
+	// Counts attribute updates, so trees built while one arrives
+	// are not cached.
+	generation int
+
+	// The attribute cache we get updates from.
+	attributes *attr.AttributeCache
+}
+
+func NewBackend(conn grpc.ClientConnInterface, instance string) *Backend {
+	return &Backend{
+		instance:   instance,
+		exec:       repb.NewExecutionClient(conn),
+		cas:        repb.NewContentAddressableStorageClient(conn),
+		byteStream: bspb.NewByteStreamClient(conn),
+		digests:    map[string]*repb.Digest{},
+		uploaded:   map[string]bool{},
+		dirs:       map[string]*dirNode{},
+	}
+}
+
+// dirNode is a directory of the input root.
+type dirNode struct {
+	digest   *repb.Digest
+	dir      *repb.Directory
+	children map[string]*dirNode
+}
+
+// inputBuild collects the new parts of an input root.
+type inputBuild struct {
+	blobs map[string]*blob
+	dirs  map[string]*dirNode
+}
+
+func (b *Backend) Id() string {
+	return fmt.Sprintf("reapi-backend-%p", b)
+}
+
+// Send implements attr.AttributeCacheClient. It drops the cached
+// directories that contain the changed files.
+func (b *Backend) Send(files []*attr.FileAttr) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range files {
+		for p := f.Path; ; p, _ = attr.SplitPath(p) {
+			delete(b.dirs, p)
+			if p == "" {
+				break
+			}
+		}
+	}
+	b.generation++
+	return nil
+}
+
+// sync subscribes to the attribute cache, and applies its pending
+// updates.
+func (b *Backend) sync(attributes *attr.AttributeCache) error {
+	b.mu.Lock()
+	if b.attributes != attributes {
+		if b.attributes != nil {
+			b.attributes.RmClient(b)
+		}
+		b.attributes = attributes
+		b.dirs = map[string]*dirNode{}
+		b.generation++
+		attributes.AddClient(b)
+	}
+	b.mu.Unlock()
+	return attributes.Send(b)
+}
+
+// forget drops what we know about the contents of the service, eg.
+// because it evicted blobs.
+func (b *Backend) forget() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.uploaded = map[string]bool{}
+	b.dirs = map[string]*dirNode{}
+	b.generation++
+}
+
+// addBlob adds bl to the blobs to upload, unless the service has it.
+func (b *Backend) addBlob(blobs map[string]*blob, bl *blob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.uploaded[bl.digest.Hash] {
+		blobs[bl.digest.Hash] = bl
+	}
+}
+
+// blob is something to upload: either data, or a file.
+type blob struct {
+	digest *repb.Digest
+	data   []byte
+	path   string
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+func addProto(blobs map[string]*blob, m proto.Message) (*repb.Digest, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	d := &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+	blobs[d.Hash] = &blob{digest: d, data: data}
+	return d, nil
+}
+
+// fileDigest returns the digest of a file in the store.
+func (b *Backend) fileDigest(store *cba.Store, hash string) (*repb.Digest, error) {
+	b.mu.Lock()
+	d := b.digests[hash]
+	b.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	f, err := os.Open(store.Path(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	d = &repb.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: n}
+
+	b.mu.Lock()
+	b.digests[hash] = d
+	b.mu.Unlock()
+	return d, nil
+}
+
+// inputTree returns the directory name, which is relative to the
+// root of the file system. Directories that are not cached are added
+// to build, along with the blobs the service misses.
+func (b *Backend) inputTree(inputs *termite.BackendInputs, name string, build *inputBuild) (*dirNode, error) {
+	b.mu.Lock()
+	node := b.dirs[name]
+	b.mu.Unlock()
+	if node != nil {
+		return node, nil
+	}
+
+	a := inputs.Attributes.GetDir(name)
+	if a.Deletion() || !a.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", name)
+	}
+	var names []string
+	for n := range a.NameModeMap {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	node = &dirNode{
+		dir:      &repb.Directory{},
+		children: map[string]*dirNode{},
+	}
+	for _, n := range names {
+		p := joinPath(name, n)
+		c := inputs.Attributes.Get(p)
+		switch {
+		case c.Deletion():
+			// Eg. the socket, or private files.
+			continue
+		case c.IsDir():
+			sub, err := b.inputTree(inputs, p, build)
+			if err != nil {
+				return nil, err
+			}
+			node.dir.Directories = append(node.dir.Directories, &repb.DirectoryNode{Name: n, Digest: sub.digest})
+			node.children[n] = sub
+		case c.IsSymlink():
+			node.dir.Symlinks = append(node.dir.Symlinks, &repb.SymlinkNode{Name: n, Target: c.Link})
+		case c.IsRegular():
+			d, err := b.fileDigest(inputs.Store, c.Hash)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", p, err)
+			}
+			node.dir.Files = append(node.dir.Files, &repb.FileNode{Name: n, Digest: d, IsExecutable: c.Mode&0111 != 0})
+			b.addBlob(build.blobs, &blob{digest: d, path: inputs.Store.Path(c.Hash)})
+		}
+	}
+
+	protoBlobs := map[string]*blob{}
+	d, err := addProto(protoBlobs, node.dir)
+	if err != nil {
+		return nil, err
+	}
+	b.addBlob(build.blobs, protoBlobs[d.Hash])
+	node.digest = d
+	build.dirs[name] = node
+	return node, nil
+}
+
+// commit caches the directories of build after they were uploaded,
+// unless the attributes changed since generation.
+func (b *Backend) commit(build *inputBuild, generation int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for h := range build.blobs {
+		b.uploaded[h] = true
+	}
+	if b.generation != generation {
+		return
+	}
+	for name, node := range build.dirs {
+		b.dirs[name] = node
+	}
+}
+
+func fileMode(exec bool) uint32 {
+	if exec {
+		return syscall.S_IFREG | 0755
+	}
+	return syscall.S_IFREG | 0644
+}
+
+// newCommand converts a request to a command that runs in the
+// writable root.
+func newCommand(req *termite.WorkRequest, root string) (*repb.Command, error) {
+	dir, err := filepath.Rel(root, req.Dir)
+	if err != nil || dir == ".." || strings.HasPrefix(dir, "../") {
+		return nil, fmt.Errorf("directory %s is outside the writable root %s", req.Dir, root)
+	}
+
+	argv := append([]string{}, req.Argv...)
+	argv[0] = req.Binary
+	if rel, err := filepath.Rel(req.Dir, req.Binary); err == nil && strings.HasPrefix(req.Binary, root+"/") {
+		if !strings.Contains(rel, "/") {
+			rel = "./" + rel
+		}
+		argv[0] = rel
+	}
+	if dir != "." {
+		// The output paths are relative to the working
+		// directory, so we can't use WorkingDirectory.
+		argv = append([]string{"/bin/sh", "-c", `cd "$0" && exec "$@"`, dir}, argv...)
+	}
+
+	cmd := &repb.Command{
+		Arguments: argv,
+		// The empty path denotes the working directory.
+		OutputPaths:       []string{""},
+		OutputDirectories: []string{""},
+		// We compare the output with the input by directory,
+		// so we don't need the Tree with all of them.
+		OutputDirectoryFormat: repb.Command_DIRECTORY_ONLY,
+	}
+	env := append([]string{}, req.Env...)
+	sort.Strings(env)
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		cmd.EnvironmentVariables = append(cmd.EnvironmentVariables,
+			&repb.Command_EnvironmentVariable{Name: kv[0], Value: kv[1]})
+	}
+	return cmd, nil
+}
+
+func (b *Backend) resourceName(d *repb.Digest, upload bool) string {
+	n := fmt.Sprintf("blobs/%s/%d", d.Hash, d.SizeBytes)
+	if upload {
+		n = fmt.Sprintf("uploads/%x/%s", termite.RandomBytes(16), n)
+	}
+	if b.instance != "" {
+		n = b.instance + "/" + n
+	}
+	return n
+}
+
+// upload sends the blobs the server doesn't have yet.
+func (b *Backend) upload(ctx context.Context, blobs map[string]*blob) error {
+	req := &repb.FindMissingBlobsRequest{InstanceName: b.instance}
+	for _, bl := range blobs {
+		req.BlobDigests = append(req.BlobDigests, bl.digest)
+	}
+	missing, err := b.cas.FindMissingBlobs(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	batch := &repb.BatchUpdateBlobsRequest{InstanceName: b.instance}
+	batchSize := int64(0)
+	flush := func() error {
+		if len(batch.Requests) == 0 {
+			return nil
+		}
+		rep, err := b.cas.BatchUpdateBlobs(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, r := range rep.Responses {
+			if err := status.ErrorProto(r.Status); err != nil {
+				return fmt.Errorf("upload %s: %v", r.Digest.GetHash(), err)
+			}
+		}
+		batch.Requests = nil
+		batchSize = 0
+		return nil
+	}
+
+	for _, d := range missing.MissingBlobDigests {
+		bl := blobs[d.Hash]
+		if bl == nil {
+			return fmt.Errorf("server reports unknown blob %s missing", d.Hash)
+		}
+		if bl.digest.SizeBytes > maxBatchSize {
+			if err := b.write(ctx, bl); err != nil {
+				return err
+			}
+			continue
+		}
+		data := bl.data
+		if data == nil {
+			if data, err = ioutil.ReadFile(bl.path); err != nil {
+				return err
+			}
+		}
+		if batchSize+int64(len(data)) > maxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch.Requests = append(batch.Requests, &repb.BatchUpdateBlobsRequest_Request{
+			Digest: bl.digest,
+			Data:   data,
+		})
+		batchSize += int64(len(data))
+	}
+	return flush()
+}
+
+func (b *Backend) write(ctx context.Context, bl *blob) error {
+	var f io.Reader = bytes.NewReader(bl.data)
+	if bl.data == nil {
+		file, err := os.Open(bl.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		f = file
+	}
+	stream, err := b.byteStream.Write(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := b.resourceName(bl.digest, true)
+	buf := make([]byte, readChunkSize)
+	var off int64
+	for {
+		n, err := f.Read(buf)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last := off+int64(n) >= bl.digest.SizeBytes
+		if err := stream.Send(&bspb.WriteRequest{
+			ResourceName: name,
+			WriteOffset:  off,
+			FinishWrite:  last,
+			Data:         buf[:n],
+		}); err != nil {
+			return err
+		}
+		name = ""
+		off += int64(n)
+		if last {
+			break
+		}
+		if n == 0 {
+			return fmt.Errorf("blob %s: short read", bl.digest.Hash)
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// download writes the blob to w.
+func (b *Backend) download(ctx context.Context, d *repb.Digest, w io.Writer) error {
+	if d.GetSizeBytes() == 0 {
+		return nil
+	}
+	stream, err := b.byteStream.Read(ctx, &bspb.ReadRequest{
+		ResourceName: b.resourceName(d, false),
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		rep, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(rep.Data); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Backend) downloadProto(ctx context.Context, d *repb.Digest, m proto.Message) error {
+	buf := &bytes.Buffer{}
+	if err := b.download(ctx, d, buf); err != nil {
+		return err
+	}
+	return proto.Unmarshal(buf.Bytes(), m)
+}
+
+// execute runs the action, and waits for its result.
+func (b *Backend) execute(ctx context.Context, action *repb.Digest) (*repb.ActionResult, error) {
+	stream, err := b.exec.Execute(ctx, &repb.ExecuteRequest{
+		InstanceName: b.instance,
+		ActionDigest: action,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, err := stream.Recv()
+		if err == io.EOF {
+			return nil, fmt.Errorf("execute %s: stream ended before completion", action.Hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !op.Done {
+			continue
+		}
+		if err := status.ErrorProto(op.GetError()); err != nil {
+			return nil, err
+		}
+		rep := &repb.ExecuteResponse{}
+		if err := op.GetResponse().UnmarshalTo(rep); err != nil {
+			return nil, err
+		}
+		if err := status.ErrorProto(rep.Status); err != nil {
+			return nil, err
+		}
+		return rep.Result, nil
+	}
+}
+
+// kinds returns the names of the entries of dir, with their type.
+func kinds(dir *repb.Directory) map[string]attr.FileMode {
+	names := map[string]attr.FileMode{}
+	if dir == nil {
+		return names
+	}
+	for _, f := range dir.Files {
+		names[f.Name] = attr.FileMode(syscall.S_IFREG)
+	}
+	for _, l := range dir.Symlinks {
+		names[l.Name] = attr.FileMode(syscall.S_IFLNK)
+	}
+	for _, d := range dir.Directories {
+		names[d.Name] = attr.FileMode(syscall.S_IFDIR)
+	}
+	return names
+}
+
+// outputs compares an output directory with the input, and records
+// the changes.
+type outputs struct {
+	ctx    context.Context
+	store  *cba.Store
+	prefix string
+	now    time.Time
+	fset   *attr.FileSet
+
+	// fetch returns an output directory by digest.
+	fetch func(d *repb.Digest) (*repb.Directory, error)
+}
+
+func (o *outputs) add(rel string, mode uint32) *attr.FileAttr {
+	a := &attr.FileAttr{
+		Path: joinPath(o.prefix, rel),
+		Attr: &fuse.Attr{Mode: mode},
+	}
+	a.SetTimes(&o.now, &o.now, &o.now)
+	o.fset.Files = append(o.fset.Files, a)
+	return a
+}
+
+// changes adds the differences between the input directory in,
+// which may be nil, and the output directory out at rel. Directories
+// with the same digest in both are skipped.
+func (b *Backend) changes(o *outputs, rel string, in *dirNode, out *repb.Directory) error {
+	var inDir *repb.Directory
+	if in != nil {
+		inDir = in.dir
+	}
+	before := kinds(inDir)
+	after := kinds(out)
+	for n, k := range before {
+		// Changes of type need a deletion first.
+		if after[n] != k {
+			o.fset.Files = append(o.fset.Files, &attr.FileAttr{Path: joinPath(o.prefix, joinPath(rel, n))})
+		}
+	}
+
+	inFiles := map[string]*repb.FileNode{}
+	inLinks := map[string]string{}
+	if inDir != nil {
+		for _, f := range inDir.Files {
+			inFiles[f.Name] = f
+		}
+		for _, l := range inDir.Symlinks {
+			inLinks[l.Name] = l.Target
+		}
+	}
+
+	for _, f := range out.Files {
+		if old := inFiles[f.Name]; old != nil && old.Digest.GetHash() == f.Digest.GetHash() && old.IsExecutable == f.IsExecutable {
+			continue
+		}
+		p := joinPath(rel, f.Name)
+		w := o.store.NewHashWriter()
+		err := b.download(o.ctx, f.Digest, w)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("output %s: %v", p, err)
+		}
+		a := o.add(p, fileMode(f.IsExecutable))
+		a.Hash = w.Sum()
+		a.Size = uint64(f.Digest.GetSizeBytes())
+
+		b.mu.Lock()
+		b.digests[a.Hash] = f.Digest
+		b.uploaded[f.Digest.GetHash()] = true
+		b.mu.Unlock()
+	}
+
+	for _, l := range out.Symlinks {
+		if target, ok := inLinks[l.Name]; ok && target == l.Target {
+			continue
+		}
+		a := o.add(joinPath(rel, l.Name), syscall.S_IFLNK|0777)
+		a.Link = l.Target
+		a.Size = uint64(len(l.Target))
+	}
+
+	for _, d := range out.Directories {
+		var sub *dirNode
+		if before[d.Name] == attr.FileMode(syscall.S_IFDIR) {
+			sub = in.children[d.Name]
+			if sub.digest.GetHash() == d.Digest.GetHash() {
+				continue
+			}
+		}
+		dir, err := o.fetch(d.Digest)
+		if err != nil {
+			return err
+		}
+		p := joinPath(rel, d.Name)
+		if sub == nil {
+			// Changes inside existing directories are
+			// reported separately.
+			a := o.add(p, syscall.S_IFDIR|0755)
+			a.NameModeMap = kinds(dir)
+		}
+		if err := b.changes(o, p, sub, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchDirectory returns a fetch function for outputs, which
+// downloads the directories, or takes them from the tree if the
+// service only returned that.
+func (b *Backend) fetchDirectory(ctx context.Context, tree *repb.Tree) (func(*repb.Digest) (*repb.Directory, error), error) {
+	if tree == nil {
+		return func(d *repb.Digest) (*repb.Directory, error) {
+			dir := &repb.Directory{}
+			err := b.downloadProto(ctx, d, dir)
+			return dir, err
+		}, nil
+	}
+
+	children := map[string]*repb.Directory{}
+	for _, c := range tree.Children {
+		d, err := addProto(map[string]*blob{}, c)
+		if err != nil {
+			return nil, err
+		}
+		children[d.Hash] = c
+	}
+	return func(d *repb.Digest) (*repb.Directory, error) {
+		c := children[d.GetHash()]
+		if c == nil {
+			return nil, fmt.Errorf("tree misses directory %s", d.GetHash())
+		}
+		return c, nil
+	}, nil
+}
+
+// action uploads the action for the request, and runs it.
+func (b *Backend) action(ctx context.Context, inputs *termite.BackendInputs, req *termite.WorkRequest) (*repb.ActionResult, *dirNode, error) {
+	b.mu.Lock()
+	generation := b.generation
+	b.mu.Unlock()
+
+	build := &inputBuild{
+		blobs: map[string]*blob{},
+		dirs:  map[string]*dirNode{},
+	}
+	root, err := b.inputTree(inputs, strings.TrimLeft(inputs.WritableRoot, "/"), build)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd, err := newCommand(req, inputs.WritableRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmdDigest, err := addProto(build.blobs, cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	actionDigest, err := addProto(build.blobs, &repb.Action{
+		CommandDigest:   cmdDigest,
+		InputRootDigest: root.digest,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := b.upload(ctx, build.blobs); err != nil {
+		return nil, nil, err
+	}
+	b.commit(build, generation)
+
+	result, err := b.execute(ctx, actionDigest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, root, nil
+}
+
+func (b *Backend) Run(inputs *termite.BackendInputs, req *termite.WorkRequest, rep *termite.WorkResponse) error {
+	ctx := context.Background()
+	if err := b.sync(inputs.Attributes); err != nil {
+		return err
+	}
+
+	result, root, err := b.action(ctx, inputs, req)
+	if status.Code(err) == codes.FailedPrecondition {
+		// The service dropped blobs that we uploaded before.
+		b.forget()
+		result, root, err = b.action(ctx, inputs, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	rep.Exit = syscall.WaitStatus(uint32(result.ExitCode&0xff) << 8)
+	rep.WorkerId = result.ExecutionMetadata.GetWorker()
+	for _, o := range []struct {
+		raw []byte
+		d   *repb.Digest
+		out *string
+	}{
+		{result.StdoutRaw, result.StdoutDigest, &rep.Stdout},
+		{result.StderrRaw, result.StderrDigest, &rep.Stderr},
+	} {
+		if o.raw != nil || o.d == nil {
+			*o.out = string(o.raw)
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := b.download(ctx, o.d, buf); err != nil {
+			return err
+		}
+		*o.out = buf.String()
+	}
+
+	for _, od := range result.OutputDirectories {
+		if od.Path != "" {
+			continue
+		}
+		var tree *repb.Tree
+		rootDigest := od.RootDirectoryDigest
+		if rootDigest == nil {
+			// The service ignored OutputDirectoryFormat.
+			tree = &repb.Tree{}
+			if err := b.downloadProto(ctx, od.TreeDigest, tree); err != nil {
+				return err
+			}
+		}
+		fetch, err := b.fetchDirectory(ctx, tree)
+		if err != nil {
+			return err
+		}
+
+		o := &outputs{
+			ctx:    ctx,
+			store:  inputs.Store,
+			prefix: strings.TrimLeft(inputs.WritableRoot, "/"),
+			now:    time.Now(),
+			fset:   &attr.FileSet{},
+			fetch:  fetch,
+		}
+		out := tree.GetRoot()
+		if out == nil {
+			if out, err = fetch(rootDigest); err != nil {
+				return err
+			}
+		}
+		if err := b.changes(o, "", root, out); err != nil {
+			return err
+		}
+		o.fset.Sort()
+		rep.FileSet = o.fset
+		return nil
+	}
+	return fmt.Errorf("no output tree for %v", req.Argv)
+}
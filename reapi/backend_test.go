@@ -0,0 +1,292 @@
+package reapi
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/hanwen/go-fuse/fuse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/stats"
+	"github.com/hanwen/termite/termite"
+)
+
+type backendTestCase struct {
+	*testCase
+	grpcServer *grpc.Server
+	conn       *grpc.ClientConn
+	backend    *Backend
+
+	root   string
+	store  *cba.Store
+	inputs *termite.BackendInputs
+
+	// Number of blobs asked for in FindMissingBlobs.
+	offered int32
+}
+
+// newBackendTestCase runs a Server as stand-in for a remote
+// execution service, and sets up the files of a master.
+func newBackendTestCase(t *testing.T) *backendTestCase {
+	tc := &backendTestCase{testCase: newTestCase(t)}
+
+	listener := bufconn.Listen(1 << 20)
+	tc.grpcServer = grpc.NewServer(grpc.UnaryInterceptor(
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if r, ok := req.(*repb.FindMissingBlobsRequest); ok {
+				atomic.AddInt32(&tc.offered, int32(len(r.BlobDigests)))
+			}
+			return handler(ctx, req)
+		}))
+	tc.server.Register(tc.grpcServer)
+	go tc.grpcServer.Serve(listener)
+
+	var err error
+	tc.conn, err = grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	tc.backend = NewBackend(tc.conn, "")
+
+	tc.root = filepath.Join(tc.tmp, "root")
+	os.Mkdir(tc.root, 0755)
+	tc.store = cba.NewStore(&cba.StoreOptions{
+		Dir: filepath.Join(tc.tmp, "master-cache"),
+	}, stats.NewTimerStats())
+	attributes := attr.NewAttributeCache(func(n string) *attr.FileAttr {
+		fi, _ := os.Lstat("/" + n)
+		a := &attr.FileAttr{Path: n, Attr: fuse.ToAttr(fi)}
+		if fi == nil {
+			return a
+		}
+		if a.IsRegular() {
+			a.Hash = tc.store.SavePath("/" + n)
+		} else {
+			a.ReadFromFs("/"+n, tc.store.Options.Hash)
+		}
+		return a
+	}, func(n string) *fuse.Attr {
+		fi, _ := os.Lstat("/" + n)
+		return fuse.ToAttr(fi)
+	})
+	tc.inputs = &termite.BackendInputs{
+		Attributes:   attributes,
+		Store:        tc.store,
+		WritableRoot: tc.root,
+	}
+	return tc
+}
+
+func (tc *backendTestCase) Clean() {
+	tc.conn.Close()
+	tc.grpcServer.Stop()
+	tc.testCase.Clean()
+}
+
+func TestBackendRun(t *testing.T) {
+	tc := newBackendTestCase(t)
+	defer tc.Clean()
+
+	ioutil.WriteFile(filepath.Join(tc.root, "in.txt"), []byte("hello\n"), 0644)
+	ioutil.WriteFile(filepath.Join(tc.root, "old.txt"), []byte("old\n"), 0644)
+	os.Mkdir(filepath.Join(tc.root, "sub"), 0755)
+
+	req := &termite.WorkRequest{
+		Binary: "/bin/sh",
+		Argv:   []string{"sh", "-c", "cat ../in.txt > out.txt && rm ../old.txt && mkdir new && echo x > new/y && echo ok"},
+		Env:    []string{"PATH=/bin:/usr/bin"},
+		Dir:    filepath.Join(tc.root, "sub"),
+	}
+	rep := &termite.WorkResponse{}
+	if err := tc.backend.Run(tc.inputs, req, rep); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rep.Exit.ExitStatus() != 0 || rep.Stdout != "ok\n" {
+		t.Fatalf("unexpected response: %v %q %q", rep.Exit, rep.Stdout, rep.Stderr)
+	}
+
+	prefix := strings.TrimLeft(tc.root, "/") + "/"
+	got := map[string]*attr.FileAttr{}
+	for _, f := range rep.FileSet.Files {
+		got[strings.TrimPrefix(f.Path, prefix)] = f
+	}
+	if len(got) != 4 {
+		t.Errorf("want 4 changes, got %v", rep.FileSet.Files)
+	}
+	if f := got["old.txt"]; f == nil || !f.Deletion() {
+		t.Errorf("old.txt should be deleted: %v", f)
+	}
+	if f := got["sub/new"]; f == nil || !f.IsDir() || f.NameModeMap["y"] == 0 {
+		t.Errorf("sub/new should be a directory with y: %v", f)
+	}
+	for n, want := range map[string]string{"sub/out.txt": "hello\n", "sub/new/y": "x\n"} {
+		f := got[n]
+		if f == nil || f.Hash == "" {
+			t.Errorf("%s missing: %v", n, f)
+			continue
+		}
+		if content, _ := ioutil.ReadFile(tc.store.Path(f.Hash)); string(content) != want {
+			t.Errorf("%s: got %q, want %q", n, content, want)
+		}
+	}
+	if got["in.txt"] != nil || got["sub"] != nil {
+		t.Errorf("unchanged files reported: %v", rep.FileSet.Files)
+	}
+}
+
+func TestBackendIncremental(t *testing.T) {
+	tc := newBackendTestCase(t)
+	defer tc.Clean()
+
+	for _, d := range []string{"a", "b"} {
+		os.Mkdir(filepath.Join(tc.root, d), 0755)
+		for i := 0; i < 5; i++ {
+			ioutil.WriteFile(filepath.Join(tc.root, d, fmt.Sprintf("f%d", i)), []byte(d+fmt.Sprint(i)), 0644)
+		}
+	}
+	run := func() string {
+		rep := &termite.WorkResponse{}
+		req := &termite.WorkRequest{
+			Binary: "/bin/sh",
+			Argv:   []string{"sh", "-c", "cat a/f0 b/f0"},
+			Dir:    tc.root,
+		}
+		if err := tc.backend.Run(tc.inputs, req, rep); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		return rep.Stdout
+	}
+	if out := run(); out != "a0b0" {
+		t.Fatalf("got %q", out)
+	}
+
+	// The master updates the attributes after a change.
+	ioutil.WriteFile(filepath.Join(tc.root, "a", "f0"), []byte("new"), 0644)
+	tc.inputs.Attributes.Queue(tc.inputs.Attributes.Refresh(""))
+
+	atomic.StoreInt32(&tc.offered, 0)
+	if out := run(); out != "newb0" {
+		t.Errorf("got %q after change", out)
+	}
+	// The file, the directories a and root, the command and the
+	// action.
+	if n := atomic.LoadInt32(&tc.offered); n != 5 {
+		t.Errorf("offered %d blobs, want 5", n)
+	}
+	if tc.backend.dirs[strings.TrimLeft(filepath.Join(tc.root, "b"), "/")] == nil {
+		t.Errorf("unchanged directory b not cached")
+	}
+
+	// Blobs the service lost are uploaded again.
+	tc.server.store = cba.NewStore(&cba.StoreOptions{
+		Dir:  filepath.Join(tc.tmp, "new-cache"),
+		Hash: crypto.SHA256,
+	}, stats.NewTimerStats())
+	tc.server.actionCache = map[string]*repb.ActionResult{}
+	if out := run(); out != "newb0" {
+		t.Errorf("got %q after losing blobs", out)
+	}
+}
+
+func TestBackendExitCode(t *testing.T) {
+	tc := newBackendTestCase(t)
+	defer tc.Clean()
+
+	req := &termite.WorkRequest{
+		Binary: "/bin/sh",
+		Argv:   []string{"sh", "-c", "echo fail >&2; exit 2"},
+		Dir:    tc.root,
+	}
+	rep := &termite.WorkResponse{}
+	if err := tc.backend.Run(tc.inputs, req, rep); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rep.Exit.ExitStatus() != 2 || rep.Stderr != "fail\n" {
+		t.Errorf("unexpected response: %v %q", rep.Exit, rep.Stderr)
+	}
+	if len(rep.FileSet.Files) != 0 {
+		t.Errorf("unexpected changes: %v", rep.FileSet.Files)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+	tc.server.options.Secret = []byte("sesame")
+
+	listener := bufconn.Listen(1 << 20)
+	g := grpc.NewServer(tc.server.GRPCOptions()...)
+	tc.server.Register(g)
+	go g.Serve(listener)
+	defer g.Stop()
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	client := repb.NewCapabilitiesClient(conn)
+	if _, err := client.GetCapabilities(context.Background(), &repb.GetCapabilitiesRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v without secret, want Unauthenticated", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), SecretHeader, "sesame")
+	if _, err := client.GetCapabilities(ctx, &repb.GetCapabilitiesRequest{}); err != nil {
+		t.Errorf("GetCapabilities with secret: %v", err)
+	}
+	stream, err := repb.NewExecutionClient(conn).Execute(context.Background(), &repb.ExecuteRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v for stream without secret, want Unauthenticated", err)
+	}
+}
+
+func TestNewCommand(t *testing.T) {
+	req := &termite.WorkRequest{
+		Binary: "/src/bin/tool",
+		Argv:   []string{"tool", "-x"},
+		Env:    []string{"B=2", "A=1"},
+		Dir:    "/src/sub",
+	}
+	cmd, err := newCommand(req, "/src")
+	if err != nil {
+		t.Fatalf("newCommand: %v", err)
+	}
+	want := []string{"/bin/sh", "-c", `cd "$0" && exec "$@"`, "sub", "../bin/tool", "-x"}
+	if strings.Join(cmd.Arguments, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q", cmd.Arguments, want)
+	}
+	if cmd.EnvironmentVariables[0].Name != "A" {
+		t.Errorf("environment not sorted: %v", cmd.EnvironmentVariables)
+	}
+
+	req.Dir = "/elsewhere"
+	if _, err := newCommand(req, "/src"); err == nil {
+		t.Errorf("expected error for directory outside root")
+	}
+}
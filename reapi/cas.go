@@ -0,0 +1,237 @@
+package reapi
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) GetCapabilities(ctx context.Context, req *repb.GetCapabilitiesRequest) (*repb.ServerCapabilities, error) {
+	return &repb.ServerCapabilities{
+		CacheCapabilities: &repb.CacheCapabilities{
+			DigestFunctions: []repb.DigestFunction_Value{repb.DigestFunction_SHA256},
+			ActionCacheUpdateCapabilities: &repb.ActionCacheUpdateCapabilities{
+				UpdateEnabled: true,
+			},
+			SymlinkAbsolutePathStrategy: repb.SymlinkAbsolutePathStrategy_DISALLOWED,
+		},
+		ExecutionCapabilities: &repb.ExecutionCapabilities{
+			DigestFunction: repb.DigestFunction_SHA256,
+			ExecEnabled:    true,
+		},
+		LowApiVersion:  &semver.SemVer{Major: 2},
+		HighApiVersion: &semver.SemVer{Major: 2},
+	}, nil
+}
+
+func (s *Server) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	rep := &repb.FindMissingBlobsResponse{}
+	for _, d := range req.BlobDigests {
+		if _, err := key(d); err != nil {
+			return nil, err
+		}
+		if !s.has(d) {
+			rep.MissingBlobDigests = append(rep.MissingBlobDigests, d)
+		}
+	}
+	return rep, nil
+}
+
+func (s *Server) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	rep := &repb.BatchUpdateBlobsResponse{}
+	for _, r := range req.Requests {
+		st := status.New(codes.OK, "")
+		if err := checkDigest(r.Digest, r.Data); err != nil {
+			st = status.New(codes.InvalidArgument, err.Error())
+		} else {
+			s.saveBlob(r.Data)
+		}
+		rep.Responses = append(rep.Responses, &repb.BatchUpdateBlobsResponse_Response{
+			Digest: r.Digest,
+			Status: st.Proto(),
+		})
+	}
+	return rep, nil
+}
+
+func (s *Server) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	rep := &repb.BatchReadBlobsResponse{}
+	for _, d := range req.Digests {
+		data, err := s.readBlob(d)
+		st := status.New(codes.OK, "")
+		if err != nil {
+			st = status.Convert(err)
+		}
+		rep.Responses = append(rep.Responses, &repb.BatchReadBlobsResponse_Response{
+			Digest: d,
+			Data:   data,
+			Status: st.Proto(),
+		})
+	}
+	return rep, nil
+}
+
+func (s *Server) GetTree(req *repb.GetTreeRequest, stream repb.ContentAddressableStorage_GetTreeServer) error {
+	rep := &repb.GetTreeResponse{}
+	todo := []*repb.Digest{req.RootDigest}
+	for len(todo) > 0 {
+		d := todo[0]
+		todo = todo[1:]
+		dir := &repb.Directory{}
+		if err := s.readProto(d, dir); err != nil {
+			return err
+		}
+		rep.Directories = append(rep.Directories, dir)
+		for _, sub := range dir.Directories {
+			todo = append(todo, sub.Digest)
+		}
+	}
+	return stream.Send(rep)
+}
+
+func (s *Server) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	k, err := key(req.ActionDigest)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.actionCache[k]
+	if r == nil {
+		return nil, status.Errorf(codes.NotFound, "no result for %s", req.ActionDigest.Hash)
+	}
+	return r, nil
+}
+
+func (s *Server) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	k, err := key(req.ActionDigest)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actionCache[k] = req.ActionResult
+	return req.ActionResult, nil
+}
+
+// parseResourceName extracts the digest from a ByteStream resource
+// name, which looks like "[instance/]blobs/HASH/SIZE" for reads, and
+// "[instance/]uploads/UUID/blobs/HASH/SIZE[/...]" for writes.
+func parseResourceName(name string) (*repb.Digest, error) {
+	comps := strings.Split(name, "/")
+	for i, c := range comps {
+		if c != "blobs" || i+2 >= len(comps) {
+			continue
+		}
+		size, err := strconv.ParseInt(comps[i+2], 10, 64)
+		if err != nil {
+			break
+		}
+		d := &repb.Digest{Hash: comps[i+1], SizeBytes: size}
+		if _, err := key(d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "invalid resource name %q", name)
+}
+
+// Size of the chunks for ByteStream reads.
+const readChunkSize = 64 * 1024
+
+func (s *Server) Read(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	d, err := parseResourceName(req.ResourceName)
+	if err != nil {
+		return err
+	}
+	if req.ReadOffset < 0 || req.ReadOffset > d.SizeBytes || req.ReadLimit < 0 {
+		return status.Errorf(codes.OutOfRange, "invalid range %d+%d", req.ReadOffset, req.ReadLimit)
+	}
+	if d.SizeBytes == 0 {
+		return stream.Send(&bspb.ReadResponse{})
+	}
+	k, _ := key(d)
+	if !s.store.Has(k) {
+		return status.Errorf(codes.NotFound, "blob %s not found", d.Hash)
+	}
+	f, err := os.Open(s.store.Path(k))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	remaining := d.SizeBytes - req.ReadOffset
+	if req.ReadLimit > 0 && req.ReadLimit < remaining {
+		remaining = req.ReadLimit
+	}
+	buf := make([]byte, readChunkSize)
+	off := req.ReadOffset
+	for remaining > 0 {
+		n := int64(len(buf))
+		if n > remaining {
+			n = remaining
+		}
+		got, err := f.ReadAt(buf[:n], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if got == 0 {
+			return status.Errorf(codes.DataLoss, "blob %s truncated", d.Hash)
+		}
+		if err := stream.Send(&bspb.ReadResponse{Data: buf[:got]}); err != nil {
+			return err
+		}
+		off += int64(got)
+		remaining -= int64(got)
+	}
+	return nil
+}
+
+func (s *Server) Write(stream bspb.ByteStream_WriteServer) error {
+	var d *repb.Digest
+	w := s.store.NewHashWriter()
+	var written int64
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			w.Close()
+			return err
+		}
+		if d == nil {
+			if d, err = parseResourceName(req.ResourceName); err != nil {
+				w.Close()
+				return err
+			}
+		}
+		if req.WriteOffset != written {
+			w.Close()
+			return status.Errorf(codes.InvalidArgument, "write at %d, expected %d", req.WriteOffset, written)
+		}
+		if _, err := w.Write(req.Data); err != nil {
+			w.Close()
+			return err
+		}
+		written += int64(len(req.Data))
+		if req.FinishWrite {
+			break
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// The store uses SHA-256, so its hash is the digest.
+	if got := hex.EncodeToString([]byte(w.Sum())); got != d.Hash || written != d.SizeBytes {
+		return status.Errorf(codes.InvalidArgument,
+			"digest mismatch: got %s/%d, want %s/%d", got, written, d.Hash, d.SizeBytes)
+	}
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: written})
+}
@@ -0,0 +1,65 @@
+package reapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// DialOptions configure the connection of a Backend to a remote
+// execution service.
+type DialOptions struct {
+	// Use TLS. The certificate of the service is checked against
+	// the certificates in CAFile, which implies TLS, or else the
+	// system roots.
+	TLS    bool
+	CAFile string
+
+	// If set, sent in the SecretHeader header, as a termite reapi
+	// server with -secret wants.
+	Secret []byte
+}
+
+// GRPCOptions returns the options for grpc.Dial.
+func (o *DialOptions) GRPCOptions() ([]grpc.DialOption, error) {
+	creds := insecure.NewCredentials()
+	if o.TLS || o.CAFile != "" {
+		config := &tls.Config{}
+		if o.CAFile != "" {
+			pem, err := ioutil.ReadFile(o.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificates", o.CAFile)
+			}
+		}
+		creds = credentials.NewTLS(config)
+	}
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if len(o.Secret) > 0 {
+		opts = append(opts, grpc.WithPerRPCCredentials(secretCredentials(o.Secret)))
+	}
+	return opts, nil
+}
+
+// secretCredentials sends the secret with each call.
+type secretCredentials []byte
+
+func (c secretCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{SecretHeader: string(c)}, nil
+}
+
+// RequireTransportSecurity allows the secret on plain connections,
+// like the server does, eg. for a service on localhost.
+func (c secretCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,94 @@
+package reapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// selfSigned returns a certificate for host, and writes it to a PEM
+// file in dir.
+func selfSigned(t *testing.T, dir, host string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	name := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, name
+}
+
+func TestDialOptions(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+	tc.server.options.Secret = []byte("sesame")
+
+	cert, caFile := selfSigned(t, tc.tmp, "bufnet")
+	listener := bufconn.Listen(1 << 20)
+	g := grpc.NewServer(append(tc.server.GRPCOptions(),
+		grpc.Creds(credentials.NewServerTLSFromCert(&cert)))...)
+	tc.server.Register(g)
+	go g.Serve(listener)
+	defer g.Stop()
+
+	capabilities := func(o *DialOptions) error {
+		opts, err := o.GRPCOptions()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+		conn, err := grpc.Dial("bufnet", opts...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = repb.NewCapabilitiesClient(conn).GetCapabilities(ctx, &repb.GetCapabilitiesRequest{})
+		return err
+	}
+
+	if err := capabilities(&DialOptions{CAFile: caFile, Secret: []byte("sesame")}); err != nil {
+		t.Errorf("GetCapabilities over TLS: %v", err)
+	}
+	if err := capabilities(&DialOptions{CAFile: caFile}); err == nil {
+		t.Error("GetCapabilities without secret succeeded")
+	}
+	if err := capabilities(&DialOptions{Secret: []byte("sesame")}); err == nil {
+		t.Error("GetCapabilities without TLS succeeded")
+	}
+	if _, err := (&DialOptions{CAFile: filepath.Join(tc.tmp, "missing")}).GRPCOptions(); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
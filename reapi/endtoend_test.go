@@ -0,0 +1,232 @@
+package reapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/termite"
+)
+
+// endToEndTestCase runs a coordinator, a worker and a master, and
+// serves the API for the master on a real gRPC connection.
+type endToEndTestCase struct {
+	tester      *testing.T
+	tmp         string
+	coordinator *termite.Coordinator
+	worker      *termite.Worker
+	grpcServer  *grpc.Server
+	conn        *grpc.ClientConn
+}
+
+func pickPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func newEndToEndTestCase(t *testing.T) *endToEndTestCase {
+	mkbox, err := filepath.Abs("../bin/mkbox/mkbox")
+	if err != nil {
+		t.Fatalf("Abs: %v", err)
+	}
+	if _, err := os.Stat(mkbox); err != nil || os.Geteuid() != 0 {
+		t.Skip("needs root and a built bin/mkbox")
+	}
+
+	tmp, _ := ioutil.TempDir("", "reapi")
+	tc := &endToEndTestCase{tester: t, tmp: tmp}
+	termiteSecret := termite.RandomBytes(20)
+
+	tc.coordinator = termite.NewCoordinator(&termite.CoordinatorOptions{Secret: termiteSecret})
+	go tc.coordinator.PeriodicCheck()
+	coordinatorPort := pickPort(t)
+	go tc.coordinator.ServeHTTP(coordinatorPort)
+	coordinatorAddr := fmt.Sprintf("localhost:%d", coordinatorPort)
+
+	workerTmp := filepath.Join(tmp, "worker-tmp")
+	os.Mkdir(workerTmp, 0700)
+	tc.worker = termite.NewWorker(&termite.WorkerOptions{
+		Secret:         termiteSecret,
+		TempDir:        workerTmp,
+		StoreOptions:   cba.StoreOptions{Dir: filepath.Join(tmp, "worker-cache")},
+		Jobs:           1,
+		ReportInterval: 100 * time.Millisecond,
+		Coordinator:    coordinatorAddr,
+		PortRetry:      10,
+		Mkbox:          mkbox,
+	})
+	go tc.worker.RunWorkerServer()
+
+	wd := filepath.Join(tmp, "wd")
+	os.MkdirAll(wd, 0755)
+	socket := filepath.Join(wd, "master-socket")
+	master := termite.NewMaster(&termite.MasterOptions{
+		WritableRoot:  wd,
+		RetryCount:    2,
+		Secret:        termiteSecret,
+		MaxJobs:       1,
+		Coordinator:   coordinatorAddr,
+		KeepAlive:     500 * time.Millisecond,
+		Period:        500 * time.Millisecond,
+		ExposePrivate: true,
+		StoreOptions:  cba.StoreOptions{Dir: filepath.Join(tmp, "master-cache")},
+		Socket:        socket,
+	})
+	go master.Start()
+	for i := 0; tc.coordinator.WorkerCount() == 0; i++ {
+		if i > 20 {
+			t.Fatal("no live workers")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for i := 0; ; i++ {
+		if _, err := os.Lstat(socket); err == nil {
+			break
+		}
+		if i > 20 {
+			t.Fatal("master socket did not appear")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	server, err := NewServer(&Options{
+		CacheDir: filepath.Join(tmp, "reapi-cache"),
+		WorkDir:  filepath.Join(wd, ".termite-reapi"),
+		Runner:   &MasterRunner{Socket: socket},
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	listener := bufconn.Listen(1 << 20)
+	tc.grpcServer = grpc.NewServer()
+	server.Register(tc.grpcServer)
+	go tc.grpcServer.Serve(listener)
+
+	tc.conn, err = grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return tc
+}
+
+func (tc *endToEndTestCase) Clean() {
+	tc.conn.Close()
+	tc.grpcServer.Stop()
+	tc.worker.Shutdown(&termite.ShutdownRequest{}, &termite.ShutdownResponse{})
+	tc.coordinator.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	os.RemoveAll(tc.tmp)
+}
+
+func digestBytes(data []byte) *repb.Digest {
+	sum := sha256.Sum256(data)
+	return &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+}
+
+// upload plays a Bazel client, sending blobs over gRPC.
+func (tc *endToEndTestCase) upload(ctx context.Context, blobs ...[]byte) error {
+	req := &repb.BatchUpdateBlobsRequest{}
+	for _, b := range blobs {
+		req.Requests = append(req.Requests, &repb.BatchUpdateBlobsRequest_Request{
+			Digest: digestBytes(b),
+			Data:   b,
+		})
+	}
+	rep, err := repb.NewContentAddressableStorageClient(tc.conn).BatchUpdateBlobs(ctx, req)
+	if err != nil {
+		return err
+	}
+	for _, r := range rep.Responses {
+		if err := status.ErrorProto(r.Status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func marshal(t *testing.T, m proto.Message) []byte {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return data
+}
+
+func TestEndToEnd(t *testing.T) {
+	tc := newEndToEndTestCase(t)
+	defer tc.Clean()
+	ctx := context.Background()
+
+	in := []byte("hello\n")
+	input := marshal(t, &repb.Directory{
+		Files: []*repb.FileNode{{Name: "in.txt", Digest: digestBytes(in)}},
+	})
+	cmd := marshal(t, &repb.Command{
+		Arguments:   []string{"/bin/sh", "-c", "cat in.txt in.txt > out/twice.txt"},
+		OutputFiles: []string{"out/twice.txt"},
+	})
+	action := marshal(t, &repb.Action{
+		CommandDigest:   digestBytes(cmd),
+		InputRootDigest: digestBytes(input),
+	})
+	if err := tc.upload(ctx, in, input, cmd, action); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	stream, err := repb.NewExecutionClient(tc.conn).Execute(ctx, &repb.ExecuteRequest{
+		ActionDigest: digestBytes(action),
+	})
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	op, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	rep := &repb.ExecuteResponse{}
+	if err := op.GetResponse().UnmarshalTo(rep); err != nil {
+		t.Fatalf("UnmarshalTo: %v", err)
+	}
+	if err := status.ErrorProto(rep.Status); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	if rep.Result.ExitCode != 0 || len(rep.Result.OutputFiles) != 1 {
+		t.Fatalf("unexpected result %v", rep.Result)
+	}
+	if w := rep.Result.ExecutionMetadata.GetWorker(); w == "" || w == "local" {
+		t.Errorf("not run on a worker: %q", w)
+	}
+
+	read, err := repb.NewContentAddressableStorageClient(tc.conn).BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+		Digests: []*repb.Digest{rep.Result.OutputFiles[0].Digest},
+	})
+	if err != nil || status.ErrorProto(read.Responses[0].Status) != nil {
+		t.Fatalf("BatchReadBlobs: %v %v", err, read)
+	}
+	if got := string(read.Responses[0].Data); got != "hello\nhello\n" {
+		t.Errorf("got output %q", got)
+	}
+}
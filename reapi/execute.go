@@ -0,0 +1,208 @@
+package reapi
+
+import (
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	lpb "google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/hanwen/termite/termite"
+)
+
+// MasterRunner runs requests on the termite master listening on
+// Socket.
+type MasterRunner struct {
+	Socket string
+}
+
+func (r *MasterRunner) call(method string, req, rep interface{}) error {
+	conn := termite.OpenSocketConnection(r.Socket, termite.RPC_CHANNEL, 10*time.Second)
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	return client.Call(method, req, rep)
+}
+
+func (r *MasterRunner) Refresh(dir string) error {
+	rep := 1
+	return r.call("LocalMaster.RefreshDirectory", &dir, &rep)
+}
+
+func (r *MasterRunner) Run(req *termite.WorkRequest, rep *termite.WorkResponse) error {
+	return r.call("LocalMaster.Run", req, rep)
+}
+
+func (s *Server) Execute(req *repb.ExecuteRequest, stream repb.Execution_ExecuteServer) error {
+	op := &lpb.Operation{
+		Name: fmt.Sprintf("operations/%s", req.GetActionDigest().GetHash()),
+		Done: true,
+	}
+	md, err := anypb.New(&repb.ExecuteOperationMetadata{
+		Stage:        repb.ExecutionStage_COMPLETED,
+		ActionDigest: req.ActionDigest,
+	})
+	if err != nil {
+		return err
+	}
+	op.Metadata = md
+
+	rep, err := s.execute(req)
+	if err != nil {
+		rep = &repb.ExecuteResponse{Status: status.Convert(err).Proto()}
+	}
+	result, err := anypb.New(rep)
+	if err != nil {
+		return err
+	}
+	op.Result = &lpb.Operation_Response{Response: result}
+	return stream.Send(op)
+}
+
+func (s *Server) execute(req *repb.ExecuteRequest) (*repb.ExecuteResponse, error) {
+	actionKey, err := key(req.ActionDigest)
+	if err != nil {
+		return nil, err
+	}
+	action := &repb.Action{}
+	if err := s.readProto(req.ActionDigest, action); err != nil {
+		return nil, missing(err)
+	}
+
+	if !req.SkipCacheLookup && !action.DoNotCache {
+		s.mu.Lock()
+		cached := s.actionCache[actionKey]
+		s.mu.Unlock()
+		if cached != nil {
+			return &repb.ExecuteResponse{Result: cached, CachedResult: true}, nil
+		}
+	}
+
+	cmd := &repb.Command{}
+	if err := s.readProto(action.CommandDigest, cmd); err != nil {
+		return nil, missing(err)
+	}
+	if len(cmd.Arguments) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "command has no arguments")
+	}
+	outputs := append(append(append([]string{}, cmd.OutputFiles...), cmd.OutputDirectories...), cmd.OutputPaths...)
+	for _, p := range append([]string{cmd.WorkingDirectory}, outputs...) {
+		if err := checkPath(p); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.nextActionId++
+	execRoot := filepath.Join(s.options.WorkDir, fmt.Sprintf("action%d-%x", s.nextActionId, actionKey[:4]))
+	s.mu.Unlock()
+	defer os.RemoveAll(execRoot)
+
+	if err := s.materialize(action.InputRootDigest, execRoot, execRoot); err != nil {
+		return nil, missing(err)
+	}
+	for _, p := range outputs {
+		// The API requires parent dirs of outputs to exist.
+		if err := mkdirUnder(execRoot, filepath.Dir(filepath.Join(cmd.WorkingDirectory, p))); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "output %q: %v", p, err)
+		}
+	}
+
+	workReq, err := newWorkRequest(cmd, execRoot)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if action.Timeout != nil {
+		workReq.Timeout = action.Timeout.AsDuration()
+	}
+	if err := s.options.Runner.Refresh(execRoot); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "refresh: %v", err)
+	}
+
+	start := time.Now()
+	workRep := &termite.WorkResponse{}
+	if err := s.options.Runner.Run(workReq, workRep); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "run: %v", err)
+	}
+	end := time.Now()
+
+	result := &repb.ActionResult{
+		ExitCode:     int32(workRep.Exit.ExitStatus()),
+		StdoutDigest: s.saveBlob([]byte(workRep.Stdout)),
+		StderrDigest: s.saveBlob([]byte(workRep.Stderr)),
+		ExecutionMetadata: &repb.ExecutedActionMetadata{
+			Worker:                      workRep.WorkerId,
+			ExecutionStartTimestamp:     timestamppb.New(start),
+			ExecutionCompletedTimestamp: timestamppb.New(end),
+		},
+	}
+	if workRep.Exit.Signaled() {
+		result.ExitCode = int32(128 + workRep.Exit.Signal())
+	}
+	if err := s.collectOutputs(cmd, execRoot, result); err != nil {
+		return nil, status.Errorf(codes.Internal, "outputs: %v", err)
+	}
+	log.Printf("executed %x: %v, exit %d", actionKey, cmd.Arguments, result.ExitCode)
+
+	if result.ExitCode == 0 && !action.DoNotCache {
+		s.mu.Lock()
+		s.actionCache[actionKey] = result
+		s.mu.Unlock()
+	}
+	return &repb.ExecuteResponse{Result: result}, nil
+}
+
+// missing converts NotFound errors for inputs into the
+// FailedPrecondition that clients expect for missing blobs.
+func missing(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return status.Errorf(codes.FailedPrecondition, "%v", status.Convert(err).Message())
+	}
+	return err
+}
+
+// newWorkRequest converts a command to a termite request.
+func newWorkRequest(cmd *repb.Command, execRoot string) (*termite.WorkRequest, error) {
+	req := &termite.WorkRequest{
+		Argv: cmd.Arguments,
+		Dir:  filepath.Join(execRoot, cmd.WorkingDirectory),
+	}
+	path := ""
+	for _, e := range cmd.EnvironmentVariables {
+		req.Env = append(req.Env, e.Name+"="+e.Value)
+		if e.Name == "PATH" {
+			path = e.Value
+		}
+	}
+
+	bin := cmd.Arguments[0]
+	switch {
+	case filepath.IsAbs(bin):
+		req.Binary = bin
+	case strings.Contains(bin, "/"):
+		req.Binary = filepath.Join(req.Dir, bin)
+	default:
+		for _, d := range filepath.SplitList(path) {
+			if !filepath.IsAbs(d) {
+				d = filepath.Join(req.Dir, d)
+			}
+			cand := filepath.Join(d, bin)
+			if fi, err := os.Stat(cand); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+				req.Binary = cand
+				break
+			}
+		}
+	}
+	if req.Binary == "" {
+		return nil, fmt.Errorf("%q not found in PATH %q", bin, path)
+	}
+	return req, nil
+}
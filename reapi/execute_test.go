@@ -0,0 +1,382 @@
+package reapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/hanwen/termite/termite"
+)
+
+// localRunner runs requests directly, standing in for a master with a
+// local worker.
+type localRunner struct {
+	runs int
+
+	// The last refreshed directory and request.
+	refreshed string
+	last      *termite.WorkRequest
+}
+
+func (r *localRunner) Refresh(dir string) error {
+	r.refreshed = dir
+	return nil
+}
+
+func (r *localRunner) Run(req *termite.WorkRequest, rep *termite.WorkResponse) error {
+	r.runs++
+	r.last = req
+	var stdout, stderr bytes.Buffer
+	cmd := &exec.Cmd{
+		Path:   req.Binary,
+		Args:   req.Argv,
+		Env:    req.Env,
+		Dir:    req.Dir,
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return err
+	}
+	rep.Exit = cmd.ProcessState.Sys().(syscall.WaitStatus)
+	rep.Stdout = stdout.String()
+	rep.Stderr = stderr.String()
+	rep.WorkerId = "local"
+	return nil
+}
+
+type testCase struct {
+	tester *testing.T
+	tmp    string
+	runner *localRunner
+	server *Server
+}
+
+func newTestCase(t *testing.T) *testCase {
+	tmp, _ := ioutil.TempDir("", "reapi")
+	tc := &testCase{
+		tester: t,
+		tmp:    tmp,
+		runner: &localRunner{},
+	}
+	var err error
+	tc.server, err = NewServer(&Options{
+		CacheDir: filepath.Join(tmp, "cache"),
+		WorkDir:  filepath.Join(tmp, "work"),
+		Runner:   tc.runner,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return tc
+}
+
+func (tc *testCase) Clean() {
+	os.RemoveAll(tc.tmp)
+}
+
+// upload plays the client, sending a blob with BatchUpdateBlobs.
+func (tc *testCase) upload(data []byte) *repb.Digest {
+	sum := sha256.Sum256(data)
+	d := &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+	rep, err := tc.server.BatchUpdateBlobs(context.Background(), &repb.BatchUpdateBlobsRequest{
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{{Digest: d, Data: data}},
+	})
+	if err != nil || rep.Responses[0].Status.Code != int32(codes.OK) {
+		tc.tester.Fatalf("BatchUpdateBlobs: %v %v", err, rep)
+	}
+	return d
+}
+
+func (tc *testCase) uploadProto(m proto.Message) *repb.Digest {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		tc.tester.Fatalf("Marshal: %v", err)
+	}
+	return tc.upload(data)
+}
+
+func (tc *testCase) read(d *repb.Digest) []byte {
+	rep, err := tc.server.BatchReadBlobs(context.Background(), &repb.BatchReadBlobsRequest{
+		Digests: []*repb.Digest{d},
+	})
+	if err != nil || rep.Responses[0].Status.Code != int32(codes.OK) {
+		tc.tester.Fatalf("BatchReadBlobs: %v %v", err, rep)
+	}
+	return rep.Responses[0].Data
+}
+
+func (tc *testCase) action(cmd *repb.Command, input *repb.Directory) *repb.Digest {
+	return tc.uploadProto(&repb.Action{
+		CommandDigest:   tc.uploadProto(cmd),
+		InputRootDigest: tc.uploadProto(input),
+	})
+}
+
+func TestExecute(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+
+	in := tc.upload([]byte("hello\n"))
+	input := &repb.Directory{
+		Directories: []*repb.DirectoryNode{{
+			Name: "src",
+			Digest: tc.uploadProto(&repb.Directory{
+				Files: []*repb.FileNode{{Name: "in.txt", Digest: in}},
+			}),
+		}},
+	}
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-c", "cat src/in.txt src/in.txt > out/twice.txt && echo done"},
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "PATH", Value: "/bin:/usr/bin"},
+		},
+		OutputFiles: []string{"out/twice.txt"},
+	}
+	actionDigest := tc.action(cmd, input)
+
+	rep, err := tc.server.execute(&repb.ExecuteRequest{ActionDigest: actionDigest})
+	if err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	res := rep.Result
+	if res.ExitCode != 0 || len(res.OutputFiles) != 1 {
+		t.Fatalf("unexpected result %v", res)
+	}
+	if got := string(tc.read(res.OutputFiles[0].Digest)); got != "hello\nhello\n" {
+		t.Errorf("output: got %q", got)
+	}
+	if got := string(tc.read(res.StdoutDigest)); got != "done\n" {
+		t.Errorf("stdout: got %q", got)
+	}
+
+	rep, err = tc.server.execute(&repb.ExecuteRequest{ActionDigest: actionDigest})
+	if err != nil || !rep.CachedResult {
+		t.Errorf("expected cached result: %v %v", rep, err)
+	}
+	if tc.runner.runs != 1 {
+		t.Errorf("got %d runs, want 1", tc.runner.runs)
+	}
+}
+
+func TestExecuteOutputDirectory(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+
+	cmd := &repb.Command{
+		Arguments:         []string{"/bin/sh", "-c", "mkdir -p gen/sub && echo x > gen/sub/x && ln -s sub/x gen/l"},
+		OutputDirectories: []string{"gen"},
+	}
+	rep, err := tc.server.execute(&repb.ExecuteRequest{
+		ActionDigest: tc.action(cmd, &repb.Directory{}),
+	})
+	if err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	if len(rep.Result.OutputDirectories) != 1 {
+		t.Fatalf("unexpected result %v", rep.Result)
+	}
+	tree := &repb.Tree{}
+	if err := proto.Unmarshal(tc.read(rep.Result.OutputDirectories[0].TreeDigest), tree); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(tree.Root.Symlinks) != 1 || tree.Root.Symlinks[0].Target != "sub/x" {
+		t.Errorf("symlinks: %v", tree.Root.Symlinks)
+	}
+	if len(tree.Children) != 1 || len(tree.Children[0].Files) != 1 {
+		t.Fatalf("children: %v", tree.Children)
+	}
+	if got := string(tc.read(tree.Children[0].Files[0].Digest)); got != "x\n" {
+		t.Errorf("file: got %q", got)
+	}
+
+	// With DIRECTORY_ONLY, we get the root Directory instead.
+	cmd.Arguments[2] += " && echo again"
+	cmd.OutputDirectoryFormat = repb.Command_DIRECTORY_ONLY
+	rep, err = tc.server.execute(&repb.ExecuteRequest{
+		ActionDigest: tc.action(cmd, &repb.Directory{}),
+	})
+	if err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	out := rep.Result.OutputDirectories[0]
+	root := &repb.Directory{}
+	if out.TreeDigest != nil || proto.Unmarshal(tc.read(out.RootDirectoryDigest), root) != nil {
+		t.Fatalf("unexpected output %v", out)
+	}
+	if !proto.Equal(root, tree.Root) {
+		t.Errorf("got root %v, want %v", root, tree.Root)
+	}
+}
+
+func TestExecuteFailure(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+
+	actionDigest := tc.action(&repb.Command{
+		Arguments: []string{"/bin/sh", "-c", "exit 3"},
+	}, &repb.Directory{})
+	for i := 0; i < 2; i++ {
+		rep, err := tc.server.execute(&repb.ExecuteRequest{ActionDigest: actionDigest})
+		if err != nil {
+			t.Fatalf("execute: %v", err)
+		}
+		if rep.Result.ExitCode != 3 || rep.CachedResult {
+			t.Errorf("unexpected result %v", rep)
+		}
+	}
+	if tc.runner.runs != 2 {
+		t.Errorf("failures should not be cached; got %d runs", tc.runner.runs)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+
+	actionDigest := tc.uploadProto(&repb.Action{
+		CommandDigest: tc.uploadProto(&repb.Command{
+			Arguments:        []string{"/bin/true"},
+			WorkingDirectory: "sub",
+		}),
+		InputRootDigest: tc.uploadProto(&repb.Directory{
+			Directories: []*repb.DirectoryNode{{Name: "sub", Digest: tc.uploadProto(&repb.Directory{})}},
+		}),
+		Timeout: durationpb.New(5 * time.Second),
+	})
+	if _, err := tc.server.execute(&repb.ExecuteRequest{ActionDigest: actionDigest}); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	if req := tc.runner.last; req == nil || req.Timeout != 5*time.Second {
+		t.Errorf("got request %v, want timeout 5s", req)
+	}
+
+	// Only the input root of the action is refreshed.
+	if dir := tc.runner.refreshed; filepath.Dir(dir) != filepath.Join(tc.tmp, "work") ||
+		filepath.Join(dir, "sub") != tc.runner.last.Dir {
+		t.Errorf("refreshed %q for a task in %q", dir, tc.runner.last.Dir)
+	}
+}
+
+func TestExecuteMissingInput(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+
+	input := &repb.Directory{
+		Files: []*repb.FileNode{{
+			Name:   "missing",
+			Digest: &repb.Digest{Hash: hex.EncodeToString(make([]byte, 32)), SizeBytes: 10},
+		}},
+	}
+	_, err := tc.server.execute(&repb.ExecuteRequest{
+		ActionDigest: tc.action(&repb.Command{Arguments: []string{"/bin/true"}}, input),
+	})
+	if err == nil {
+		t.Fatalf("expected error for missing input")
+	}
+}
+
+func TestExecuteEscapingInput(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+
+	// A symlink x made before the directory x would let the
+	// directory be written outside the root.
+	input := &repb.Directory{
+		Directories: []*repb.DirectoryNode{{
+			Name: "x",
+			Digest: tc.uploadProto(&repb.Directory{
+				Files: []*repb.FileNode{{Name: "escaped", Digest: tc.upload([]byte("x"))}},
+			}),
+		}},
+		Symlinks: []*repb.SymlinkNode{{Name: "x", Target: "../../.."}},
+	}
+	if _, err := tc.server.execute(&repb.ExecuteRequest{
+		ActionDigest: tc.action(&repb.Command{Arguments: []string{"/bin/true"}}, input),
+	}); err == nil {
+		t.Errorf("expected error for duplicate name")
+	}
+
+	input.Directories = nil
+	if _, err := tc.server.execute(&repb.ExecuteRequest{
+		ActionDigest: tc.action(&repb.Command{Arguments: []string{"/bin/true"}}, input),
+	}); err == nil {
+		t.Errorf("expected error for symlink leaving the root")
+	}
+	if _, err := os.Lstat(filepath.Join(tc.tmp, "escaped")); err == nil {
+		t.Errorf("file written outside the root")
+	}
+}
+
+func TestExecuteEscapingOutput(t *testing.T) {
+	tc := newTestCase(t)
+	defer tc.Clean()
+
+	for _, cmd := range []*repb.Command{
+		{Arguments: []string{"/bin/true"}, OutputFiles: []string{"../../out"}},
+		{Arguments: []string{"/bin/true"}, OutputPaths: []string{"/etc/passwd"}},
+		{Arguments: []string{"/bin/true"}, WorkingDirectory: "a/../.."},
+	} {
+		_, err := tc.server.execute(&repb.ExecuteRequest{ActionDigest: tc.action(cmd, &repb.Directory{})})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: got %v, want InvalidArgument", cmd, err)
+		}
+	}
+
+	// Outputs are not read through symlinks made by the command.
+	secret := filepath.Join(tc.tmp, "secret")
+	ioutil.WriteFile(secret, []byte("secret"), 0644)
+	rep, err := tc.server.execute(&repb.ExecuteRequest{ActionDigest: tc.action(&repb.Command{
+		Arguments:         []string{"/bin/sh", "-c", "ln -s " + secret + " out && ln -s " + tc.tmp + " dir"},
+		OutputFiles:       []string{"out"},
+		OutputDirectories: []string{"dir"},
+	}, &repb.Directory{})})
+	if err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	if len(rep.Result.OutputFiles) != 0 || len(rep.Result.OutputDirectories) != 0 {
+		t.Errorf("got outputs through symlinks: %v", rep.Result)
+	}
+
+	_, err = tc.server.execute(&repb.ExecuteRequest{ActionDigest: tc.action(&repb.Command{
+		Arguments:   []string{"/bin/sh", "-c", "rmdir dir && ln -s " + tc.tmp + " dir"},
+		OutputPaths: []string{"dir/secret"},
+	}, &repb.Directory{})})
+	if err == nil {
+		t.Errorf("read an output through a symlinked directory")
+	}
+}
+
+func TestParseResourceName(t *testing.T) {
+	hash := hex.EncodeToString(make([]byte, 32))
+	for _, n := range []string{
+		"blobs/" + hash + "/12",
+		"instance/blobs/" + hash + "/12",
+		"uploads/1234/blobs/" + hash + "/12/extra",
+	} {
+		d, err := parseResourceName(n)
+		if err != nil || d.Hash != hash || d.SizeBytes != 12 {
+			t.Errorf("parseResourceName(%q): %v %v", n, d, err)
+		}
+	}
+	for _, n := range []string{"blobs/abc/12", "blobs/" + hash, "blobs/" + hash + "/x"} {
+		if _, err := parseResourceName(n); err == nil {
+			t.Errorf("parseResourceName(%q) should fail", n)
+		}
+	}
+}
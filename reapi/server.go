@@ -0,0 +1,206 @@
+// Package reapi implements the Bazel Remote Execution API (v2) on
+// top of termite. Actions are executed by a termite master, which
+// farms them out to its workers.
+package reapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/stats"
+	"github.com/hanwen/termite/termite"
+)
+
+// Runner executes a WorkRequest. MasterRunner is the production
+// implementation.
+type Runner interface {
+	// Refresh makes the runner see files that were written to
+	// dir, an input root in the work directory.
+	Refresh(dir string) error
+
+	Run(req *termite.WorkRequest, rep *termite.WorkResponse) error
+}
+
+type Options struct {
+	// Directory for the content store.
+	CacheDir string
+
+	// Directory where input roots are unpacked. Must be inside the
+	// writable root of the master, so the outputs are written back.
+	WorkDir string
+
+	Runner Runner
+
+	// If set, clients must send it in the SecretHeader header.
+	Secret []byte
+}
+
+// SecretHeader is the gRPC header holding Options.Secret. With Bazel,
+// pass --remote_header=x-termite-secret=SECRET.
+const SecretHeader = "x-termite-secret"
+
+// Server implements the Execution, ContentAddressableStorage,
+// ActionCache, Capabilities and ByteStream services.
+type Server struct {
+	repb.UnimplementedExecutionServer
+	repb.UnimplementedContentAddressableStorageServer
+	repb.UnimplementedActionCacheServer
+	repb.UnimplementedCapabilitiesServer
+	bspb.UnimplementedByteStreamServer
+
+	options Options
+	store   *cba.Store
+	timings *stats.TimerStats
+
+	mu           sync.Mutex
+	actionCache  map[string]*repb.ActionResult
+	nextActionId int
+}
+
+func NewServer(options *Options) (*Server, error) {
+	o := *options
+	if err := os.MkdirAll(o.WorkDir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		options:     o,
+		timings:     stats.NewTimerStats(),
+		actionCache: map[string]*repb.ActionResult{},
+	}
+	s.store = cba.NewStore(&cba.StoreOptions{
+		Dir:  o.CacheDir,
+		Hash: crypto.SHA256,
+	}, s.timings)
+	return s, nil
+}
+
+// Register registers all services with the gRPC server.
+func (s *Server) Register(g *grpc.Server) {
+	repb.RegisterExecutionServer(g, s)
+	repb.RegisterContentAddressableStorageServer(g, s)
+	repb.RegisterActionCacheServer(g, s)
+	repb.RegisterCapabilitiesServer(g, s)
+	bspb.RegisterByteStreamServer(g, s)
+}
+
+// GRPCOptions returns the options for the gRPC server, which check
+// the secret if one is set.
+func (s *Server) GRPCOptions() []grpc.ServerOption {
+	if len(s.options.Secret) == 0 {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := s.authenticate(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := s.authenticate(stream.Context()); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+}
+
+func (s *Server) authenticate(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(SecretHeader) {
+		if subtle.ConstantTimeCompare([]byte(v), s.options.Secret) == 1 {
+			return nil
+		}
+	}
+	return status.Errorf(codes.Unauthenticated, "missing or wrong %s header", SecretHeader)
+}
+
+// key returns the store key for a digest.
+func key(d *repb.Digest) (string, error) {
+	if d == nil {
+		return "", status.Errorf(codes.InvalidArgument, "missing digest")
+	}
+	raw, err := hex.DecodeString(d.Hash)
+	if err != nil || len(raw) != sha256.Size {
+		return "", status.Errorf(codes.InvalidArgument, "invalid digest %q", d.Hash)
+	}
+	return string(raw), nil
+}
+
+func digestOf(hash string, size int64) *repb.Digest {
+	return &repb.Digest{
+		Hash:      hex.EncodeToString([]byte(hash)),
+		SizeBytes: size,
+	}
+}
+
+// has returns true if the store holds the blob.  The empty blob is
+// always present.
+func (s *Server) has(d *repb.Digest) bool {
+	if d.SizeBytes == 0 {
+		return true
+	}
+	k, err := key(d)
+	return err == nil && s.store.Has(k)
+}
+
+func (s *Server) readBlob(d *repb.Digest) ([]byte, error) {
+	if d.GetSizeBytes() == 0 {
+		return nil, nil
+	}
+	k, err := key(d)
+	if err != nil {
+		return nil, err
+	}
+	if !s.store.Has(k) {
+		return nil, status.Errorf(codes.NotFound, "blob %s not found", d.Hash)
+	}
+	return ioutil.ReadFile(s.store.Path(k))
+}
+
+func (s *Server) saveBlob(data []byte) *repb.Digest {
+	return digestOf(s.store.Save(data), int64(len(data)))
+}
+
+func (s *Server) readProto(d *repb.Digest, m proto.Message) error {
+	data, err := s.readBlob(d)
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(data, m); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%s: %v", d.Hash, err)
+	}
+	return nil
+}
+
+func (s *Server) saveProto(m proto.Message) (*repb.Digest, error) {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return s.saveBlob(data), nil
+}
+
+func checkDigest(d *repb.Digest, data []byte) error {
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != d.GetHash() || int64(len(data)) != d.GetSizeBytes() {
+		return fmt.Errorf("digest mismatch: got %s/%d, want %s/%d", got, len(data), d.GetHash(), d.GetSizeBytes())
+	}
+	return nil
+}
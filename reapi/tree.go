@@ -0,0 +1,312 @@
+package reapi
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+// checkPath checks that a path from the client is relative, and
+// does not leave the directory it is relative to.
+func checkPath(p string) error {
+	c := filepath.Clean(p)
+	if filepath.IsAbs(p) || c == ".." || strings.HasPrefix(c, "../") {
+		return fmt.Errorf("path %q leaves the root", p)
+	}
+	return nil
+}
+
+// resolve returns rel inside root. It fails if a directory on the
+// way is a symlink, as that could point anywhere.
+func resolve(root, rel string) (string, error) {
+	if err := checkPath(rel); err != nil {
+		return "", err
+	}
+	p := root
+	parts := strings.Split(filepath.Clean(rel), "/")
+	for i, c := range parts {
+		if c == "." {
+			continue
+		}
+		p = filepath.Join(p, c)
+		if i == len(parts)-1 {
+			break
+		}
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return filepath.Join(root, filepath.Clean(rel)), nil
+		} else if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%q: %s is not a directory", rel, c)
+		}
+	}
+	return p, nil
+}
+
+// mkdirUnder creates the directory rel inside root and its parents,
+// refusing to go through symlinks.
+func mkdirUnder(root, rel string) error {
+	if err := checkPath(rel); err != nil {
+		return err
+	}
+	p := root
+	for _, c := range strings.Split(filepath.Clean(rel), "/") {
+		if c == "." {
+			continue
+		}
+		p = filepath.Join(p, c)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(p, 0755)
+		} else if err == nil && !fi.IsDir() {
+			err = fmt.Errorf("%q: %s is not a directory", rel, c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// materialize writes the directory tree with the given digest to
+// dir, which must not exist yet. Symlinks must point inside root.
+// They are made last, so nothing is written through them.
+func (s *Server) materialize(d *repb.Digest, dir, root string) error {
+	tree := &repb.Directory{}
+	if err := s.readProto(d, tree); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, sub := range tree.Directories {
+		if err := checkName(sub.Name); err != nil {
+			return err
+		}
+		if err := s.materialize(sub.Digest, filepath.Join(dir, sub.Name), root); err != nil {
+			return err
+		}
+	}
+	for _, f := range tree.Files {
+		if err := checkName(f.Name); err != nil {
+			return err
+		}
+		mode := os.FileMode(0644)
+		if f.IsExecutable {
+			mode = 0755
+		}
+		if err := s.writeFile(f.Digest, filepath.Join(dir, f.Name), mode); err != nil {
+			return err
+		}
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return err
+	}
+	for _, l := range tree.Symlinks {
+		if err := checkName(l.Name); err != nil {
+			return err
+		}
+		if filepath.IsAbs(l.Target) {
+			return fmt.Errorf("absolute symlink %q", l.Target)
+		}
+		if err := checkPath(filepath.Join(rel, l.Target)); err != nil {
+			return fmt.Errorf("symlink %q: %v", l.Name, err)
+		}
+		if err := os.Symlink(l.Target, filepath.Join(dir, l.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile copies a blob out of the store. We don't hardlink, as the
+// store files are read-only and may have the wrong mode. O_EXCL makes
+// sure we don't write through a symlink.
+func (s *Server) writeFile(d *repb.Digest, path string, mode os.FileMode) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if d.GetSizeBytes() == 0 {
+		return nil
+	}
+	k, err := key(d)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(s.store.Path(k))
+	if err != nil {
+		return fmt.Errorf("input %s: %v", d.Hash, err)
+	}
+	defer in.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// saveFile adds the file at path to the store.
+func (s *Server) saveFile(path string) (*repb.Digest, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if fi.Size() == 0 {
+		return s.saveBlob(nil), nil
+	}
+	hash := s.store.SavePath(path)
+	if hash == "" {
+		return nil, fmt.Errorf("could not save %s", path)
+	}
+	return digestOf(hash, fi.Size()), nil
+}
+
+// saveDir adds the directory at path to the store. It returns the
+// Directory message for dir, and adds its descendants to children.
+func (s *Server) saveDir(path string, children *[]*repb.Directory) (*repb.Directory, error) {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := &repb.Directory{}
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name())
+		switch {
+		case e.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return nil, err
+			}
+			dir.Symlinks = append(dir.Symlinks, &repb.SymlinkNode{
+				Name:   e.Name(),
+				Target: target,
+			})
+		case e.IsDir():
+			sub, err := s.saveDir(p, children)
+			if err != nil {
+				return nil, err
+			}
+			d, err := s.saveProto(sub)
+			if err != nil {
+				return nil, err
+			}
+			*children = append(*children, sub)
+			dir.Directories = append(dir.Directories, &repb.DirectoryNode{
+				Name:   e.Name(),
+				Digest: d,
+			})
+		case e.Mode().IsRegular():
+			d, err := s.saveFile(p)
+			if err != nil {
+				return nil, err
+			}
+			dir.Files = append(dir.Files, &repb.FileNode{
+				Name:         e.Name(),
+				Digest:       d,
+				IsExecutable: e.Mode()&0111 != 0,
+			})
+		}
+	}
+	// ReadDir sorts by name, as the API requires.
+	return dir, nil
+}
+
+// collectOutputs adds the outputs of cmd, run in execRoot, to the
+// result. Missing outputs are skipped, as the API prescribes. The
+// empty path denotes the whole working directory. Directories are
+// returned in the format the command asks for. Symlinks are not
+// followed.
+func (s *Server) collectOutputs(cmd *repb.Command, execRoot string, result *repb.ActionResult) error {
+	files := append([]string{}, cmd.OutputFiles...)
+	dirs := append([]string{}, cmd.OutputDirectories...)
+	if len(cmd.OutputPaths) > 0 {
+		// OutputPaths supersedes the older fields.
+		files, dirs = nil, nil
+	}
+	for _, p := range cmd.OutputPaths {
+		abs, err := resolve(execRoot, filepath.Join(cmd.WorkingDirectory, p))
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(abs); err == nil && fi.IsDir() {
+			dirs = append(dirs, p)
+		} else {
+			files = append(files, p)
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(dirs)
+
+	for _, p := range files {
+		abs, err := resolve(execRoot, filepath.Join(cmd.WorkingDirectory, p))
+		if err != nil {
+			return err
+		}
+		fi, err := os.Lstat(abs)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		d, err := s.saveFile(abs)
+		if err != nil {
+			return err
+		}
+		result.OutputFiles = append(result.OutputFiles, &repb.OutputFile{
+			Path:         p,
+			Digest:       d,
+			IsExecutable: fi.Mode()&0111 != 0,
+		})
+	}
+
+	for _, p := range dirs {
+		abs, err := resolve(execRoot, filepath.Join(cmd.WorkingDirectory, p))
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(abs); err != nil || !fi.IsDir() {
+			continue
+		}
+		tree := &repb.Tree{}
+		root, err := s.saveDir(abs, &tree.Children)
+		if err != nil {
+			return err
+		}
+		tree.Root = root
+		out := &repb.OutputDirectory{Path: p}
+		if cmd.OutputDirectoryFormat != repb.Command_DIRECTORY_ONLY {
+			if out.TreeDigest, err = s.saveProto(tree); err != nil {
+				return err
+			}
+		}
+		if cmd.OutputDirectoryFormat != repb.Command_TREE_ONLY {
+			if out.RootDirectoryDigest, err = s.saveProto(root); err != nil {
+				return err
+			}
+		}
+		result.OutputDirectories = append(result.OutputDirectories, out)
+	}
+	return nil
+}
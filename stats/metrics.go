@@ -0,0 +1,129 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsWriter writes metrics in the Prometheus text exposition
+// format.
+type MetricsWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{
+		w:    w,
+		seen: map[string]bool{},
+	}
+}
+
+// MetricsContentType is the HTTP Content-Type for the exposition
+// format.
+const MetricsContentType = "text/plain; version=0.0.4"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Counter writes a monotonically increasing value. Labels are given as
+// name, value pairs.
+func (me *MetricsWriter) Counter(name, help string, val float64, labels ...string) {
+	me.write(name, "counter", help, val, labels)
+}
+
+// Gauge writes a value that can go up and down.
+func (me *MetricsWriter) Gauge(name, help string, val float64, labels ...string) {
+	me.write(name, "gauge", help, val, labels)
+}
+
+func (me *MetricsWriter) write(name, kind, help string, val float64, labels []string) {
+	if !me.seen[name] {
+		me.seen[name] = true
+		fmt.Fprintf(me.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	l := ""
+	if len(labels) > 0 {
+		pairs := []string{}
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		l = "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(me.w, "%s%s %s\n", name, l, strconv.FormatFloat(val, 'g', -1, 64))
+}
+
+// WriteMetrics exports the call counts and accumulated time of each
+// timer.
+func (me *TimerStats) WriteMetrics(w *MetricsWriter, prefix string) {
+	t := me.Timings()
+	names := []string{}
+	for n := range t {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		w.Counter(prefix+"_rpc_calls_total", "Number of timed calls.",
+			float64(t[n].N), "name", n)
+	}
+	for _, n := range names {
+		w.Counter(prefix+"_rpc_seconds_total", "Time spent in timed calls.",
+			t[n].Duration.Seconds(), "name", n)
+	}
+}
+
+// WriteMetrics exports the phase counters, and the CPU and disk usage
+// of the last sampled second.
+func (me *ServerStats) WriteMetrics(w *MetricsWriter, prefix string) {
+	me.mutex.Lock()
+	current := map[string]int{}
+	entered := map[string]int{}
+	busy := map[string]time.Duration{}
+	now := time.Now()
+	for _, n := range me.PhaseOrder {
+		current[n] = me.phaseCounts[n]
+		entered[n] = me.phaseEntered[n]
+		busy[n] = me.phaseBusy[n] + time.Duration(me.phaseCounts[n])*now.Sub(me.phaseLastChange[n])
+	}
+	me.mutex.Unlock()
+
+	for _, n := range me.PhaseOrder {
+		w.Gauge(prefix+"_phase_tasks", "Tasks currently in this phase.",
+			float64(current[n]), "phase", n)
+	}
+	for _, n := range me.PhaseOrder {
+		w.Counter(prefix+"_phase_entered_total", "Tasks that entered this phase.",
+			float64(entered[n]), "phase", n)
+	}
+	for _, n := range me.PhaseOrder {
+		w.Counter(prefix+"_phase_seconds_total", "Accumulated time tasks spent in this phase.",
+			busy[n].Seconds(), "phase", n)
+	}
+
+	if cpu := me.CpuStats(); len(cpu) > 0 {
+		last := cpu[len(cpu)-1]
+		w.Gauge(prefix+"_cpu_seconds", "CPU use over the last sampled second.",
+			last.SelfCpu.Seconds(), "kind", "self_user")
+		w.Gauge(prefix+"_cpu_seconds", "", last.SelfSys.Seconds(), "kind", "self_sys")
+		w.Gauge(prefix+"_cpu_seconds", "", last.ChildCpu.Seconds(), "kind", "child_user")
+		w.Gauge(prefix+"_cpu_seconds", "", last.ChildSys.Seconds(), "kind", "child_sys")
+	}
+	if disk := me.DiskStats(); len(disk) > 0 {
+		last := disk[len(disk)-1]
+		w.Gauge(prefix+"_disk_ops", "Disk operations over the last sampled second.",
+			float64(last.ReadsCompleted), "kind", "read")
+		w.Gauge(prefix+"_disk_ops", "", float64(last.WritesCompleted), "kind", "write")
+	}
+}
+
+// WriteMemMetrics exports the heap statistics of the process.
+func WriteMemMetrics(w *MetricsWriter, prefix string) {
+	m := GetMemStat()
+	w.Gauge(prefix+"_heap_bytes", "Heap memory.", float64(m.HeapIdle), "state", "idle")
+	w.Gauge(prefix+"_heap_bytes", "", float64(m.HeapInuse), "state", "inuse")
+}
@@ -0,0 +1,50 @@
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewMetricsWriter(buf)
+	w.Counter("x_total", "help text", 3, "name", "a\"b")
+	w.Counter("x_total", "", 4.5, "name", "c")
+	w.Gauge("y", "other", 1)
+
+	want := "# HELP x_total help text\n" +
+		"# TYPE x_total counter\n" +
+		"x_total{name=\"a\\\"b\"} 3\n" +
+		"x_total{name=\"c\"} 4.5\n" +
+		"# HELP y other\n" +
+		"# TYPE y gauge\n" +
+		"y 1\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestServerStatsMetrics(t *testing.T) {
+	s := NewServerStats()
+	s.PhaseOrder = []string{"run"}
+	s.Enter("run")
+	time.Sleep(10 * time.Millisecond)
+	s.Exit("run")
+
+	buf := &bytes.Buffer{}
+	s.WriteMetrics(NewMetricsWriter(buf), "test")
+	out := buf.String()
+	for _, want := range []string{
+		"test_phase_tasks{phase=\"run\"} 0\n",
+		"test_phase_entered_total{phase=\"run\"} 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %q", want, out)
+		}
+	}
+	if strings.Contains(out, "test_phase_seconds_total{phase=\"run\"} 0\n") {
+		t.Errorf("phase time not accumulated: %q", out)
+	}
+}
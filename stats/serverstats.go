@@ -13,6 +13,12 @@ var _ = log.Println
 type ServerStats struct {
 	mutex       sync.Mutex
 	phaseCounts map[string]int
+
+	// Cumulative data, for exporting as metrics.
+	phaseEntered    map[string]int
+	phaseBusy       map[string]time.Duration
+	phaseLastChange map[string]time.Time
+
 	*CpuStatSampler
 	*DiskStatSampler
 	PhaseOrder []string
@@ -21,6 +27,9 @@ type ServerStats struct {
 func NewServerStats() *ServerStats {
 	return &ServerStats{
 		phaseCounts:     map[string]int{},
+		phaseEntered:    map[string]int{},
+		phaseBusy:       map[string]time.Duration{},
+		phaseLastChange: map[string]time.Time{},
 		CpuStatSampler:  NewCpuStatSampler(),
 		DiskStatSampler: NewDiskStatSampler(),
 	}
@@ -29,15 +38,29 @@ func NewServerStats() *ServerStats {
 func (me *ServerStats) Enter(phase string) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
+	me.accumulate(phase)
 	me.phaseCounts[phase]++
+	me.phaseEntered[phase]++
 }
 
 func (me *ServerStats) Exit(phase string) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
+	me.accumulate(phase)
 	me.phaseCounts[phase]--
 }
 
+// accumulate adds the time spent by all tasks in the phase since the
+// last change. Summed over all tasks, this equals the total time
+// spent in the phase. Must hold lock.
+func (me *ServerStats) accumulate(phase string) {
+	now := time.Now()
+	if last, ok := me.phaseLastChange[phase]; ok {
+		me.phaseBusy[phase] += time.Duration(me.phaseCounts[phase]) * now.Sub(last)
+	}
+	me.phaseLastChange[phase] = now
+}
+
 func CpuStatsWriteHttp(w http.ResponseWriter, stats []CpuStat, disk []DiskStat) {
 	if len(stats) == 0 {
 		return
@@ -129,6 +152,13 @@ func (me *ServerStats) WriteHttp(w http.ResponseWriter) {
 	CountStatsWriteHttp(w, me.PhaseOrder, me.PhaseCounts())
 }
 
+// PhaseCount returns the number of tasks currently in the phase.
+func (me *ServerStats) PhaseCount(phase string) int {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.phaseCounts[phase]
+}
+
 func (me *ServerStats) PhaseCounts() (r []int) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
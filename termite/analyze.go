@@ -24,6 +24,9 @@ func DumpAnnotations(req *WorkRequest, rep *WorkResponse, start time.Time,
 		Target:  req.DeclaredTarget,
 		Reads:   rep.Reads,
 		Command: strings.Join(req.Argv, " "),
+
+		Nondeterminism:  rep.Nondeterminism,
+		UndeclaredReads: rep.UndeclaredReads,
 	}
 
 	slashTopDir := topDir + "/"
@@ -0,0 +1,357 @@
+package termite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Scaler adds workers to, or removes them from the pool.  It is
+// invoked by the coordinator when AutoscaleOptions are set.
+type Scaler interface {
+	// ScaleUp should start n new workers.
+	ScaleUp(n int) error
+
+	// ScaleDown should remove the given workers. They have
+	// already been asked to drain, and exit once their current
+	// tasks are done.
+	ScaleDown(addrs []string) error
+}
+
+type AutoscaleOptions struct {
+	Scaler Scaler
+
+	// Bounds for the number of workers in the pool.
+	MinWorkers int
+	MaxWorkers int
+
+	// Minimum time between two scaling actions.
+	Cooldown time.Duration
+
+	// How long a worker must be unused by all masters before it
+	// is drained.
+	IdleTime time.Duration
+
+	// How often to evaluate demand.
+	Period time.Duration
+}
+
+// DemandReport is sent by masters to the coordinator, so it can
+// decide on the size of the worker pool.
+type DemandReport struct {
+	// Identifies the master.
+	Master string
+
+	// Jobs wanted (the master's --jobs), and jobs reserved on workers.
+	WantedJobs  int
+	GrantedJobs int
+
+	// Tasks that are waiting for a job slot.
+	WaitingTasks int
+
+	// Workers that the master has a mirror on.
+	Workers []string
+
+	// Task results per worker since the previous report.
+	Outcomes []WorkerOutcome
+}
+
+type masterDemand struct {
+	DemandReport
+	LastReported time.Time
+}
+
+type scaleDecision struct {
+	Up   int
+	Down []string
+}
+
+// autoscaler holds the scaling state. Protected by Coordinator.mutex.
+type autoscaler struct {
+	options    AutoscaleOptions
+	lastAction time.Time
+
+	// Last time a worker was in use by a master.
+	lastUsed map[string]time.Time
+
+	// Workers we asked to shut down. They stay here until they
+	// unregister, as draining may take longer than any timeout.
+	draining map[string]time.Time
+
+	// Outstanding scale-up requests, so we don't ask for the same
+	// workers twice while they boot.
+	pendingUp      int
+	pendingUpSince time.Time
+}
+
+func newAutoscaler(o *AutoscaleOptions) *autoscaler {
+	a := &autoscaler{
+		options:  *o,
+		lastUsed: map[string]time.Time{},
+		draining: map[string]time.Time{},
+	}
+	if a.options.Cooldown <= 0 {
+		a.options.Cooldown = 5 * time.Minute
+	}
+	if a.options.IdleTime <= 0 {
+		a.options.IdleTime = 10 * time.Minute
+	}
+	if a.options.Period <= 0 {
+		a.options.Period = 10 * time.Second
+	}
+	return a
+}
+
+// Demand reports older than this are ignored.
+const demandExpiry = 2 * time.Minute
+
+func (a *autoscaler) decide(now time.Time, workers map[string]*WorkerRegistration, demands map[string]*masterDemand) scaleDecision {
+	d := scaleDecision{}
+
+	poolSize := 0
+	jobs := 0
+	for addr, w := range workers {
+		if _, ok := a.draining[addr]; ok {
+			continue
+		}
+		if _, ok := a.lastUsed[addr]; !ok {
+			// Newly registered; don't drain directly.
+			a.lastUsed[addr] = now
+		}
+		poolSize++
+		if w.MaxJobs > 0 {
+			jobs += w.MaxJobs
+		} else {
+			jobs++
+		}
+	}
+	for addr := range a.lastUsed {
+		if workers[addr] == nil {
+			delete(a.lastUsed, addr)
+		}
+	}
+	for addr := range a.draining {
+		if workers[addr] == nil {
+			delete(a.draining, addr)
+		}
+	}
+
+	if a.pendingUp > 0 && now.Sub(a.pendingUpSince) > a.options.Cooldown {
+		a.pendingUp = 0
+	}
+
+	unmet := 0
+	for _, m := range demands {
+		if now.Sub(m.LastReported) > demandExpiry {
+			continue
+		}
+		// Only count jobs the master could use right now.
+		missing := m.WantedJobs - m.GrantedJobs
+		if missing > m.WaitingTasks {
+			missing = m.WaitingTasks
+		}
+		if missing > 0 {
+			unmet += missing
+		}
+		for _, w := range m.Workers {
+			if _, ok := workers[w]; ok {
+				a.lastUsed[w] = now
+			}
+		}
+	}
+
+	if now.Sub(a.lastAction) < a.options.Cooldown {
+		return d
+	}
+
+	jobsPerWorker := 1
+	if poolSize > 0 && jobs > poolSize {
+		jobsPerWorker = jobs / poolSize
+	}
+
+	want := poolSize
+	if unmet > 0 {
+		want += (unmet + jobsPerWorker - 1) / jobsPerWorker
+	}
+	if want < a.options.MinWorkers {
+		want = a.options.MinWorkers
+	}
+	if a.options.MaxWorkers > 0 && want > a.options.MaxWorkers {
+		want = a.options.MaxWorkers
+	}
+
+	if up := want - poolSize - a.pendingUp; up > 0 {
+		d.Up = up
+		return d
+	}
+	if unmet > 0 {
+		return d
+	}
+
+	var idle []string
+	for addr := range workers {
+		if _, ok := a.draining[addr]; ok {
+			continue
+		}
+		if now.Sub(a.lastUsed[addr]) >= a.options.IdleTime {
+			idle = append(idle, addr)
+		}
+	}
+	sort.Strings(idle)
+	for _, addr := range idle {
+		if poolSize-len(d.Down) <= a.options.MinWorkers {
+			break
+		}
+		d.Down = append(d.Down, addr)
+	}
+	return d
+}
+
+// ReportDemand records the demand of a master, and the outcomes of its
+// tasks.
+func (c *Coordinator) ReportDemand(req *DemandReport, rep *Empty) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.demand[req.Master] = &masterDemand{
+		DemandReport: *req,
+		LastReported: time.Now(),
+	}
+	c.recordOutcomes(req.Outcomes)
+	return nil
+}
+
+// PeriodicAutoscale evaluates demand and invokes the scaler.  It does
+// nothing if the coordinator has no AutoscaleOptions.
+func (c *Coordinator) PeriodicAutoscale() {
+	if c.autoscaler == nil {
+		return
+	}
+	for {
+		time.Sleep(c.autoscaler.options.Period)
+		c.autoscale()
+	}
+}
+
+func (c *Coordinator) autoscale() {
+	now := time.Now()
+	c.mutex.Lock()
+	a := c.autoscaler
+	d := a.decide(now, c.workers, c.demand)
+	if d.Up > 0 || len(d.Down) > 0 {
+		a.lastAction = now
+	}
+	if d.Up > 0 {
+		a.pendingUp += d.Up
+		a.pendingUpSince = now
+	}
+	for _, addr := range d.Down {
+		a.draining[addr] = now
+	}
+	c.mutex.Unlock()
+
+	if d.Up > 0 {
+		log.Printf("autoscale: adding %d workers", d.Up)
+		if err := a.options.Scaler.ScaleUp(d.Up); err != nil {
+			log.Printf("autoscale: ScaleUp(%d): %v", d.Up, err)
+		}
+	}
+
+	if len(d.Down) == 0 {
+		return
+	}
+
+	var drained []string
+	for _, addr := range d.Down {
+		log.Printf("autoscale: draining idle worker %s", addr)
+		if err := c.drainWorker(addr); err != nil {
+			log.Printf("autoscale: drain %s: %v", addr, err)
+			c.mutex.Lock()
+			delete(a.draining, addr)
+			c.mutex.Unlock()
+			continue
+		}
+		drained = append(drained, addr)
+	}
+	if len(drained) > 0 {
+		if err := a.options.Scaler.ScaleDown(drained); err != nil {
+			log.Printf("autoscale: ScaleDown(%v): %v", drained, err)
+		}
+	}
+}
+
+// newWorker records that a worker registered for the first time, so
+// it no longer counts as pending. Must hold lock.
+func (a *autoscaler) newWorker() {
+	if a.pendingUp > 0 {
+		a.pendingUp--
+	}
+}
+
+// CommandScaler runs a command for scaling.  It is invoked as
+// "Command up N" or "Command down ADDR...".
+type CommandScaler struct {
+	Command string
+}
+
+func (s *CommandScaler) run(args ...string) error {
+	cmd := exec.Command(s.Command, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v: %v, output %q", s.Command, args, err, out)
+	}
+	return nil
+}
+
+func (s *CommandScaler) ScaleUp(n int) error {
+	return s.run("up", strconv.Itoa(n))
+}
+
+func (s *CommandScaler) ScaleDown(addrs []string) error {
+	return s.run(append([]string{"down"}, addrs...)...)
+}
+
+// WebhookScaler POSTs a ScaleRequest as JSON to an URL.
+type WebhookScaler struct {
+	URL string
+}
+
+type ScaleRequest struct {
+	// "up" or "down"
+	Action string
+
+	// For scaling up, the number of workers to add.
+	Count int `json:",omitempty"`
+
+	// For scaling down, the workers to remove.
+	Workers []string `json:",omitempty"`
+}
+
+func (s *WebhookScaler) post(req *ScaleRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	rep, err := http.Post(s.URL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	rep.Body.Close()
+	if rep.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: status %s", s.URL, rep.Status)
+	}
+	return nil
+}
+
+func (s *WebhookScaler) ScaleUp(n int) error {
+	return s.post(&ScaleRequest{Action: "up", Count: n})
+}
+
+func (s *WebhookScaler) ScaleDown(addrs []string) error {
+	return s.post(&ScaleRequest{Action: "down", Workers: addrs})
+}
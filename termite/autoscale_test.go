@@ -0,0 +1,118 @@
+package termite
+
+import (
+	"testing"
+	"time"
+)
+
+func testWorkers(addrs ...string) map[string]*WorkerRegistration {
+	r := map[string]*WorkerRegistration{}
+	for _, a := range addrs {
+		r[a] = &WorkerRegistration{Registration: Registration{Address: a, MaxJobs: 4}}
+	}
+	return r
+}
+
+func TestAutoscaleUp(t *testing.T) {
+	a := newAutoscaler(&AutoscaleOptions{MaxWorkers: 3, Cooldown: time.Minute})
+	now := time.Now()
+	demand := map[string]*masterDemand{
+		"m": {
+			DemandReport: DemandReport{
+				WantedJobs:   20,
+				GrantedJobs:  4,
+				WaitingTasks: 10,
+				Workers:      []string{"a:1"},
+			},
+			LastReported: now,
+		},
+	}
+
+	d := a.decide(now, testWorkers("a:1"), demand)
+	if d.Up != 2 || len(d.Down) != 0 {
+		t.Errorf("got %v, want 2 up (capped by MaxWorkers)", d)
+	}
+
+	a.lastAction = now
+	a.pendingUp = 2
+	a.pendingUpSince = now
+	d = a.decide(now.Add(time.Second), testWorkers("a:1"), demand)
+	if d.Up != 0 {
+		t.Errorf("scaled during cooldown: %v", d)
+	}
+}
+
+func TestAutoscaleNoDemand(t *testing.T) {
+	a := newAutoscaler(&AutoscaleOptions{MinWorkers: 1, Cooldown: time.Minute, IdleTime: time.Minute})
+	now := time.Now()
+	workers := testWorkers("a:1", "b:1", "c:1")
+	demand := map[string]*masterDemand{
+		"m": {
+			DemandReport: DemandReport{
+				WantedJobs:  4,
+				GrantedJobs: 4,
+				Workers:     []string{"b:1"},
+			},
+			LastReported: now,
+		},
+	}
+
+	if d := a.decide(now, workers, demand); d.Up != 0 || len(d.Down) != 0 {
+		t.Errorf("new workers should not be drained: %v", d)
+	}
+
+	later := now.Add(2 * time.Minute)
+	demand["m"].LastReported = later
+	d := a.decide(later, workers, demand)
+	if d.Up != 0 || len(d.Down) != 2 || d.Down[0] != "a:1" || d.Down[1] != "c:1" {
+		t.Errorf("got %v, want to drain a:1 and c:1", d)
+	}
+}
+
+func TestAutoscaleMinWorkers(t *testing.T) {
+	a := newAutoscaler(&AutoscaleOptions{MinWorkers: 2})
+	d := a.decide(time.Now(), testWorkers(), nil)
+	if d.Up != 2 {
+		t.Errorf("got %v, want 2 up", d)
+	}
+}
+
+func TestAutoscaleDraining(t *testing.T) {
+	a := newAutoscaler(&AutoscaleOptions{Cooldown: time.Minute, IdleTime: time.Minute})
+	now := time.Now()
+	a.draining["a:1"] = now
+	workers := testWorkers("a:1", "b:1")
+	a.decide(now, workers, nil)
+
+	// A worker with long tasks is still draining much later; it
+	// is neither counted, nor drained again.
+	later := now.Add(time.Hour)
+	d := a.decide(later, workers, nil)
+	if len(d.Down) != 1 || d.Down[0] != "b:1" {
+		t.Errorf("got %v, want to drain b:1", d)
+	}
+	if _, ok := a.draining["a:1"]; !ok {
+		t.Error("draining worker forgotten while registered")
+	}
+
+	a.decide(later, testWorkers("b:1"), nil)
+	if _, ok := a.draining["a:1"]; ok {
+		t.Error("unregistered worker still draining")
+	}
+}
+
+func TestDemandReportWaiting(t *testing.T) {
+	c := &mirrorConnections{
+		master: &Master{options: &MasterOptions{}},
+		mirrors: map[string]*mirrorConnection{
+			"a:1": {maxJobs: 2, availableJobs: -3},
+			"b:1": {maxJobs: 2, availableJobs: 1},
+		},
+		wantedMaxJobs: 8,
+		waiting:       2,
+	}
+	rep := c.demandReport()
+	if rep.GrantedJobs != 4 || rep.WaitingTasks != 5 {
+		t.Errorf("got %d granted, %d waiting; want 4, 5", rep.GrantedJobs, rep.WaitingTasks)
+	}
+}
@@ -0,0 +1,59 @@
+package termite
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/cba"
+)
+
+// A Backend runs tasks instead of the termite workers, eg. a remote
+// execution service.
+type Backend interface {
+	// Run runs the request. Changes to the writable root are
+	// returned in rep.FileSet; their contents must be added to
+	// inputs.Store.
+	Run(inputs *BackendInputs, req *WorkRequest, rep *WorkResponse) error
+}
+
+// BackendInputs gives a backend access to the files of the master.
+type BackendInputs struct {
+	Attributes *attr.AttributeCache
+	Store      *cba.Store
+
+	// Absolute path of the writable root.
+	WritableRoot string
+}
+
+func (m *Master) runOnBackend(req *WorkRequest, rep *WorkResponse) error {
+	if req.StdinConn != nil {
+		// There is no way to pass stdin to a remote action.
+		req.StdinConn.Close()
+		req.StdinConn = nil
+	}
+
+	log.Printf("Running task %d on backend: %v", req.TaskId, req.Argv)
+	inputs := &BackendInputs{
+		Attributes:   m.attributes,
+		Store:        m.contentStore,
+		WritableRoot: m.options.WritableRoot,
+	}
+	m.mirrors.stats.Enter("remote")
+	err := m.options.Backend.Run(inputs, req, rep)
+	m.mirrors.stats.Exit("remote")
+	if err != nil {
+		return err
+	}
+
+	m.checkHermeticity(req, rep)
+	if rep.FileSet != nil {
+		for _, f := range rep.FileSet.Files {
+			if f.Hash != "" && !m.contentStore.Has(f.Hash) {
+				return fmt.Errorf("backend did not store %x for %s", f.Hash, f.Path)
+			}
+		}
+		m.replay(*rep.FileSet)
+	}
+	return nil
+}
@@ -43,6 +43,13 @@ func ConnectionId() string {
 	return string(encoded)
 }
 
+// RandomConnectionId returns an id for connections opened by other
+// processes, such as the shell-wrapper, which do not share the
+// counter of ConnectionId.
+func RandomConnectionId() string {
+	return "r" + string(RandomBytes(HEADER_LEN-1))
+}
+
 func OpenSocketConnection(socket string, channel string, timeout time.Duration) net.Conn {
 	delay := time.Duration(0)
 	conn, err := net.Dial("unix", socket)
@@ -19,10 +19,25 @@ type Registration struct {
 	Name           string
 	Version        string
 	HttpStatusPort int
+
+	// Number of jobs the worker can run.
+	MaxJobs int
+
+	// Set if the worker finishes its current tasks, but accepts
+	// no new mirrors.
+	Draining bool
+
+	// Set by the coordinator if tasks fail too often on this
+	// worker.
+	Quarantined bool
 }
 
 type RegistrationRequest Registration
 
+type UnregisterRequest struct {
+	Address string
+}
+
 type ListRequest struct {
 	// Return changes after this time stamp.  Will halt if no
 	// changes to report.
@@ -55,6 +70,15 @@ type Coordinator struct {
 	cond       *sync.Cond
 	workers    map[string]*WorkerRegistration
 	lastChange time.Time
+
+	// Demand reported by masters, keyed by master.
+	demand     map[string]*masterDemand
+	autoscaler *autoscaler
+
+	quarantine *quarantine
+
+	// Workers that were quarantined at the last check.
+	quarantinedWorkers map[string]bool
 }
 
 // RPC interface for Coordinator
@@ -64,10 +88,18 @@ func (cs *CoordinatorService) Register(req *RegistrationRequest, rep *Empty) err
 	return ((*Coordinator)(cs)).Register(req, rep)
 }
 
+func (cs *CoordinatorService) Unregister(req *UnregisterRequest, rep *Empty) error {
+	return ((*Coordinator)(cs)).Unregister(req, rep)
+}
+
 func (cs *CoordinatorService) List(req *ListRequest, rep *ListResponse) error {
 	return ((*Coordinator)(cs)).List(req, rep)
 }
 
+func (cs *CoordinatorService) ReportDemand(req *DemandReport, rep *Empty) error {
+	return ((*Coordinator)(cs)).ReportDemand(req, rep)
+}
+
 type CoordinatorOptions struct {
 	// Secret is the password for coordinator, workers and master
 	// to authenticate.
@@ -76,6 +108,13 @@ type CoordinatorOptions struct {
 	// Password should be passed in the kill/restart URLs to make
 	// sure web scrapers don't randomly shutdown workers.
 	WebPassword string
+
+	// If set, the coordinator sizes the worker pool.
+	Autoscale *AutoscaleOptions
+
+	// When to stop handing out workers, based on failures reported
+	// by masters.
+	Quarantine QuarantineOptions
 }
 
 func NewCoordinator(opts *CoordinatorOptions) *Coordinator {
@@ -83,8 +122,15 @@ func NewCoordinator(opts *CoordinatorOptions) *Coordinator {
 	c := &Coordinator{
 		options: &o,
 		workers: make(map[string]*WorkerRegistration),
+		demand:  make(map[string]*masterDemand),
 		Mux:     http.NewServeMux(),
 		dialer:  newWorkerDialer(o.Secret),
+
+		quarantine:         newQuarantine(o.Quarantine),
+		quarantinedWorkers: make(map[string]bool),
+	}
+	if o.Autoscale != nil {
+		c.autoscaler = newAutoscaler(o.Autoscale)
 	}
 	c.cond = sync.NewCond(&c.mutex)
 	return c
@@ -104,12 +150,30 @@ func (c *Coordinator) Register(req *RegistrationRequest, rep *Empty) error {
 
 	w := &WorkerRegistration{Registration: Registration(*req)}
 	w.LastReported = time.Now()
+	if c.autoscaler != nil && c.workers[w.Address] == nil {
+		c.autoscaler.newWorker()
+	}
 	c.lastChange = w.LastReported
 	c.workers[w.Address] = w
 	c.cond.Broadcast()
 	return nil
 }
 
+// Unregister removes a worker that is about to exit.
+func (c *Coordinator) Unregister(req *UnregisterRequest, rep *Empty) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.workers[req.Address]; !ok {
+		return fmt.Errorf("worker %q unknown", req.Address)
+	}
+	log.Println("unregistering worker", req.Address)
+	delete(c.workers, req.Address)
+	c.lastChange = time.Now()
+	c.cond.Broadcast()
+	return nil
+}
+
 func (c *Coordinator) WorkerCount() int {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -130,12 +194,45 @@ func (c *Coordinator) List(req *ListRequest, rep *ListResponse) error {
 	sort.Strings(keys)
 	for _, k := range keys {
 		w := c.workers[k]
-		rep.Registrations = append(rep.Registrations, w.Registration)
+		r := w.Registration
+		r.Quarantined = c.quarantinedWorkers[k]
+		rep.Registrations = append(rep.Registrations, r)
 	}
 	rep.LastChange = c.lastChange
 	return nil
 }
 
+// recordOutcomes feeds task results reported by a master into the
+// quarantine. Must hold lock.
+func (c *Coordinator) recordOutcomes(outcomes []WorkerOutcome) {
+	now := time.Now()
+	for _, o := range outcomes {
+		if c.quarantine.record(o.Address, o.Tasks, o.Failures, now) {
+			log.Printf("quarantining worker %s", o.Address)
+			c.quarantinedWorkers[o.Address] = true
+			c.lastChange = now
+			c.cond.Broadcast()
+		}
+	}
+}
+
+// expireQuarantine makes workers available again once their quarantine
+// has passed.
+func (c *Coordinator) expireQuarantine() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for addr := range c.quarantinedWorkers {
+		if !c.quarantine.isQuarantined(addr, now) {
+			log.Printf("worker %s leaves quarantine", addr)
+			delete(c.quarantinedWorkers, addr)
+			c.lastChange = now
+			c.cond.Broadcast()
+		}
+	}
+}
+
 func (c *Coordinator) dialWorker(address string) (io.ReadWriteCloser, error) {
 	mux, err := c.dialer.Dial(address)
 	if err != nil {
@@ -182,6 +279,7 @@ func (c *Coordinator) PeriodicCheck() {
 	for {
 		time.Sleep(_POLL * time.Second)
 		c.checkReachable()
+		c.expireQuarantine()
 	}
 }
 
@@ -197,6 +295,19 @@ func (c *Coordinator) killWorker(addr string, restart bool) error {
 	return err
 }
 
+func (c *Coordinator) drainWorker(addr string) error {
+	conn, err := c.dialWorker(addr)
+	if err != nil {
+		return err
+	}
+
+	cl := rpc.NewClient(conn)
+	err = cl.Call("Worker.Drain", &DrainRequest{}, &DrainResponse{})
+	cl.Close()
+	conn.Close()
+	return err
+}
+
 func (c *Coordinator) shutdownWorker(addr string, restart bool) error {
 	conn, err := c.dialWorker(addr)
 	if err != nil {
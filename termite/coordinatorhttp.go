@@ -63,6 +63,14 @@ func (c *Coordinator) ServeHTTP(port int) {
 		func(w http.ResponseWriter, req *http.Request) {
 			c.workerHandler(w, req)
 		})
+	c.Mux.HandleFunc(jsonApiPrefix+"workers",
+		func(w http.ResponseWriter, req *http.Request) {
+			c.jsonWorkersHandler(w, req)
+		})
+	c.Mux.HandleFunc("/metrics",
+		func(w http.ResponseWriter, req *http.Request) {
+			c.metricsHandler(w, req)
+		})
 	c.Mux.HandleFunc("/shutdown",
 		func(w http.ResponseWriter, req *http.Request) {
 			c.shutdownSelf(w, req)
@@ -71,6 +79,10 @@ func (c *Coordinator) ServeHTTP(port int) {
 		func(w http.ResponseWriter, req *http.Request) {
 			c.killHandler(w, req)
 		})
+	c.Mux.HandleFunc("/drain",
+		func(w http.ResponseWriter, req *http.Request) {
+			c.drainHandler(w, req)
+		})
 	c.Mux.HandleFunc("/killall",
 		func(w http.ResponseWriter, req *http.Request) {
 			c.killAllHandler(w, req)
@@ -194,6 +206,32 @@ func (c *Coordinator) killHandler(w http.ResponseWriter, req *http.Request) {
 	go c.checkReachable()
 }
 
+func (c *Coordinator) drainHandler(w http.ResponseWriter, req *http.Request) {
+	c.log(req)
+	if !c.checkPassword(w, req) {
+		return
+	}
+
+	addr, err := c.getHost(req)
+	if err == nil {
+		err = c.drainWorker(addr)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "<html><head><title>Termite worker error</title></head>")
+		fmt.Fprintf(w, "<body>Error: %s</body></html>", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, "<html><head><title>Termite worker status</title></head>")
+	fmt.Fprintf(w, "<body><h1>Status %s</h1>", addr)
+	fmt.Fprintf(w, "<p>drain of %s in progress", addr)
+	// Should have a redirect.
+	fmt.Fprintf(w, "<p><a href=\"/\">back to index</a>")
+	fmt.Fprintf(w, "</body></html>")
+}
+
 func (c *Coordinator) rootHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	c.mutex.Lock()
@@ -215,8 +253,15 @@ func (c *Coordinator) rootHandler(w http.ResponseWriter, req *http.Request) {
 		addr := worker.Address
 		fmt.Fprintf(w, "<li><a href=\"worker?host=%s\">address <tt>%s</tt>, host <tt>%s</tt></a>"+
 			" (<a href=\"/workerkill?host=%s\">Kill</a>, \n"+
-			"<a href=\"/restart?host=%s\">Restart</a>)\n",
-			addr, addr, worker.Name, addr, addr)
+			"<a href=\"/restart?host=%s\">Restart</a>, \n"+
+			"<a href=\"/drain?host=%s\">Drain</a>)\n",
+			addr, addr, worker.Name, addr, addr, addr)
+		if worker.Draining {
+			fmt.Fprintf(w, " <b>draining</b>\n")
+		}
+		if c.quarantinedWorkers[addr] {
+			fmt.Fprintf(w, " <b>quarantined</b>\n")
+		}
 	}
 	fmt.Fprintf(w, "</ul>")
 
@@ -0,0 +1,236 @@
+package termite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// DaemonConfig holds the per-user defaults for masters that the
+// shell-wrapper starts on demand.
+type DaemonConfig struct {
+	// Master binary. The default is "master" from $PATH.
+	Binary string
+
+	// File with the secret. A relative path is relative to the
+	// directory of the config file.
+	SecretFile string
+
+	// Source directory of the tree, see the master's -sourcedir. A
+	// relative path is relative to the tree.
+	SourceDir string
+
+	Coordinator string
+	Jobs        int
+	CacheDir    string
+
+	// The master exits after this long without requests, eg. "30m".
+	IdleTimeout string
+
+	// Where the master logs. A relative path is relative to the
+	// tree. The default is .termite-master.log in the tree.
+	LogFile string
+
+	// Further flags for the master.
+	Args []string
+}
+
+const defaultIdleTimeout = 30 * time.Minute
+
+// How long to wait for a started master to listen.
+const daemonStartTimeout = 30 * time.Second
+
+// DaemonConfigFile returns $TERMITE_CONFIG, or
+// ~/.config/termite/master.json.
+func DaemonConfigFile() string {
+	if f := os.Getenv("TERMITE_CONFIG"); f != "" {
+		return f
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "termite", "master.json")
+}
+
+// ReadDaemonConfig reads a config in JSON format.
+func ReadDaemonConfig(name string) (*DaemonConfig, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &DaemonConfig{}
+	if err := json.Unmarshal(content, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if c.IdleTimeout != "" {
+		if _, err := time.ParseDuration(c.IdleTimeout); err != nil {
+			return nil, fmt.Errorf("%s: IdleTimeout: %v", name, err)
+		}
+	}
+	if c.SecretFile != "" && !filepath.IsAbs(c.SecretFile) {
+		dir, err := filepath.Abs(filepath.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		c.SecretFile = filepath.Join(dir, c.SecretFile)
+	}
+	return c, nil
+}
+
+func (c *DaemonConfig) logFile(root string) string {
+	logFile := c.LogFile
+	if logFile == "" {
+		logFile = ".termite-master.log"
+	}
+	if !filepath.IsAbs(logFile) {
+		logFile = filepath.Join(root, logFile)
+	}
+	return logFile
+}
+
+// args returns the master command line for the tree at root.
+func (c *DaemonConfig) args(root string) []string {
+	idle := defaultIdleTimeout
+	if c.IdleTimeout != "" {
+		idle, _ = time.ParseDuration(c.IdleTimeout)
+	}
+
+	args := []string{
+		"-socket", filepath.Join(root, _SOCKET),
+		"-logfile", c.logFile(root),
+		"-idle-timeout", idle.String(),
+	}
+	if c.SecretFile != "" {
+		args = append(args, "-secret", c.SecretFile)
+	}
+	if c.SourceDir != "" {
+		src := c.SourceDir
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(root, src)
+		}
+		args = append(args, "-sourcedir", src)
+	}
+	if c.Coordinator != "" {
+		args = append(args, "-coordinator", c.Coordinator)
+	}
+	if c.Jobs > 0 {
+		args = append(args, "-jobs", strconv.Itoa(c.Jobs))
+	}
+	if c.CacheDir != "" {
+		args = append(args, "-cachedir", c.CacheDir)
+	}
+	return append(args, c.Args...)
+}
+
+// SocketAlive returns whether a master listens on the socket.
+func SocketAlive(socket string) bool {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// RemoveStaleSocket removes the socket if it was left behind by a
+// master that died. It returns whether it did.
+func RemoveStaleSocket(socket string) bool {
+	fi, err := os.Lstat(socket)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	_, err = net.Dial("unix", socket)
+	if opErr, ok := err.(*net.OpError); !ok || !isErrno(opErr.Err, syscall.ECONNREFUSED) {
+		return false
+	}
+	log.Println("removing dead socket", socket)
+	return os.Remove(socket) == nil
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == errno
+}
+
+// StartMaster starts a master for the tree at root, unless one is
+// already listening. It returns the socket.
+func StartMaster(root string, conf *DaemonConfig) (string, error) {
+	socket := filepath.Join(root, _SOCKET)
+
+	// With make -j, many wrappers may try at once.
+	lock, err := os.OpenFile(socket+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return "", err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if SocketAlive(socket) {
+		return socket, nil
+	}
+	RemoveStaleSocket(socket)
+
+	binary := conf.Binary
+	if binary == "" {
+		binary = "master"
+	}
+	args := conf.args(root)
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = root
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	log.Printf("started master %v in %s, pid %d", args, root, cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.Now().Add(daemonStartTimeout)
+	for !SocketAlive(socket) {
+		select {
+		case err := <-exited:
+			return "", fmt.Errorf("master exited: %v; see %s", err, conf.logFile(root))
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("master did not listen on %s after %v", socket, daemonStartTimeout)
+		}
+	}
+	return socket, nil
+}
+
+// beginRequest and endRequest bracket requests from the
+// shell-wrapper, for the idle timeout.
+func (m *Master) beginRequest() {
+	m.activityMu.Lock()
+	defer m.activityMu.Unlock()
+	m.activeRequests++
+}
+
+func (m *Master) endRequest() {
+	m.activityMu.Lock()
+	defer m.activityMu.Unlock()
+	m.activeRequests--
+	m.lastActivity = time.Now()
+}
+
+// idleFor returns how long the master has had no requests.
+func (m *Master) idleFor(now time.Time) time.Duration {
+	m.activityMu.Lock()
+	defer m.activityMu.Unlock()
+	if m.activeRequests > 0 {
+		return 0
+	}
+	return now.Sub(m.lastActivity)
+}
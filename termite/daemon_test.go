@@ -0,0 +1,92 @@
+package termite
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemonConfigArgs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "master.json")
+	ioutil.WriteFile(name, []byte(`{"SecretFile": "/s", "SourceDir": "/src", "Jobs": 4, "IdleTimeout": "5m", "Args": ["-xattr=false"]}`), 0644)
+	c, err := ReadDaemonConfig(name)
+	if err != nil {
+		t.Fatalf("ReadDaemonConfig: %v", err)
+	}
+	got := strings.Join(c.args("/tree"), " ")
+	want := "-socket /tree/.termite-socket -logfile /tree/.termite-master.log -idle-timeout 5m0s -secret /s -sourcedir /src -jobs 4 -xattr=false"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Relative paths are relative to the config and the tree.
+	ioutil.WriteFile(name, []byte(`{"SecretFile": "termite_rsa", "SourceDir": "../src"}`), 0644)
+	c, err = ReadDaemonConfig(name)
+	if err != nil {
+		t.Fatalf("ReadDaemonConfig: %v", err)
+	}
+	got = strings.Join(c.args("/tree/out"), " ")
+	want = "-socket /tree/out/.termite-socket -logfile /tree/out/.termite-master.log -idle-timeout 30m0s -secret " +
+		filepath.Join(dir, "termite_rsa") + " -sourcedir /tree/src"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	ioutil.WriteFile(name, []byte(`{"IdleTimeout": "later"}`), 0644)
+	if _, err := ReadDaemonConfig(name); err == nil {
+		t.Error("expected error for bad IdleTimeout")
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, _SOCKET)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	if RemoveStaleSocket(socket) {
+		t.Error("removed live socket")
+	}
+	if !SocketAlive(socket) {
+		t.Error("socket should be alive")
+	}
+
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if SocketAlive(socket) {
+		t.Error("closed socket should be dead")
+	}
+	if !RemoveStaleSocket(socket) {
+		t.Error("did not remove dead socket")
+	}
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket still there: %v", err)
+	}
+}
+
+func TestMasterIdleFor(t *testing.T) {
+	start := time.Now()
+	m := &Master{lastActivity: start}
+	if d := m.idleFor(start.Add(time.Minute)); d != time.Minute {
+		t.Errorf("got %v, want 1m", d)
+	}
+
+	m.beginRequest()
+	if d := m.idleFor(start.Add(time.Hour)); d != 0 {
+		t.Errorf("busy master idle for %v", d)
+	}
+	m.endRequest()
+	if d := m.idleFor(time.Now().Add(time.Second)); d > 2*time.Second {
+		t.Errorf("got %v after request", d)
+	}
+}
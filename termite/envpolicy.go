@@ -0,0 +1,114 @@
+package termite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// EnvPolicy decides which environment variables are passed to remote
+// tasks. Patterns are shell globs, eg. "LC_*".
+type EnvPolicy struct {
+	// If non-empty, only variables matching one of these are
+	// passed.
+	Allow []string
+
+	// Variables matching one of these are never passed, even if
+	// they are allowed.
+	Deny []string
+
+	// Variables to set, regardless of Allow and Deny.
+	Override map[string]string
+}
+
+// DefaultEnvPolicy returns the policy used if the master does not
+// specify one. It strips credentials, and variables that change
+// between shells without affecting the build.
+func DefaultEnvPolicy() *EnvPolicy {
+	return &EnvPolicy{
+		Deny: []string{
+			"*TOKEN*", "*SECRET*", "*PASSWORD*", "*PASSWD*",
+			"SSH_AUTH_SOCK", "SSH_AGENT_PID", "GPG_AGENT_INFO",
+			"OLDPWD", "SHLVL", "_",
+		},
+	}
+}
+
+// ReadEnvPolicy reads a policy in JSON format.
+func ReadEnvPolicy(name string) (*EnvPolicy, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p := &EnvPolicy{}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+// check returns an error for malformed patterns.
+func (p *EnvPolicy) check() error {
+	for _, pat := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("pattern %q: %v", pat, err)
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pat := range patterns {
+		if m, _ := path.Match(pat, name); m {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the filtered environment, and the names of the
+// variables that were stripped. Overrides are appended in sorted
+// order. A nil policy passes everything.
+func (p *EnvPolicy) Apply(env []string) (result []string, stripped []string) {
+	if p == nil {
+		return env, nil
+	}
+	for _, e := range env {
+		name := strings.SplitN(e, "=", 2)[0]
+		if _, ok := p.Override[name]; ok {
+			continue
+		}
+		if (len(p.Allow) > 0 && !matchAny(p.Allow, name)) || matchAny(p.Deny, name) {
+			stripped = append(stripped, name)
+			continue
+		}
+		result = append(result, e)
+	}
+
+	var names []string
+	for k := range p.Override {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		result = append(result, k+"="+p.Override[k])
+	}
+	return result, stripped
+}
+
+// applyEnvPolicy filters the environment of a request from the
+// shell-wrapper.
+func (m *Master) applyEnvPolicy(req *WorkRequest) {
+	var stripped []string
+	req.Env, stripped = m.options.EnvPolicy.Apply(req.Env)
+	if req.Debug && len(stripped) > 0 {
+		log.Printf("stripped environment variables for %v: %v", req.Argv, stripped)
+	}
+}
@@ -0,0 +1,37 @@
+package termite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvPolicyApply(t *testing.T) {
+	env := []string{"PATH=/bin", "GITHUB_TOKEN=x", "LC_ALL=C", "HOME=/home/u", "SHLVL=2", "CC=gcc"}
+
+	got, stripped := DefaultEnvPolicy().Apply(env)
+	if want := []string{"PATH=/bin", "LC_ALL=C", "HOME=/home/u", "CC=gcc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("default: got %v, want %v", got, want)
+	}
+	if want := []string{"GITHUB_TOKEN", "SHLVL"}; !reflect.DeepEqual(stripped, want) {
+		t.Errorf("default stripped: got %v, want %v", stripped, want)
+	}
+
+	p := &EnvPolicy{
+		Allow:    []string{"PATH", "LC_*", "CC"},
+		Deny:     []string{"LC_ALL"},
+		Override: map[string]string{"HOME": "/nonexistent", "CC": "clang"},
+	}
+	got, stripped = p.Apply(env)
+	if want := []string{"PATH=/bin", "CC=clang", "HOME=/nonexistent"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if want := []string{"GITHUB_TOKEN", "LC_ALL", "SHLVL"}; !reflect.DeepEqual(stripped, want) {
+		t.Errorf("stripped: got %v, want %v", stripped, want)
+	}
+}
+
+func TestEnvPolicyCheck(t *testing.T) {
+	if err := (&EnvPolicy{Deny: []string{"[A-"}}).check(); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+}
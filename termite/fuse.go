@@ -29,6 +29,10 @@ type workerFSState struct {
 	// Task ids that have results pending in this FS.
 	taskIds []int
 
+	// Set if the FS runs a task with WorkRequest.Isolate; other
+	// tasks may not join.
+	isolated bool
+
 	// workerFS that this state belongs to.
 	fs *workerFS
 }
@@ -52,6 +56,12 @@ type workerFS struct {
 	unionNodeFs  *pathfs.PathNodeFs
 	annotatingFS *AnnotatingFS
 
+	// Serves the rest of the root for tasks with TrackReads, so we
+	// can tell which files outside the writable root they read.
+	rootFS     *AnnotatingFS
+	rootNodeFS *pathfs.PathNodeFs
+	rootMount  string
+
 	state *workerFSState
 }
 
@@ -234,6 +244,15 @@ func (fuseFS *fuseFS) newWorkerFS(id string) (*workerFS, error) {
 		id, fs.unionFs.Root(), nodeFSOptions()); !code.Ok() {
 		return nil, errors.New(fmt.Sprintf("submount writable root %s: %v", fs.fuseFS.writableRoot, code))
 	}
+
+	fs.rootFS = NewAnnotatingFS(fuseFS.rpcFS)
+	fs.rootMount = "root-" + id
+	fs.rootNodeFS = pathfs.NewPathNodeFs(fs.rootFS,
+		&pathfs.PathNodeFsOptions{ClientInodes: true})
+	if code := fs.fuseFS.rpcNodeFS.Mount(
+		fs.rootMount, fs.rootNodeFS.Root(), nodeFSOptions()); !code.Ok() {
+		return nil, fmt.Errorf("submount root for %s: %v", id, code)
+	}
 	return fs, nil
 }
 
@@ -247,6 +266,7 @@ func (fs *workerFS) update(attrs []*attr.FileAttr) {
 			// As file contents are immutable, we must
 			// invalidate the entry instead
 			fs.fuseFS.rpcNodeFS.EntryNotify(filepath.Join(fs.id, dir), name)
+			fs.rootNodeFS.EntryNotify(dir, name)
 			continue
 		}
 		path = strings.TrimLeft(path[len(fs.fuseFS.writableRoot):], "/")
@@ -272,11 +292,15 @@ type fsYield struct {
 	dir   string
 	files map[string]*termitefs.Result
 	reads []string
+
+	// Files read outside the writable root, relative to the root.
+	externalReads []string
 }
 
 func (fs *workerFS) reap() fsYield {
 	yield := fs.unionFs.Reap()
 	opened := fs.annotatingFS.Reap()
+	external := fs.rootFS.Reap()
 	backingStoreFiles := map[string]string{}
 	dir, err := ioutil.TempDir(fs.tmpDir, "reap")
 	if err != nil {
@@ -305,5 +329,5 @@ func (fs *workerFS) reap() fsYield {
 
 	// We saved the backing store files, so we don't need the file system anymore.
 	fs.unionFs.Reset()
-	return fsYield{dir, yield, opened}
+	return fsYield{dir, yield, opened, external}
 }
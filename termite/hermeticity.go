@@ -0,0 +1,117 @@
+package termite
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// HermeticityPolicy lists where remote tasks may read files from.
+// Reads from the writable root and the source root are always
+// allowed. Checking reads requires a file system per task on the
+// workers, which makes tasks slower.
+type HermeticityPolicy struct {
+	// Absolute directories that tasks may read from, eg. a pinned
+	// toolchain prefix.
+	Allow []string
+
+	// If set, tasks reading elsewhere fail. Otherwise, they are
+	// only reported.
+	Enforce bool
+}
+
+type hermeticityReport struct {
+	Time    time.Time
+	Command string
+	Dir     string
+	Worker  string
+	Reads   []string
+}
+
+// undeclared returns the reads that are not inside allowed roots,
+// in sorted order. Reads are relative to the root.
+func (p *HermeticityPolicy) undeclared(reads []string, roots []string) []string {
+	allowed := append(append([]string{}, roots...), p.Allow...)
+	var result []string
+	for _, r := range reads {
+		name := filepath.Join("/", r)
+		ok := false
+		for _, dir := range allowed {
+			if dir != "" && under(name, dir) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// prepareHermeticity makes the worker track the reads of a task.
+func (m *Master) prepareHermeticity(req *WorkRequest) {
+	if m.options.Hermeticity == nil {
+		return
+	}
+	req.TrackReads = true
+	req.Isolate = true
+}
+
+// checkHermeticity flags tasks that read files outside the allowed
+// roots. In enforcing mode, it makes them fail and drops their
+// outputs, so it must run before the outputs are replayed.
+func (m *Master) checkHermeticity(req *WorkRequest, rep *WorkResponse) {
+	policy := m.options.Hermeticity
+	if policy == nil {
+		return
+	}
+	bad := policy.undeclared(rep.ExternalReads,
+		[]string{m.options.WritableRoot, m.options.SourceRoot})
+	if len(bad) == 0 {
+		return
+	}
+	log.Printf("Command %v read undeclared files: %v", req.Argv, bad)
+	rep.UndeclaredReads = bad
+	if policy.Enforce {
+		rep.Stderr += fmt.Sprintf("termite: %v read files outside the allowed roots: %s\n",
+			req.Argv, strings.Join(bad, " "))
+		if rep.Exit.ExitStatus() == 0 {
+			rep.Exit = syscall.WaitStatus(1 << 8)
+		}
+		if rep.FileSet != nil {
+			rep.FileSet = &attr.FileSet{}
+		}
+	}
+
+	m.hermeticityMu.Lock()
+	defer m.hermeticityMu.Unlock()
+	m.hermeticity = append(m.hermeticity, &hermeticityReport{
+		Time:    time.Now(),
+		Command: strings.Join(req.Argv, " "),
+		Dir:     req.Dir,
+		Worker:  rep.WorkerId,
+		Reads:   bad,
+	})
+	if len(m.hermeticity) > maxTaskReports {
+		m.hermeticity = m.hermeticity[len(m.hermeticity)-maxTaskReports:]
+	}
+}
+
+// hermeticityReports returns the recent reports, newest first.
+func (m *Master) hermeticityReports() []*hermeticityReport {
+	m.hermeticityMu.Lock()
+	defer m.hermeticityMu.Unlock()
+	var result []*hermeticityReport
+	for i := len(m.hermeticity) - 1; i >= 0; i-- {
+		result = append(result, m.hermeticity[i])
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package termite
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/termite/attr"
+)
+
+func TestHermeticityUndeclared(t *testing.T) {
+	p := &HermeticityPolicy{Allow: []string{"/usr/lib", "/opt/tools/"}}
+	reads := []string{
+		"src/main.c",
+		"usr/lib/libc.so",
+		"usr/libexec/cc1",
+		"opt/tools/bin/gcc",
+		"home/user/.bashrc",
+		"etc/passwd",
+	}
+	got := p.undeclared(reads, []string{"/src", ""})
+	want := []string{"/etc/passwd", "/home/user/.bashrc", "/usr/libexec/cc1"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCheckHermeticityEnforce(t *testing.T) {
+	m := &Master{options: &MasterOptions{
+		WritableRoot: "/src",
+		Hermeticity:  &HermeticityPolicy{Enforce: true},
+	}}
+	req := &WorkRequest{Argv: []string{"cc"}}
+	rep := &WorkResponse{ExternalReads: []string{"src/a.c"}}
+	m.checkHermeticity(req, rep)
+	if rep.Exit.ExitStatus() != 0 || len(m.hermeticityReports()) != 0 {
+		t.Errorf("hermetic task flagged: %v", rep)
+	}
+
+	rep = &WorkResponse{
+		ExternalReads: []string{"etc/passwd"},
+		FileSet:       &attr.FileSet{Files: []*attr.FileAttr{{Path: "src/a.o"}}},
+	}
+	m.checkHermeticity(req, rep)
+	if rep.Exit.ExitStatus() == 0 || !strings.Contains(rep.Stderr, "/etc/passwd") {
+		t.Errorf("task should fail: %v %q", rep.Exit, rep.Stderr)
+	}
+	if len(rep.FileSet.Files) != 0 {
+		t.Errorf("outputs of a failed task would be replayed: %v", rep.FileSet)
+	}
+	if r := m.hermeticityReports(); len(r) != 1 || r[0].Reads[0] != "/etc/passwd" {
+		t.Errorf("got reports %v", r)
+	}
+}
+
+func TestEndToEndHermeticityEnforce(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+	tc.master.options.Hermeticity = &HermeticityPolicy{Enforce: true}
+
+	rep := tc.RunFail(WorkRequest{
+		Argv: []string{"/bin/sh", "-c", "cat /etc/passwd > output.txt"},
+	})
+	if len(rep.UndeclaredReads) == 0 {
+		t.Errorf("no undeclared reads: %v", rep)
+	}
+	if _, err := os.Lstat(tc.wd + "/output.txt"); err == nil {
+		t.Errorf("output of a failing task was replayed")
+	}
+}
@@ -0,0 +1,183 @@
+package termite
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The master can serve a GNU make jobserver: a FIFO holding one
+// token byte per job that make may start in addition to its first
+// one. termite-make hands the FIFO to make, so the build runs as many
+// jobs as there are reserved job slots on the workers, rather than a
+// fixed -j.
+
+const _JOBSERVER = ".termite-jobserver"
+
+// How often the number of tokens follows the reserved job slots.
+const jobserverPeriod = time.Second
+
+// JobserverPath returns the jobserver FIFO of the master listening on
+// socket.
+func JobserverPath(socket string) string {
+	return filepath.Join(filepath.Dir(socket), _JOBSERVER)
+}
+
+type jobServer struct {
+	path string
+	done chan struct{}
+
+	mu sync.Mutex
+	fd int
+
+	// Tokens written to the FIFO and not taken back. Make may
+	// hold some of them.
+	tokens int
+}
+
+func newJobServer(path string) (*jobServer, error) {
+	os.Remove(path)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return nil, err
+	}
+
+	// Opening for reading and writing does not block, and keeps
+	// the tokens in the FIFO while no make has it open.
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &jobServer{
+		path: path,
+		fd:   fd,
+		done: make(chan struct{}),
+	}, nil
+}
+
+// resize adds or takes back tokens, so make gets want tokens.
+// Tokens that make holds are taken back on later calls, once make
+// returns them.
+func (j *jobServer) resize(want int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.fd < 0 {
+		return
+	}
+	if want < 0 {
+		want = 0
+	}
+
+	if j.tokens < want {
+		buf := make([]byte, want-j.tokens)
+		for i := range buf {
+			buf[i] = '+'
+		}
+		n, err := syscall.Write(j.fd, buf)
+		if n > 0 {
+			j.tokens += n
+		}
+		if err != nil && err != syscall.EAGAIN {
+			log.Printf("jobserver write: %v", err)
+		}
+	}
+	if j.tokens > want {
+		buf := make([]byte, j.tokens-want)
+		n, err := syscall.Read(j.fd, buf)
+		if n > 0 {
+			j.tokens -= n
+		}
+		if err != nil && err != syscall.EAGAIN {
+			log.Printf("jobserver read: %v", err)
+		}
+	}
+}
+
+// resync counts the tokens in the FIFO, so the tokens that an
+// interrupted make took with it are written again. It must only be
+// called while no make holds tokens; a token taken meanwhile is
+// written twice, and taken back once it is returned.
+func (j *jobServer) resync() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.fd < 0 {
+		return
+	}
+	var n int32
+	if err := ioctl(uintptr(j.fd), syscall.TIOCINQ, unsafe.Pointer(&n)); err != nil {
+		log.Printf("jobserver FIONREAD: %v", err)
+		return
+	}
+	if int(n) != j.tokens {
+		log.Printf("jobserver: %d tokens were not returned", j.tokens-int(n))
+		j.tokens = int(n)
+	}
+}
+
+func (j *jobServer) tokenCount() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.tokens
+}
+
+// serve resizes the jobserver to capacity() until close. While
+// idle() holds, it first recounts the tokens.
+func (j *jobServer) serve(capacity func() int, idle func() bool) {
+	ticker := time.NewTicker(jobserverPeriod)
+	defer ticker.Stop()
+	for {
+		if idle() {
+			j.resync()
+		}
+		j.resize(capacity())
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *jobServer) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.fd < 0 {
+		return
+	}
+	close(j.done)
+	syscall.Close(j.fd)
+	j.fd = -1
+	os.Remove(j.path)
+}
+
+// jobCapacity returns the number of tokens for make: the reserved
+// job slots, less the one that make has without a token.
+func (m *Master) jobCapacity() int {
+	m.mirrors.Mutex.Lock()
+	defer m.mirrors.Mutex.Unlock()
+	return m.mirrors.maxJobs() - 1
+}
+
+// jobsIdle returns whether no command runs, so no make can hold
+// jobserver tokens.
+func (m *Master) jobsIdle() bool {
+	m.activityMu.Lock()
+	active := m.activeRequests
+	m.activityMu.Unlock()
+	return active == 0 && !m.sessions.busy()
+}
+
+// openJobServer creates the jobserver FIFO next to the socket.
+func (m *Master) openJobServer() {
+	j, err := newJobServer(JobserverPath(m.options.Socket))
+	if err != nil {
+		log.Printf("jobserver: %v", err)
+		return
+	}
+	log.Printf("Serving make jobserver on %s", j.path)
+	m.jobServer = j
+}
@@ -0,0 +1,97 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJobServerResize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "termite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := newJobServer(filepath.Join(dir, _JOBSERVER))
+	if err != nil {
+		t.Fatalf("newJobServer: %v", err)
+	}
+	defer j.close()
+
+	// Play make: take tokens from the FIFO.
+	client, err := os.OpenFile(j.path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	j.resize(3)
+	buf := make([]byte, 2)
+	if n, err := client.Read(buf); n != 2 || err != nil {
+		t.Fatalf("got %d tokens, %v", n, err)
+	}
+
+	// Make holds two tokens, so only one can be taken back.
+	j.resize(0)
+	if got := j.tokenCount(); got != 2 {
+		t.Errorf("got %d tokens after shrink, want 2", got)
+	}
+
+	// Once make returns them, the rest goes.
+	client.Write(buf)
+	j.resize(0)
+	if got := j.tokenCount(); got != 0 {
+		t.Errorf("got %d tokens, want 0", got)
+	}
+
+	j.resize(-1)
+	j.resize(1)
+	if got := j.tokenCount(); got != 1 {
+		t.Errorf("got %d tokens, want 1", got)
+	}
+
+	// An interrupted make drops the tokens it holds. Once
+	// nothing runs, they are written again.
+	j.resize(3)
+	if n, err := client.Read(buf); n != 2 || err != nil {
+		t.Fatalf("got %d tokens, %v", n, err)
+	}
+	j.resync()
+	if got := j.tokenCount(); got != 1 {
+		t.Errorf("got %d tokens after resync, want 1", got)
+	}
+	j.resize(3)
+	all := make([]byte, 4)
+	if n, err := client.Read(all); n != 3 || err != nil {
+		t.Errorf("got %d tokens after losing 2, want 3 (%v)", n, err)
+	}
+
+	j.close()
+	if _, err := os.Lstat(j.path); err == nil {
+		t.Error("FIFO not removed on close")
+	}
+}
+
+func TestMasterJobsIdle(t *testing.T) {
+	m := &Master{options: &MasterOptions{}, sessions: newSessions()}
+	if !m.jobsIdle() {
+		t.Error("new master not idle")
+	}
+	m.beginRequest()
+	if m.jobsIdle() {
+		t.Error("idle during a request")
+	}
+	m.endRequest()
+
+	s := m.session(&WorkRequest{Session: "a"})
+	m.sessions.acquire(s, 1)
+	if m.jobsIdle() {
+		t.Error("idle while a task runs")
+	}
+	m.sessions.release(s, 1, false)
+	if !m.jobsIdle() {
+		t.Error("not idle after the task")
+	}
+}
@@ -0,0 +1,104 @@
+package termite
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/hanwen/termite/stats"
+)
+
+// Prefix for the versioned JSON status endpoints.  Change the version
+// when making incompatible changes to the returned structs.
+const jsonApiPrefix = "/api/v1/"
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("json.Marshal(%T): %v", v, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(out, '\n'))
+}
+
+func (m *Master) Status(req *MasterStatusRequest, rep *MasterStatusResponse) error {
+	rep.Version = Version()
+	rep.WritableRoot = m.options.WritableRoot
+	rep.SourceRoot = m.options.SourceRoot
+	rep.FileSizeHistogram, rep.FileCount = m.sizeHistogram()
+	rep.RpcTimings = m.timing.TimingMessages()
+
+	m.mirrors.Mutex.Lock()
+	rep.WantedMaxJobs = m.mirrors.wantedMaxJobs
+	rep.ReservedJobs = m.mirrors.maxJobs()
+	rep.AvailableJobs = m.mirrors.availableJobs()
+	for addr := range m.mirrors.mirrors {
+		rep.Mirrors = append(rep.Mirrors, addr)
+	}
+	for addr := range m.mirrors.workers {
+		rep.Workers = append(rep.Workers, addr)
+	}
+	rep.Quarantined = m.mirrors.quarantinedWorkers()
+	phases := m.mirrors.stats
+	m.mirrors.Mutex.Unlock()
+
+	sort.Strings(rep.Mirrors)
+	sort.Strings(rep.Workers)
+	rep.PhaseNames = phases.PhaseOrder
+	rep.PhaseCounts = phases.PhaseCounts()
+	rep.MemStat = *stats.GetMemStat()
+	rep.Sessions = m.sessions.status()
+	return nil
+}
+
+func (m *Master) jsonStatusHandler(w http.ResponseWriter, req *http.Request) {
+	rep := MasterStatusResponse{}
+	m.Status(&MasterStatusRequest{}, &rep)
+	writeJSON(w, &rep)
+}
+
+func serveJSONStatus(worker *Worker, w http.ResponseWriter, req *http.Request) {
+	rep := WorkerStatusResponse{}
+	if err := worker.Status(&WorkerStatusRequest{}, &rep); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &rep)
+}
+
+func serveJSONMirrors(worker *Worker, w http.ResponseWriter, req *http.Request) {
+	rep := WorkerStatusResponse{}
+	worker.mirrors.Status(&WorkerStatusRequest{}, &rep)
+	mirrors := rep.MirrorStatus
+	if mirrors == nil {
+		mirrors = []MirrorStatusResponse{}
+	}
+	writeJSON(w, mirrors)
+}
+
+// Registrations returns the registered workers, sorted by address.
+func (c *Coordinator) Registrations() []WorkerRegistration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	keys := []string{}
+	for k := range c.workers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	regs := []WorkerRegistration{}
+	for _, k := range keys {
+		r := *c.workers[k]
+		r.Quarantined = c.quarantinedWorkers[k]
+		regs = append(regs, r)
+	}
+	return regs
+}
+
+func (c *Coordinator) jsonWorkersHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, c.Registrations())
+}
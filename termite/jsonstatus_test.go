@@ -0,0 +1,36 @@
+package termite
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCoordinatorJSONWorkers(t *testing.T) {
+	c := NewCoordinator(&CoordinatorOptions{})
+	now := time.Now()
+	for _, a := range []string{"b:1", "a:1"} {
+		c.workers[a] = &WorkerRegistration{
+			Registration: Registration{Address: a, Name: a},
+			LastReported: now,
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	c.jsonWorkersHandler(rec, httptest.NewRequest("GET", jsonApiPrefix+"workers", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q", ct)
+	}
+	var got []WorkerRegistration
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(got) != 2 || got[0].Address != "a:1" || got[1].Address != "b:1" {
+		t.Errorf("got %v", got)
+	}
+	if !got[0].LastReported.Equal(now) {
+		t.Errorf("LastReported: got %v, want %v", got[0].LastReported, now)
+	}
+}
@@ -27,6 +27,8 @@ func localStart(m *Master, sock string) {
 }
 
 func (m *LocalMaster) Run(req *WorkRequest, rep *WorkResponse) error {
+	m.master.beginRequest()
+	defer m.master.endRequest()
 	if req.RanLocally {
 		log.Println("Ran command locally:", req.Argv)
 		return nil
@@ -36,16 +38,46 @@ func (m *LocalMaster) Run(req *WorkRequest, rep *WorkResponse) error {
 	}
 	if req.StdinId != "" {
 		req.StdinConn = m.listener.Pending().accept(req.StdinId)
+		defer func() {
+			// Not passed on, eg. because the command ran in the
+			// master.
+			if req.StdinConn != nil {
+				req.StdinConn.Close()
+			}
+		}()
 	}
+	m.master.applyEnvPolicy(req)
 	return m.master.run(req, rep)
 }
 
+func (m *LocalMaster) RunTests(req *TestRequest, rep *TestResponse) error {
+	m.master.beginRequest()
+	defer m.master.endRequest()
+	if len(req.Binary) == 0 || req.Binary[0] != '/' {
+		return fmt.Errorf("Path to binary is not absolute: %q", req.Binary)
+	}
+	return m.master.RunTests(req, rep)
+}
+
 func (m *LocalMaster) Shutdown(req *int, rep *int) error {
 	m.master.quit <- 1
 	return nil
 }
 
+func (m *LocalMaster) Sessions(req *int, rep *SessionListResponse) error {
+	rep.Sessions = m.master.sessions.status()
+	return nil
+}
+
+func (m *LocalMaster) CancelSession(req *CancelSessionRequest, rep *CancelSessionResponse) error {
+	killed, err := m.master.CancelSession(req.Session)
+	rep.Killed = killed
+	return err
+}
+
 func (m *LocalMaster) RefreshAttributeCache(input *int, output *int) error {
+	m.master.beginRequest()
+	defer m.master.endRequest()
 	log.Println("Refreshing attribute cache")
 	m.master.refreshAttributeCache()
 	m.master.setAnalysisDir()
@@ -53,7 +85,18 @@ func (m *LocalMaster) RefreshAttributeCache(input *int, output *int) error {
 	return nil
 }
 
+// RefreshDirectory refreshes the attributes below an absolute
+// directory only.
+func (m *LocalMaster) RefreshDirectory(dir *string, output *int) error {
+	m.master.beginRequest()
+	defer m.master.endRequest()
+	m.master.refreshDir(*dir)
+	return nil
+}
+
 func (m *LocalMaster) InspectFile(req *attr.AttrRequest, rep *attr.AttrResponse) error {
+	m.master.beginRequest()
+	defer m.master.endRequest()
 	a := m.master.attributes.GetDir(req.Name)
 	rep.Attrs = append(rep.Attrs, a)
 	return nil
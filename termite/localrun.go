@@ -3,27 +3,201 @@ package termite
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
+// LocalRule decides how the shell-wrapper runs a command. The
+// patterns are regular expressions; a rule applies if all of its
+// non-empty patterns match.
 type LocalRule struct {
-	Regexp      string
+	// Name of the rule, for -check-rules.
+	Name string
+
+	// Matches the whole command.
+	Regexp string
+
+	// Matches the working directory.
+	Dir string
+
+	// Matches the basename of the binary. Only simple commands,
+	// without shell syntax, have a binary.
+	Binary string
+
+	// Each of these must match an element of the argv of a simple
+	// command.
+	Argv []string
+
+	// Matches the declared target, $MAKE_TARGET.
+	Target string
+
+	// Rules with higher priority are tried first. Rules of equal
+	// priority are tried in file order.
+	Priority int
+
+	// If set, the rules of this file are inserted in place of this
+	// one, and the other fields are ignored. A relative path is
+	// relative to the including file.
+	Include string
+
 	Local       bool
 	Recurse     bool
 	SkipRefresh bool
 	Debug       bool
+
+	// If set, overrides the worker's network setting for remote
+	// commands.
+	ShareNetwork *bool
+
+	// Root image for remote commands, relative to the directory
+	// holding the .termite-localrc.
+	RootImage string
+
+	// Environment policy for remote commands, applied before the
+	// master's.
+	Env *EnvPolicy
+
+	// Kill the command if it runs longer than this, eg. "10m".
+	Timeout string
+}
+
+// TimeoutDuration returns the parsed Timeout, or zero if there is
+// none.
+func (r *LocalRule) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(r.Timeout)
+	return d
+}
+
+// LocalCommand is what rules are matched against.
+type LocalCommand struct {
+	Command string
+	Dir     string
+
+	// The parsed command, or nil if it uses shell syntax.
+	Argv []string
+
+	Target string
+}
+
+// NewLocalCommand describes a shell command.
+func NewLocalCommand(cmd string, dir string, target string) *LocalCommand {
+	return &LocalCommand{
+		Command: cmd,
+		Dir:     dir,
+		Argv:    ParseCommand(cmd),
+		Target:  target,
+	}
+}
+
+// localRule is a LocalRule with compiled patterns.
+type localRule struct {
+	*LocalRule
+
+	// Where the rule was defined, eg. ".termite-localrc rule 2".
+	source string
+
+	regexp *regexp.Regexp
+	dir    *regexp.Regexp
+	binary *regexp.Regexp
+	argv   []*regexp.Regexp
+	target *regexp.Regexp
+}
+
+func compileLocalRule(r *LocalRule, source string) (*localRule, error) {
+	c := &localRule{LocalRule: r, source: source}
+	if r.Name != "" {
+		c.source = fmt.Sprintf("%s (%s)", source, r.Name)
+	}
+
+	for _, p := range []struct {
+		pattern string
+		dest    **regexp.Regexp
+	}{
+		{r.Regexp, &c.regexp},
+		{r.Dir, &c.dir},
+		{r.Binary, &c.binary},
+		{r.Target, &c.target},
+	} {
+		if p.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.pattern)
+		if err != nil {
+			return nil, err
+		}
+		*p.dest = re
+	}
+	for _, p := range r.Argv {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		c.argv = append(c.argv, re)
+	}
+
+	if r.Timeout != "" {
+		if d, err := time.ParseDuration(r.Timeout); err != nil {
+			return nil, err
+		} else if d <= 0 {
+			return nil, fmt.Errorf("timeout must be positive: %q", r.Timeout)
+		}
+	}
+	if r.Env != nil {
+		if err := r.Env.check(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// match returns whether the rule applies to the command, or why
+// not.
+func (r *localRule) match(c *LocalCommand) (bool, string) {
+	if r.regexp != nil && !r.regexp.MatchString(c.Command) {
+		return false, fmt.Sprintf("command does not match %q", r.Regexp)
+	}
+	if r.dir != nil && !r.dir.MatchString(c.Dir) {
+		return false, fmt.Sprintf("directory %q does not match %q", c.Dir, r.Dir)
+	}
+	if (r.binary != nil || len(r.argv) > 0) && len(c.Argv) == 0 {
+		return false, "not a simple command"
+	}
+	if r.binary != nil {
+		if base := filepath.Base(c.Argv[0]); !r.binary.MatchString(base) {
+			return false, fmt.Sprintf("binary %q does not match %q", base, r.Binary)
+		}
+	}
+	for i, re := range r.argv {
+		found := false
+		for _, a := range c.Argv {
+			if re.MatchString(a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, fmt.Sprintf("no argument matches %q", r.LocalRule.Argv[i])
+		}
+	}
+	if r.target != nil && !r.target.MatchString(c.Target) {
+		return false, fmt.Sprintf("target %q does not match %q", c.Target, r.Target)
+	}
+	return true, ""
 }
 
 type localDecider struct {
-	rules []LocalRule
+	rules []*localRule
 }
 
-func newLocalDecider(input io.Reader) *localDecider {
+// parseLocalRules reads rules in JSON format. Lines starting with #
+// or // are comments.
+func parseLocalRules(input io.Reader) ([]LocalRule, error) {
 	reader := bufio.NewReader(input)
 	out := []byte{}
 	for {
@@ -38,51 +212,138 @@ func newLocalDecider(input io.Reader) *localDecider {
 		out = append(out, '\n')
 	}
 
-	decider := localDecider{}
-	err := json.Unmarshal([]byte(out), &decider.rules)
-	if err != nil {
-		log.Println(err)
-		return nil
+	var rules []LocalRule
+	if err := json.Unmarshal(out, &rules); err != nil {
+		return nil, err
 	}
-	return &decider
+	return rules, nil
 }
 
-func (d *localDecider) ShouldRunLocally(command string) *LocalRule {
-	for _, r := range d.rules {
-		m, err := regexp.MatchString(r.Regexp, command)
-		if err != nil {
-			log.Fatal("regexp error:", err)
+// add compiles rules read from name, which resolves relative
+// includes against dir. The files being read are in including, to
+// catch include cycles.
+func (d *localDecider) add(input io.Reader, name string, dir string, including map[string]bool) error {
+	rules, err := parseLocalRules(input)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		source := fmt.Sprintf("%s rule %d", name, i+1)
+		if r.Include != "" {
+			inc := r.Include
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(dir, inc)
+			}
+			if err := d.read(inc, including); err != nil {
+				return fmt.Errorf("%s: %v", source, err)
+			}
 			continue
 		}
-		if m {
-			return &r
+		c, err := compileLocalRule(r, source)
+		if err != nil {
+			return fmt.Errorf("%s: %v", source, err)
 		}
+		d.rules = append(d.rules, c)
 	}
-
 	return nil
 }
 
-func NewLocalDecider(dir string) *localDecider {
-	localRc := filepath.Join(dir, ".termite-localrc")
+func (d *localDecider) read(name string, including map[string]bool) error {
+	name = filepath.Clean(name)
+	if including[name] {
+		return fmt.Errorf("include cycle at %s", name)
+	}
+	including[name] = true
+	defer delete(including, name)
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return d.add(f, name, filepath.Dir(name), including)
+}
+
+// sort orders the rules by priority, keeping the file order for
+// equal priorities.
+func (d *localDecider) sort() {
+	sort.SliceStable(d.rules, func(i, j int) bool {
+		return d.rules[i].Priority > d.rules[j].Priority
+	})
+}
 
-	f, _ := os.Open(localRc)
-	if f != nil {
-		defer f.Close()
-		d := newLocalDecider(f)
-		if d == nil {
-			log.Fatal("could not parse:", localRc)
+func newLocalDecider(input io.Reader) (*localDecider, error) {
+	d := &localDecider{}
+	if err := d.add(input, "input", ".", map[string]bool{}); err != nil {
+		return nil, err
+	}
+	d.sort()
+	return d, nil
+}
+
+// ReadLocalRules reads and validates a rule file, including the
+// files it includes.
+func ReadLocalRules(name string) (*localDecider, error) {
+	d := &localDecider{}
+	if err := d.read(name, map[string]bool{}); err != nil {
+		return nil, err
+	}
+	d.sort()
+	return d, nil
+}
+
+// Match returns the first rule that applies to the command, or nil.
+func (d *localDecider) Match(c *LocalCommand) *LocalRule {
+	for _, r := range d.rules {
+		if ok, _ := r.match(c); ok {
+			return r.LocalRule
 		}
-		return d
 	}
+	return nil
+}
 
-	rules := []LocalRule{
-		{
-			// ?s = . matches \n
-			Regexp:      "(?s).*termite-make",
-			Local:       true,
-			Recurse:     true,
-			SkipRefresh: true,
-		},
+// Explain describes how the rules are tried for a command, one line
+// per rule up to the one that applies.
+func (d *localDecider) Explain(c *LocalCommand) []string {
+	var lines []string
+	for _, r := range d.rules {
+		ok, why := r.match(c)
+		if ok {
+			return append(lines, fmt.Sprintf("%s: applies (local: %v)", r.source, r.Local))
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", r.source, why))
+	}
+	return append(lines, "no rule applies: the command runs remotely")
+}
+
+// RuleCount returns the number of rules, after resolving includes.
+func (d *localDecider) RuleCount() int {
+	return len(d.rules)
+}
+
+func (d *localDecider) ShouldRunLocally(command string) *LocalRule {
+	return d.Match(NewLocalCommand(command, "", ""))
+}
+
+// NewLocalDecider reads the .termite-localrc in dir, or returns the
+// default rules if there is none.
+func NewLocalDecider(dir string) (*localDecider, error) {
+	localRc := filepath.Join(dir, ".termite-localrc")
+	if _, err := os.Stat(localRc); err == nil {
+		return ReadLocalRules(localRc)
+	}
+
+	rule, err := compileLocalRule(&LocalRule{
+		Name: "default",
+		// ?s = . matches \n
+		Regexp:      "(?s).*termite-make",
+		Local:       true,
+		Recurse:     true,
+		SkipRefresh: true,
+	}, "default")
+	if err != nil {
+		return nil, err
 	}
-	return &localDecider{rules}
+	return &localDecider{[]*localRule{rule}}, nil
 }
@@ -3,7 +3,11 @@ package termite
 import (
 	"bytes"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLocalDecider(t *testing.T) {
@@ -12,7 +16,10 @@ func TestLocalDecider(t *testing.T) {
 		"[{\"Regexp\": \".*foo\", \"Local\": false},\n " +
 		"{\"Regexp\": \".*bar\", \"Local\": true}]")
 	buf := bytes.NewBufferString(str)
-	l := newLocalDecider(buf)
+	l, err := newLocalDecider(buf)
+	if err != nil {
+		t.Fatalf("newLocalDecider: %v", err)
+	}
 
 	r := l.ShouldRunLocally("xfoo")
 	if r.Local != false {
@@ -27,9 +34,120 @@ func TestLocalDecider(t *testing.T) {
 
 func TestLocalDeciderDefault(t *testing.T) {
 	d, _ := ioutil.TempDir("", "termite")
-	l := NewLocalDecider(d)
+	l, err := NewLocalDecider(d)
+	if err != nil {
+		t.Fatalf("NewLocalDecider: %v", err)
+	}
 	r := l.ShouldRunLocally("foo \n bar \n  termite-make ; \ndone")
 	if r == nil || r.Local != true {
 		t.Error("termite-make should run locally. Rule:", r)
 	}
 }
+
+func TestLocalDeciderFields(t *testing.T) {
+	l, err := newLocalDecider(bytes.NewBufferString(`[
+  {"Name": "gen", "Dir": "/gen$", "Local": true},
+  {"Name": "cc", "Binary": "^gcc$", "Argv": ["^-c$", "[.]c$"], "Timeout": "1m"},
+  {"Name": "target", "Target": "[.]pb[.]h$", "Local": true}]`))
+	if err != nil {
+		t.Fatalf("newLocalDecider: %v", err)
+	}
+
+	for _, c := range []struct {
+		cmd, dir, target, rule string
+	}{
+		{"gcc -c foo.c", "/src/gen", "", "gen"},
+		{"/usr/bin/gcc -c foo.c -o foo.o", "/src", "", "cc"},
+		{"gcc foo.o", "/src", "", ""},
+		{"gcc -c foo.c && true", "/src", "", ""},
+		{"protoc x", "/src", "x.pb.h", "target"},
+	} {
+		r := l.Match(NewLocalCommand(c.cmd, c.dir, c.target))
+		name := ""
+		if r != nil {
+			name = r.Name
+		}
+		if name != c.rule {
+			t.Errorf("%q in %s: got rule %q, want %q", c.cmd, c.dir, name, c.rule)
+		}
+	}
+
+	r := l.Match(NewLocalCommand("gcc -c foo.c", "/src", ""))
+	if got := r.TimeoutDuration(); got != time.Minute {
+		t.Errorf("timeout: got %v", got)
+	}
+}
+
+func TestLocalDeciderPriority(t *testing.T) {
+	l, err := newLocalDecider(bytes.NewBufferString(`[
+  {"Name": "all", "Regexp": ".*"},
+  {"Name": "make", "Binary": "make", "Priority": 10, "Local": true}]`))
+	if err != nil {
+		t.Fatalf("newLocalDecider: %v", err)
+	}
+	if r := l.ShouldRunLocally("make all"); r == nil || r.Name != "make" {
+		t.Errorf("got %v, want rule make", r)
+	}
+	if r := l.ShouldRunLocally("cc x"); r == nil || r.Name != "all" {
+		t.Errorf("got %v, want rule all", r)
+	}
+}
+
+func TestLocalDeciderInclude(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, ".termite-localrc"),
+		[]byte(`[{"Include": "rules/common"}, {"Name": "last", "Regexp": ".*"}]`), 0644)
+	os.Mkdir(filepath.Join(dir, "rules"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "rules", "common"),
+		[]byte(`[{"Name": "make", "Binary": "make", "Local": true}]`), 0644)
+
+	l, err := NewLocalDecider(dir)
+	if err != nil {
+		t.Fatalf("NewLocalDecider: %v", err)
+	}
+	if l.RuleCount() != 2 {
+		t.Errorf("got %d rules, want 2", l.RuleCount())
+	}
+	if r := l.ShouldRunLocally("make"); r == nil || r.Name != "make" {
+		t.Errorf("got %v, want rule make", r)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "rules", "common"),
+		[]byte(`[{"Include": "../.termite-localrc"}]`), 0644)
+	if _, err := NewLocalDecider(dir); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("include cycle: got %v", err)
+	}
+}
+
+func TestLocalDeciderErrors(t *testing.T) {
+	for _, s := range []string{
+		`[{"Regexp": "[a-"}]`,
+		`[{"Argv": ["("]}]`,
+		`[{"Timeout": "soon"}]`,
+		`[{"Env": {"Deny": ["[A-"]}}]`,
+		`[{"Regexp": }]`,
+	} {
+		if _, err := newLocalDecider(bytes.NewBufferString(s)); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestLocalDeciderExplain(t *testing.T) {
+	l, err := newLocalDecider(bytes.NewBufferString(`[
+  {"Name": "make", "Binary": "make", "Local": true},
+  {"Name": "cc", "Binary": "gcc"}]`))
+	if err != nil {
+		t.Fatalf("newLocalDecider: %v", err)
+	}
+	lines := l.Explain(NewLocalCommand("gcc -c x.c", "/src", ""))
+	if len(lines) != 2 || !strings.Contains(lines[0], "does not match") || !strings.Contains(lines[1], "(cc): applies") {
+		t.Errorf("got %q", lines)
+	}
+	lines = l.Explain(NewLocalCommand("ld x.o", "/src", ""))
+	if len(lines) != 3 || !strings.Contains(lines[2], "no rule applies") {
+		t.Errorf("got %q", lines)
+	}
+}
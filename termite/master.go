@@ -8,6 +8,7 @@ import (
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +36,32 @@ type Master struct {
 
 	analysisDirMu sync.Mutex
 	analysisDir   string
+
+	// Root images by path.
+	imageHashes *imageHashes
+
+	// Recent results of verification runs that differed.
+	nondeterminismMu sync.Mutex
+	nondeterminism   []*nondeterminismReport
+
+	// Recent tasks that read outside the allowed roots.
+	hermeticityMu sync.Mutex
+	hermeticity   []*hermeticityReport
+
+	// Requests from the shell-wrapper in flight, and when the last
+	// one finished.
+	activityMu     sync.Mutex
+	activeRequests int
+	lastActivity   time.Time
+
+	sessions *sessions
+
+	// Includes of scanned files in pump mode, by path.
+	pumpMu      sync.Mutex
+	pumpScanned map[string]*scannedFile
+
+	// Set if we serve a make jobserver.
+	jobServer *jobServer
 }
 
 // Immutable state and options for master.
@@ -47,6 +74,9 @@ type MasterOptions struct {
 	// How often a failed should be retried on another worker.
 	RetryCount int
 
+	// If set, how to retry failed tasks. This overrides RetryCount.
+	Retry *RetryPolicy
+
 	// List of files that should not be served
 	Excludes []string
 
@@ -76,6 +106,7 @@ type MasterOptions struct {
 	XAttrCache bool
 
 	Uid int
+	Gid int
 
 	// The log file.  This is to ensure we don't export or hash
 	// the log file.
@@ -86,6 +117,57 @@ type MasterOptions struct {
 
 	// Dump action graph data into this directory
 	AnalysisDir string
+
+	// When to stop using workers that fail too often.
+	Quarantine QuarantineOptions
+
+	// Tar file or directory to use as the root file system for
+	// tasks, rather than the master's. The writable root is still
+	// served from the master.
+	RootImage string
+
+	// Additions to the mount policy of the workers, eg. a local
+	// ccache directory.
+	MountPolicy *MountPolicy
+
+	// If set, run tasks here rather than on termite workers.
+	Backend Backend
+
+	// Which environment variables to pass to tasks. If nil,
+	// DefaultEnvPolicy() is used.
+	EnvPolicy *EnvPolicy
+
+	// Give tasks deterministic randomness and SOURCE_DATE_EPOCH, and
+	// normalize the attributes of their outputs.
+	Reproducible bool
+
+	// SOURCE_DATE_EPOCH for reproducible mode, in seconds. If zero,
+	// DefaultSourceDateEpoch is used.
+	SourceDateEpoch int64
+
+	// Fraction of the tasks to run a second time on another
+	// worker, to check that they produce the same output.
+	VerifyRate float64
+
+	// Commands matching this are always run a second time.
+	VerifyCommands *regexp.Regexp
+
+	// If set, check which files outside the writable root tasks
+	// read. Backends don't report reads, so this can't be used
+	// with one.
+	Hermeticity *HermeticityPolicy
+
+	// If positive, exit after this long without requests from the
+	// shell-wrapper.
+	IdleTimeout time.Duration
+
+	// If set, send the headers of C and C++ compiles along with
+	// the request.
+	Pump bool
+
+	// If set, serve a make jobserver with a token for each reserved
+	// job slot.
+	Jobserver bool
 }
 
 type replayRequest struct {
@@ -176,6 +258,9 @@ func NewMaster(options *MasterOptions) *Master {
 		replayChannel: make(chan *replayRequest, 1),
 		quit:          make(chan int, 0),
 		timing:        stats.NewTimerStats(),
+		imageHashes:   newImageHashes(),
+		lastActivity:  time.Now(),
+		sessions:      newSessions(),
 	}
 	m.contentStore = cba.NewStore(&options.StoreOptions, m.timing)
 
@@ -184,6 +269,10 @@ func NewMaster(options *MasterOptions) *Master {
 		o.Period = 60.0
 	}
 	o.Uid = os.Getuid()
+	o.Gid = os.Getgid()
+	if o.Reproducible && o.SourceDateEpoch == 0 {
+		o.SourceDateEpoch = DefaultSourceDateEpoch
+	}
 	if o.SourceRoot != "" {
 		o.SourceRoot, _ = filepath.Abs(o.SourceRoot)
 		o.SourceRoot, _ = filepath.EvalSymlinks(o.SourceRoot)
@@ -194,6 +283,12 @@ func NewMaster(options *MasterOptions) *Master {
 	if o.LogFile != "" {
 		o.LogFile, _ = filepath.Abs(o.LogFile)
 	}
+	if o.RootImage != "" {
+		o.RootImage, _ = filepath.Abs(o.RootImage)
+	}
+	if o.EnvPolicy == nil {
+		o.EnvPolicy = DefaultEnvPolicy()
+	}
 
 	m.options = &o
 	m.dialer = newWorkerDialer(o.Secret)
@@ -213,8 +308,14 @@ func NewMaster(options *MasterOptions) *Master {
 			return fuse.ToAttr(fi)
 		})
 	m.fileServer = attr.NewServer(m.attributes, m.timing)
+	if o.Hermeticity != nil && o.Backend != nil {
+		log.Fatal("Hermeticity can't be checked on a backend: it doesn't report the files tasks read.")
+	}
 	m.CheckPrivate()
 	m.setAnalysisDir()
+	if o.Jobserver && o.Backend == nil && o.Socket != "" {
+		m.openJobServer()
+	}
 
 	// Generate taskids.
 	go func() {
@@ -279,8 +380,15 @@ func (m *Master) Start() {
 	if m.options.FetchAll {
 		go m.FetchAll()
 	}
+	if m.jobServer != nil {
+		go m.jobServer.serve(m.jobCapacity, m.jobsIdle)
+	}
 	go localStart(m, m.options.Socket)
 	m.waitForExit()
+	os.Remove(m.options.Socket)
+	if m.jobServer != nil {
+		m.jobServer.close()
+	}
 }
 
 func (m *Master) createMirror(addr string, jobs int) (*mirrorConnection, error) {
@@ -337,6 +445,7 @@ func (m *Master) createMirror(addr string, jobs int) (*mirrorConnection, error)
 		RevContentId: revContentId,
 		WritableRoot: m.options.WritableRoot,
 		MaxJobCount:  jobs,
+		MountPolicy:  m.options.MountPolicy,
 	}
 	rep := CreateMirrorResponse{}
 	cl := rpc.NewClient(conn)
@@ -389,6 +498,13 @@ func (m *Master) runOnMirror(mirror *mirrorConnection, req *WorkRequest, rep *Wo
 		if err != nil {
 			return err
 		}
+		if req.Terminal != nil {
+			// The worker streams terminal output back.
+			go func(rwc io.ReadWriteCloser) {
+				io.Copy(rwc, destInputConn)
+				rwc.Close()
+			}(req.StdinConn)
+		}
 		go func(rwc io.ReadWriteCloser) {
 			HookedCopy(destInputConn, rwc, PrintStdinSliceLen)
 			destInputConn.Close()
@@ -407,25 +523,53 @@ func (m *Master) runOnMirror(mirror *mirrorConnection, req *WorkRequest, rep *Wo
 	err = mirror.rpcClient.Call("Mirror.Run", req, rep)
 	m.mirrors.stats.Exit("remote")
 	if err == nil {
+		m.checkHermeticity(req, rep)
 		m.mirrors.stats.Enter("filewait")
 		err = mirror.fileSetWaiter.Wait(rep.FileSet, rep.TaskIds, req.TaskId)
 		m.mirrors.stats.Exit("filewait")
 	}
+	if err == nil && rep.Draining {
+		m.mirrors.drain(mirror)
+	}
 	return err
 }
 
-func (m *Master) runOnce(req *WorkRequest, rep *WorkResponse) error {
-	mirror, err := m.mirrors.pick()
+// runOnce runs a task on a worker, preferably one not in avoid. It
+// returns the worker address.
+func (m *Master) runOnce(req *WorkRequest, rep *WorkResponse, avoid map[string]bool) (string, error) {
+	if m.options.Backend != nil {
+		return "", m.runOnBackend(req, rep)
+	}
+	mirror, err := m.mirrors.pick(avoid)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if err := m.placeTask(req, mirror); err != nil {
+		return "", err
 	}
+
+	// The verification run goes first, so it sees the same
+	// inputs as the real one, even for commands that read their
+	// own outputs.
+	var check *WorkResponse
+	if m.shouldVerify(req) {
+		req.Isolate = true
+		check = m.runVerification(mirror, req)
+	}
+
 	err = m.runOnMirror(mirror, req, rep)
+	// Tasks of cancelled sessions were killed on purpose.
+	m.mirrors.recordOutcome(mirror, err != nil ||
+		(workerFault(rep) && !m.sessions.cancelled(req.Session)))
 	if err != nil {
 		m.mirrors.drop(mirror, err)
-		return err
+		return mirror.workerAddr, err
+	}
+	if check != nil {
+		m.compareRuns(req, rep, check)
 	}
 
-	return err
+	return mirror.workerAddr, err
 }
 
 func (m *Master) setAnalysisDir() {
@@ -449,34 +593,50 @@ func (m *Master) run(req *WorkRequest, rep *WorkResponse) (err error) {
 	m.mirrors.stats.Enter("run")
 	defer m.mirrors.stats.Exit("run")
 
-	m.analysisDirMu.Lock()
-	if m.analysisDir != "" {
+	req.TaskId = <-m.taskIds
+	s := m.session(req)
+	if err := m.sessions.acquire(s, req.TaskId); err != nil {
+		return err
+	}
+	defer func() {
+		m.sessions.release(s, req.TaskId, err != nil || rep.Exit != 0)
+	}()
+
+	analysisDir := s.analysisDir
+	if s.id == "" {
+		m.analysisDirMu.Lock()
+		analysisDir = m.analysisDir
+		m.analysisDirMu.Unlock()
+	}
+	if analysisDir != "" {
 		req.TrackReads = true
-		defer DumpAnnotations(req, rep, time.Now(), m.analysisDir, m.options.WritableRoot)
+		defer DumpAnnotations(req, rep, time.Now(), analysisDir, m.options.WritableRoot)
 	}
-	m.analysisDirMu.Unlock()
 
-	req.TaskId = <-m.taskIds
 	if m.MaybeRunInMaster(req, rep) {
 		log.Println("Ran in master:", req.Summary())
 		return nil
 	}
 
-	if req.Worker != "" {
+	if err := m.resolveRootImage(req); err != nil {
+		return err
+	}
+	m.makeReproducible(req)
+	m.prepareHermeticity(req)
+	m.preparePump(req)
+
+	if req.Worker != "" && m.options.Backend == nil {
 		mc, err := m.mirrors.find(req.Worker)
 		if err != nil {
 			return err
 		}
+		if err := m.placeTask(req, mc); err != nil {
+			return err
+		}
 		return m.runOnMirror(mc, req, rep)
 	}
 
-	err = m.runOnce(req, rep)
-	for i := 0; i < m.options.RetryCount && err != nil; i++ {
-		log.Println("Retrying; last error:", err)
-		err = m.runOnce(req, rep)
-	}
-
-	return err
+	return m.runWithRetries(req, rep)
 }
 
 func (m *Master) replayFileModifications(infos []*attr.FileAttr, delFileHashes map[string]string, newFiles map[string][]string) {
@@ -554,6 +714,9 @@ func (m *Master) replayFileModifications(infos []*attr.FileAttr, delFileHashes m
 }
 
 func (m *Master) replay(fset attr.FileSet) {
+	if m.options.Reproducible {
+		m.normalizeFileSet(fset)
+	}
 	// TODO - make a .termitetmp for replayed files.
 	req := replayRequest{
 		make(map[string][]string),
@@ -627,6 +790,20 @@ func (m *Master) refreshAttributeCache() {
 	m.attributes.Queue(updated)
 }
 
+// refreshDir picks up changes below a directory that were made
+// outside the master. Its parent is refreshed too, as it lists the
+// directory.
+func (m *Master) refreshDir(dir string) {
+	dir = strings.TrimLeft(dir, "/")
+	updated := m.attributes.Refresh(dir)
+	if parent, _ := SplitPath(dir); m.attributes.Have(parent) {
+		a := m.uncachedGetAttr(parent)
+		m.attributes.Update([]*attr.FileAttr{a})
+		updated.Files = append(updated.Files, a)
+	}
+	m.attributes.Queue(updated)
+}
+
 func (m *Master) fetchAll(path string) {
 	a := m.attributes.GetDir(path)
 	for n := range a.NameModeMap {
@@ -635,18 +812,34 @@ func (m *Master) fetchAll(path string) {
 }
 
 func (m *Master) waitForExit() {
-	go m.mirrors.refreshWorkers()
+	if m.options.Backend == nil {
+		go m.mirrors.refreshWorkers()
+		go m.mirrors.reportDemand()
+	}
 	ticker := time.NewTicker(m.options.Period)
 
+	var idleCheck <-chan time.Time
+	if m.options.IdleTimeout > 0 {
+		t := time.NewTicker(m.options.IdleTimeout / 10)
+		defer t.Stop()
+		idleCheck = t.C
+	}
+
 L:
 	for {
 		select {
 		case <-m.quit:
 			log.Println("quit received.")
 			break L
+		case <-idleCheck:
+			if m.idleFor(time.Now()) >= m.options.IdleTimeout {
+				log.Printf("idle for %v, exiting.", m.options.IdleTimeout)
+				break L
+			}
 		case <-ticker.C:
 			log.Println("periodic household.")
 			m.mirrors.periodicHouseholding()
+			m.sessions.expire(time.Now())
 		}
 	}
 }
@@ -0,0 +1,476 @@
+package termite
+
+import (
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+)
+
+// The commands below (mv, cp, touch, ln -s, chmod) only change files
+// the master already knows, so we apply them to the writable root
+// directly rather than doing a round trip to a worker. We only handle
+// the straightforward cases: for unknown flags, errors and anything
+// ambiguous, we let a worker run the real command.
+
+// The umask of the master, for modes of new files.
+var umask = func() uint32 {
+	u := syscall.Umask(0)
+	syscall.Umask(u)
+	return uint32(u)
+}()
+
+// fileCommand collects the changes of a command before they are
+// replayed.
+type fileCommand struct {
+	master *Master
+	dir    string
+	now    time.Time
+
+	files []*attr.FileAttr
+
+	// Changes made so far, so later arguments see them.
+	pending map[string]*attr.FileAttr
+
+	// Directories whose entries changed, in order.
+	parents    []*attr.FileAttr
+	parentSeen map[string]bool
+}
+
+func (m *Master) maybeRunFileCommand(binary string, req *WorkRequest, rep *WorkResponse) bool {
+	c := &fileCommand{
+		master:     m,
+		dir:        req.Dir,
+		now:        time.Now(),
+		pending:    map[string]*attr.FileAttr{},
+		parentSeen: map[string]bool{},
+	}
+
+	var ok bool
+	args := req.Argv[1:]
+	switch binary {
+	case "mv":
+		ok = c.mv(args)
+	case "cp":
+		ok = c.cp(args)
+	case "touch":
+		ok = c.touch(args)
+	case "ln":
+		ok = c.ln(args)
+	case "chmod":
+		ok = c.chmod(args)
+	}
+	if !ok {
+		return false
+	}
+
+	log.Println("Running in master:", req.Summary())
+	// Parents go last, so their timestamps are not changed by
+	// replaying their entries.
+	fs := attr.FileSet{Files: append(c.files, c.parents...)}
+	if len(fs.Files) > 0 {
+		m.replay(fs)
+	}
+	rep.Exit = 0
+	return true
+}
+
+// path returns the rootless path for a command argument. It fails
+// for paths outside the writable root, and for paths with "..",
+// which could traverse symlinks.
+func (c *fileCommand) path(arg string) (string, bool) {
+	if arg == "" || strings.Contains(arg, "..") {
+		return "", false
+	}
+	if arg[0] != '/' {
+		arg = filepath.Join(c.dir, arg)
+	}
+	arg = filepath.Clean(arg)
+	root := c.master.options.WritableRoot
+	if arg == root || !under(arg, root) {
+		return "", false
+	}
+	return strings.TrimLeft(arg, "/"), true
+}
+
+func (c *fileCommand) get(p string) *attr.FileAttr {
+	if a, ok := c.pending[p]; ok {
+		return a
+	}
+	return c.master.attributes.Get(p)
+}
+
+// update records a change in metadata or content of an existing
+// file.
+func (c *fileCommand) update(f *attr.FileAttr) {
+	c.files = append(c.files, f)
+	c.pending[f.Path] = f
+}
+
+// change records the creation or deletion of a file, which also
+// changes its directory.
+func (c *fileCommand) change(f *attr.FileAttr) bool {
+	dir, _ := SplitPath(f.Path)
+	if !c.parentSeen[dir] {
+		d := c.get(dir)
+		if d.Deletion() || !d.IsDir() {
+			return false
+		}
+		d = copyFileAttr(d)
+		d.SetTimes(nil, &c.now, &c.now)
+		c.parents = append(c.parents, d)
+		c.parentSeen[dir] = true
+	}
+	c.update(f)
+	return true
+}
+
+// newAttr returns attributes for a file created by the master.
+func (c *fileCommand) newAttr(mode uint32) *fuse.Attr {
+	a := &fuse.Attr{
+		Mode:  mode,
+		Owner: fuse.Owner{Uid: uint32(c.master.options.Uid), Gid: uint32(c.master.options.Gid)},
+	}
+	a.SetTimes(&c.now, &c.now, &c.now)
+	return a
+}
+
+// copyFileAttr copies a FileAttr, including its attributes, but not
+// its directory entries.
+func copyFileAttr(f *attr.FileAttr) *attr.FileAttr {
+	r := f.Copy(false)
+	if f.Attr != nil {
+		a := *f.Attr
+		r.Attr = &a
+	}
+	return r
+}
+
+// targets resolves the arguments of mv, cp and ln into source and
+// destination pairs: either "SRC DEST" or "SRC... DIR". With
+// noDeref, a symlink as DEST is replaced rather than followed.
+func (c *fileCommand) targets(args []string, noDeref bool) (srcs []string, dests []string, ok bool) {
+	if len(args) < 2 {
+		return nil, nil, false
+	}
+	last, ok := c.path(args[len(args)-1])
+	if !ok {
+		return nil, nil, false
+	}
+	d := c.get(last)
+	toDir := !d.Deletion() && d.IsDir()
+	if !toDir && (len(args) != 2 || (d.IsSymlink() && !noDeref) ||
+		strings.HasSuffix(args[len(args)-1], "/")) {
+		return nil, nil, false
+	}
+	for _, a := range args[:len(args)-1] {
+		dest := last
+		if toDir {
+			dest = filepath.Join(last, filepath.Base(a))
+		}
+		srcs = append(srcs, a)
+		dests = append(dests, dest)
+	}
+	return srcs, dests, true
+}
+
+func (c *fileCommand) mv(args []string) bool {
+	g := Getopt(args, nil, nil, true)
+	delete(g.Long, "force")
+	delete(g.Short, 'f')
+	if g.HasOptions() {
+		return false
+	}
+
+	srcs, dests, ok := c.targets(g.Args, false)
+	if !ok {
+		return false
+	}
+	for i, arg := range srcs {
+		src, ok := c.path(arg)
+		if !ok || src == dests[i] {
+			return false
+		}
+		s := c.get(src)
+		if s.Deletion() || s.IsDir() || (s.IsRegular() && s.Hash == "") {
+			return false
+		}
+		if d := c.get(dests[i]); !d.Deletion() && d.IsDir() {
+			return false
+		}
+
+		moved := copyFileAttr(s)
+		moved.Path = dests[i]
+		moved.SetTimes(nil, nil, &c.now)
+		if !c.change(&attr.FileAttr{Path: src}) || !c.change(moved) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fileCommand) cp(args []string) bool {
+	g := Getopt(args, nil, nil, true)
+	preserve := g.HasShort('p')
+	delete(g.Short, 'p')
+	delete(g.Long, "force")
+	delete(g.Short, 'f')
+	if g.HasOptions() {
+		return false
+	}
+
+	srcs, dests, ok := c.targets(g.Args, false)
+	if !ok {
+		return false
+	}
+	for i, arg := range srcs {
+		src, ok := c.path(arg)
+		if !ok || src == dests[i] {
+			return false
+		}
+		s := c.get(src)
+		if !s.IsRegular() || s.Hash == "" {
+			return false
+		}
+		d := c.get(dests[i])
+		if !d.Deletion() && !d.IsRegular() {
+			return false
+		}
+
+		mode := s.Mode & 07777
+		switch {
+		case preserve:
+		case d.Deletion():
+			mode &^= umask
+		default:
+			mode = d.Mode & 07777
+		}
+		copied := &attr.FileAttr{
+			Path: dests[i],
+			Hash: s.Hash,
+			Attr: c.newAttr(syscall.S_IFREG | mode),
+		}
+		copied.Size = s.Size
+		if preserve {
+			at, mt := s.AccessTime(), s.ModTime()
+			copied.SetTimes(&at, &mt, nil)
+		}
+		if d.Deletion() {
+			if !c.change(copied) {
+				return false
+			}
+		} else {
+			c.update(copied)
+		}
+	}
+	return true
+}
+
+func (c *fileCommand) touch(args []string) bool {
+	g := Getopt(args, nil, nil, true)
+	noCreate := g.HasShort('c') || g.HasLong("no-create")
+	delete(g.Short, 'c')
+	delete(g.Long, "no-create")
+	if g.HasOptions() || len(g.Args) == 0 {
+		return false
+	}
+
+	for _, arg := range g.Args {
+		p, ok := c.path(arg)
+		if !ok {
+			return false
+		}
+		a := c.get(p)
+		switch {
+		case a.Deletion():
+			if noCreate {
+				continue
+			}
+			f := &attr.FileAttr{
+				Path: p,
+				Hash: c.master.contentStore.Save(nil),
+				Attr: c.newAttr(syscall.S_IFREG | 0666&^umask),
+			}
+			if f.Hash == "" || !c.change(f) {
+				return false
+			}
+		case a.IsSymlink():
+			return false
+		case a.IsRegular() && a.Hash == "":
+			return false
+		default:
+			a = copyFileAttr(a)
+			a.SetTimes(&c.now, &c.now, &c.now)
+			c.update(a)
+		}
+	}
+	return true
+}
+
+func (c *fileCommand) ln(args []string) bool {
+	g := Getopt(args, nil, nil, true)
+	symbolic := g.HasShort('s') || g.HasLong("symbolic")
+	force := g.HasShort('f') || g.HasLong("force")
+	noDeref := g.HasShort('n') || g.HasLong("no-dereference")
+	for _, o := range []byte("sfn") {
+		delete(g.Short, o)
+	}
+	for _, o := range []string{"symbolic", "force", "no-dereference"} {
+		delete(g.Long, o)
+	}
+	if !symbolic || g.HasOptions() || len(g.Args) == 0 {
+		return false
+	}
+
+	var targets, links []string
+	if len(g.Args) == 1 {
+		p, ok := c.path(filepath.Base(g.Args[0]))
+		if !ok {
+			return false
+		}
+		targets, links = g.Args, []string{p}
+	} else {
+		var ok bool
+		targets, links, ok = c.targets(g.Args, noDeref)
+		if !ok {
+			return false
+		}
+	}
+
+	for i, target := range targets {
+		if target == "" {
+			return false
+		}
+		existing := c.get(links[i])
+		if !existing.Deletion() && (!force || existing.IsDir()) {
+			return false
+		}
+		link := &attr.FileAttr{
+			Path: links[i],
+			Link: target,
+			Attr: c.newAttr(syscall.S_IFLNK | 0777),
+		}
+		link.Size = uint64(len(target))
+		if !c.change(link) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fileCommand) chmod(args []string) bool {
+	g := Getopt(args, nil, nil, true)
+	if g.HasOptions() || len(g.Args) < 2 {
+		return false
+	}
+
+	spec := g.Args[0]
+	for _, arg := range g.Args[1:] {
+		p, ok := c.path(arg)
+		if !ok {
+			return false
+		}
+		a := c.get(p)
+		if a.Deletion() || a.IsSymlink() || (a.IsRegular() && a.Hash == "") {
+			return false
+		}
+		mode, ok := chmodMode(spec, a.Mode&07777, a.IsDir())
+		if !ok {
+			return false
+		}
+		a = copyFileAttr(a)
+		a.Mode = (a.Mode &^ 07777) | mode
+		a.SetTimes(nil, nil, &c.now)
+		c.update(a)
+	}
+	return true
+}
+
+// chmodMode computes the new permission bits for a chmod mode
+// argument, either octal or symbolic (eg. "u+x,go-w"). It returns
+// false for forms we don't handle, such as "g=u".
+func chmodMode(spec string, mode uint32, isDir bool) (uint32, bool) {
+	if spec == "" {
+		return 0, false
+	}
+	if spec[0] >= '0' && spec[0] <= '7' {
+		m, err := strconv.ParseUint(spec, 8, 32)
+		// chmod keeps the set-id bits of directories for
+		// short octal modes; leave that to the real thing.
+		if err != nil || m > 07777 || (isDir && mode&06000 != 0) {
+			return 0, false
+		}
+		return uint32(m), true
+	}
+
+	for _, clause := range strings.Split(spec, ",") {
+		var who uint32
+		i := 0
+	whoLoop:
+		for ; i < len(clause); i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 04700
+			case 'g':
+				who |= 02070
+			case 'o':
+				who |= 01007
+			case 'a':
+				who |= 07777
+			default:
+				break whoLoop
+			}
+		}
+		mask := who
+		if who == 0 {
+			mask = 07777 &^ umask
+		}
+		if i == len(clause) {
+			return 0, false
+		}
+
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return 0, false
+			}
+			i++
+			var perm uint32
+			for ; i < len(clause) && strings.IndexByte("+-=", clause[i]) < 0; i++ {
+				switch clause[i] {
+				case 'r':
+					perm |= 0444
+				case 'w':
+					perm |= 0222
+				case 'x':
+					perm |= 0111
+				case 'X':
+					if isDir || mode&0111 != 0 {
+						perm |= 0111
+					}
+				case 's':
+					perm |= 06000
+				case 't':
+					perm |= 01000
+				default:
+					return 0, false
+				}
+			}
+			perm &= mask
+			switch op {
+			case '+':
+				mode |= perm
+			case '-':
+				mode &^= perm
+			case '=':
+				mode = (mode &^ mask) | perm
+			}
+		}
+	}
+	return mode, true
+}
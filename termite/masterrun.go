@@ -22,7 +22,8 @@ func (m *Master) MaybeRunInMaster(req *WorkRequest, rep *WorkResponse) bool {
 		return mkdirMaybeMasterRun(m, req, rep)
 	case "rm":
 		return rmMaybeMasterRun(m, req, rep)
-		// TODO - implement mv ?
+	case "mv", "cp", "touch", "ln", "chmod":
+		return m.maybeRunFileCommand(binary, req, rep)
 	}
 	return false
 }
@@ -225,3 +225,165 @@ func TestEndToEndRmParentTimestamp(t *testing.T) {
 			beforeTime, afterTime)
 	}
 }
+
+func TestEndToEndMv(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	ioutil.WriteFile(tc.wd+"/file.txt.tmp", []byte("hello"), 0644)
+	os.Mkdir(tc.wd+"/dir", 0755)
+	tc.refresh()
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"mv", "-f", "file.txt.tmp", "file.txt"},
+	})
+	if content, err := ioutil.ReadFile(tc.wd + "/file.txt"); err != nil || string(content) != "hello" {
+		t.Errorf("mv: got %q, %v", content, err)
+	}
+	if fi, _ := os.Lstat(tc.wd + "/file.txt.tmp"); fi != nil {
+		t.Errorf("mv should remove the source: %v", fi)
+	}
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"mv", "file.txt", "dir"},
+	})
+	fa := tc.master.attributes.Get(strings.TrimLeft(tc.wd+"/dir/file.txt", "/"))
+	if fa.Deletion() || !fa.IsRegular() {
+		t.Errorf("attribute cache out of sync: %v", fa)
+	}
+}
+
+func TestEndToEndCp(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	ioutil.WriteFile(tc.wd+"/file.txt", []byte("hello"), 0755)
+	tc.refresh()
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"cp", "file.txt", "copy.txt"},
+	})
+	fi, err := os.Lstat(tc.wd + "/copy.txt")
+	if err != nil || fi.Mode()&0100 == 0 {
+		t.Fatalf("cp should keep the mode: %v, %v", fi, err)
+	}
+	if content, _ := ioutil.ReadFile(tc.wd + "/copy.txt"); string(content) != "hello" {
+		t.Errorf("cp: got %q", content)
+	}
+	if _, err := os.Lstat(tc.wd + "/file.txt"); err != nil {
+		t.Errorf("cp should keep the source: %v", err)
+	}
+
+	tc.RunFail(WorkRequest{
+		Argv: []string{"cp", "noexist", "copy.txt"},
+	})
+}
+
+func TestEndToEndTouch(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"touch", "stamp"},
+	})
+	fi, err := os.Lstat(tc.wd + "/stamp")
+	if err != nil || fi.Size() != 0 {
+		t.Fatalf("touch should create an empty file: %v %v", fi, err)
+	}
+
+	then := time.Now().Add(-time.Hour)
+	os.Chtimes(tc.wd+"/stamp", then, then)
+	tc.refresh()
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"touch", "stamp"},
+	})
+	fa := tc.master.attributes.Get(strings.TrimLeft(tc.wd+"/stamp", "/"))
+	if !fa.ModTime().After(then) {
+		t.Errorf("touch should update the time: %v", fa.ModTime())
+	}
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"touch", "-c", "noexist"},
+	})
+	if fi, _ := os.Lstat(tc.wd + "/noexist"); fi != nil {
+		t.Errorf("touch -c should not create files: %v", fi)
+	}
+}
+
+func TestEndToEndLn(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"ln", "-s", "target", "link"},
+	})
+	if l, err := os.Readlink(tc.wd + "/link"); err != nil || l != "target" {
+		t.Errorf("ln -s: got %q, %v", l, err)
+	}
+	tc.RunFail(WorkRequest{
+		Argv: []string{"ln", "-s", "other", "link"},
+	})
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"ln", "-sf", "other", "link"},
+	})
+	if l, _ := os.Readlink(tc.wd + "/link"); l != "other" {
+		t.Errorf("ln -sf: got %q", l)
+	}
+	fa := tc.master.attributes.Get(strings.TrimLeft(tc.wd+"/link", "/"))
+	if !fa.IsSymlink() || fa.Link != "other" {
+		t.Errorf("attribute cache out of sync: %v", fa)
+	}
+}
+
+func TestEndToEndChmod(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	ioutil.WriteFile(tc.wd+"/script", []byte("#!/bin/sh\n"), 0644)
+	tc.refresh()
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"chmod", "+x", "script"},
+	})
+	if fi, _ := os.Lstat(tc.wd + "/script"); fi == nil || fi.Mode()&0111 != 0111 {
+		t.Errorf("chmod +x: got %v", fi)
+	}
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"chmod", "600", "script"},
+	})
+	fa := tc.master.attributes.Get(strings.TrimLeft(tc.wd+"/script", "/"))
+	if fa.Mode&07777 != 0600 {
+		t.Errorf("chmod 600: got %o", fa.Mode)
+	}
+}
+
+func TestChmodMode(t *testing.T) {
+	oldUmask := umask
+	umask = 022
+	defer func() { umask = oldUmask }()
+
+	for _, c := range []struct {
+		spec  string
+		mode  uint32
+		isDir bool
+		want  uint32
+		ok    bool
+	}{
+		{"755", 0644, false, 0755, true},
+		{"+x", 0644, false, 0755, true},
+		{"+w", 0444, false, 0644, true},
+		{"u+x,go-r", 0644, false, 0700, true},
+		{"a=r", 0755, false, 0444, true},
+		{"g+s", 0755, false, 02755, true},
+		{"a+X", 0644, true, 0755, true},
+		{"a+X", 0644, false, 0644, true},
+		{"o=u", 0644, false, 0, false},
+		{"u", 0644, false, 0, false},
+		{"99", 0644, false, 0, false},
+	} {
+		got, ok := chmodMode(c.spec, c.mode, c.isDir)
+		if ok != c.ok || (ok && got != c.want) {
+			t.Errorf("chmodMode(%q, %o): got %o, %v, want %o, %v", c.spec, c.mode, got, ok, c.want, c.ok)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package termite
 
 import (
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"strings"
+	"time"
 
 	"github.com/hanwen/termite/cba"
 )
@@ -62,11 +65,84 @@ func (m *Master) statusHandler(w http.ResponseWriter, req *http.Request) {
 
 	m.writeThroughput(w)
 
+	m.mirrors.Mutex.Lock()
 	fmt.Fprintf(w, "<p>Master parallelism (--jobs): %d. Reserved job slots: %d",
 		m.mirrors.wantedMaxJobs, m.mirrors.maxJobs())
+	if q := m.mirrors.quarantinedWorkers(); len(q) > 0 {
+		fmt.Fprintf(w, "<p>Quarantined workers: %s", strings.Join(q, ", "))
+	}
+	m.mirrors.Mutex.Unlock()
+	if m.jobServer != nil {
+		fmt.Fprintf(w, "<p>Jobserver tokens: %d", m.jobServer.tokenCount())
+	}
+
+	m.writeSessions(w)
+	m.writeNondeterminism(w)
+	m.writeHermeticity(w)
 	fmt.Fprintf(w, "</body></html>")
 }
 
+func (m *Master) writeSessions(w http.ResponseWriter) {
+	sessions := m.sessions.status()
+	if len(sessions) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "<h2>Build sessions</h2><table><tr><th>Session<th>Started<th>Running<th>Waiting<th>Done<th>Failed<th>Jobs<th>Analysis</tr>")
+	for _, s := range sessions {
+		id := s.Id
+		if id == "" {
+			id = "(default)"
+		}
+		if s.Cancelled {
+			id += " (cancelled)"
+		}
+		jobs := "-"
+		if s.MaxJobs > 0 {
+			jobs = fmt.Sprintf("%d", s.MaxJobs)
+		}
+		fmt.Fprintf(w, "<tr><td>%s<td>%s<td>%d<td>%d<td>%d<td>%d<td>%s<td>%s</tr>",
+			html.EscapeString(id), s.Start.Format(time.RFC3339),
+			s.Running, s.Waiting, s.Done, s.Failed, jobs, html.EscapeString(s.AnalysisDir))
+	}
+	fmt.Fprintf(w, "</table>")
+}
+
+func (m *Master) writeNondeterminism(w http.ResponseWriter) {
+	reports := m.nondeterminismReports()
+	if len(reports) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "<h2>Nondeterministic commands</h2><ul>")
+	for _, r := range reports {
+		fmt.Fprintf(w, "<li>%s in %s (%s, workers %s)<ul>",
+			html.EscapeString(r.Command), html.EscapeString(r.Dir),
+			r.Time.Format(time.RFC3339), html.EscapeString(strings.Join(r.Workers, ", ")))
+		for _, d := range r.Diffs {
+			fmt.Fprintf(w, "<li>%s", html.EscapeString(d))
+		}
+		fmt.Fprintf(w, "</ul>")
+	}
+	fmt.Fprintf(w, "</ul>")
+}
+
+func (m *Master) writeHermeticity(w http.ResponseWriter) {
+	reports := m.hermeticityReports()
+	if len(reports) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "<h2>Undeclared reads</h2><ul>")
+	for _, r := range reports {
+		fmt.Fprintf(w, "<li>%s in %s (%s, worker %s)<ul>",
+			html.EscapeString(r.Command), html.EscapeString(r.Dir),
+			r.Time.Format(time.RFC3339), html.EscapeString(r.Worker))
+		for _, f := range r.Reads {
+			fmt.Fprintf(w, "<li>%s", html.EscapeString(f))
+		}
+		fmt.Fprintf(w, "</ul>")
+	}
+	fmt.Fprintf(w, "</ul>")
+}
+
 func (m *Master) writeThroughput(w http.ResponseWriter) {
 	throughput := m.contentStore.ThroughputStats()
 
@@ -90,6 +166,14 @@ func (m *Master) ServeHTTP(port int) {
 		func(w http.ResponseWriter, req *http.Request) {
 			m.statusHandler(w, req)
 		})
+	http.HandleFunc(jsonApiPrefix+"status",
+		func(w http.ResponseWriter, req *http.Request) {
+			m.jsonStatusHandler(w, req)
+		})
+	http.HandleFunc("/metrics",
+		func(w http.ResponseWriter, req *http.Request) {
+			m.metricsHandler(w, req)
+		})
 	addr := fmt.Sprintf(":%d", port)
 	log.Println("HTTP status on", addr)
 	err := http.ListenAndServe(addr, nil)
@@ -0,0 +1,98 @@
+package termite
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hanwen/termite/stats"
+)
+
+func writeContentMetrics(w *stats.MetricsWriter, prefix string, received, served uint64) {
+	w.Counter(prefix+"_content_bytes_total", "Content bytes transferred.",
+		float64(received), "direction", "received")
+	w.Counter(prefix+"_content_bytes_total", "", float64(served), "direction", "served")
+}
+
+func (m *Master) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", stats.MetricsContentType)
+	mw := stats.NewMetricsWriter(w)
+
+	m.mirrors.Mutex.Lock()
+	mirrorCount := len(m.mirrors.mirrors)
+	workerCount := len(m.mirrors.workers)
+	maxJobs := m.mirrors.maxJobs()
+	available := m.mirrors.availableJobs()
+	phases := m.mirrors.stats
+	m.mirrors.Mutex.Unlock()
+
+	phases.WriteMetrics(mw, "termite_master")
+	m.timing.WriteMetrics(mw, "termite_master")
+
+	received, served := m.contentStore.TotalThroughput()
+	writeContentMetrics(mw, "termite_master", received, served)
+	mw.Gauge("termite_master_attribute_cache_entries", "Entries in the attribute cache.",
+		float64(m.attributes.Len()))
+	mw.Gauge("termite_master_mirrors", "Connected mirrors.", float64(mirrorCount))
+	mw.Gauge("termite_master_known_workers", "Workers announced by the coordinator.",
+		float64(workerCount))
+	mw.Gauge("termite_master_jobs", "Job slots.", float64(m.mirrors.wantedMaxJobs), "state", "wanted")
+	mw.Gauge("termite_master_jobs", "", float64(maxJobs), "state", "reserved")
+	mw.Gauge("termite_master_jobs", "", float64(available), "state", "available")
+	stats.WriteMemMetrics(mw, "termite_master")
+}
+
+func serveMetrics(worker *Worker, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", stats.MetricsContentType)
+	mw := stats.NewMetricsWriter(w)
+
+	worker.stats.WriteMetrics(mw, "termite_worker")
+	worker.contentTimings.WriteMetrics(mw, "termite_worker")
+
+	received, served := worker.content.TotalThroughput()
+	writeContentMetrics(mw, "termite_worker", received, served)
+
+	mirrors := worker.mirrors.mirrors()
+	granted, running, waiting, entries := 0, 0, 0, 0
+	for _, m := range mirrors {
+		m.fsMutex.Lock()
+		granted += m.maxJobCount
+		running += m.runningCount()
+		waiting += m.waiting
+		m.fsMutex.Unlock()
+		entries += m.rpcFs.attr.Len()
+	}
+
+	accepting := 0.0
+	if a, _ := worker.state(); a {
+		accepting = 1.0
+	}
+	mw.Gauge("termite_worker_accepting", "Whether the worker accepts new mirrors.", accepting)
+	mw.Gauge("termite_worker_mirrors", "Active mirrors.", float64(len(mirrors)))
+	mw.Gauge("termite_worker_jobs", "Job slots.", float64(worker.options.Jobs), "state", "max")
+	mw.Gauge("termite_worker_jobs", "", float64(granted), "state", "granted")
+	mw.Gauge("termite_worker_jobs", "", float64(running), "state", "running")
+	mw.Gauge("termite_worker_jobs", "", float64(waiting), "state", "waiting")
+	mw.Gauge("termite_worker_attribute_cache_entries", "Entries in the attribute caches of all mirrors.",
+		float64(entries))
+	stats.WriteMemMetrics(mw, "termite_worker")
+}
+
+func (c *Coordinator) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", stats.MetricsContentType)
+	mw := stats.NewMetricsWriter(w)
+
+	c.mutex.Lock()
+	regs := map[string]time.Time{}
+	for k, v := range c.workers {
+		regs[k] = v.LastReported
+	}
+	c.mutex.Unlock()
+
+	mw.Gauge("termite_coordinator_workers", "Registered workers.", float64(len(regs)))
+	for addr, t := range regs {
+		mw.Gauge("termite_coordinator_worker_last_report_timestamp_seconds",
+			"Time of the last registration of the worker.",
+			float64(t.UnixNano())/1e9, "worker", addr)
+	}
+	stats.WriteMemMetrics(mw, "termite_coordinator")
+}
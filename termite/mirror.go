@@ -26,6 +26,9 @@ type Mirror struct {
 
 	maxJobCount int
 
+	// The worker's mount policy, extended by the master.
+	mountPolicy *MountPolicy
+
 	fsMutex    sync.Mutex
 	cond       *sync.Cond
 	waiting    int
@@ -141,7 +144,8 @@ func (m *Mirror) newFs(t *WorkerTask) (fs *workerFSState, err error) {
 	}
 
 	for fs := range m.activeFses {
-		if !fs.reaping && len(fs.taskIds) < m.worker.options.ReapCount {
+		if !t.req.Isolate && !fs.reaping && !fs.isolated &&
+			len(fs.taskIds) < m.worker.options.ReapCount {
 			fs.addTask(t)
 			return fs, nil
 		}
@@ -153,6 +157,7 @@ func (m *Mirror) newFs(t *WorkerTask) (fs *workerFSState, err error) {
 	}
 
 	m.prepareFS(wfs.state)
+	wfs.state.isolated = t.req.Isolate
 	wfs.state.addTask(t)
 	m.activeFses[wfs.state] = true
 	return wfs.state, nil
@@ -161,6 +166,7 @@ func (m *Mirror) newFs(t *WorkerTask) (fs *workerFSState, err error) {
 // Must hold lock.
 func (m *Mirror) prepareFS(fs *workerFSState) {
 	fs.reaping = false
+	fs.isolated = false
 	fs.taskIds = make([]int, 0, m.worker.options.ReapCount)
 }
 
@@ -175,13 +181,13 @@ func (m *Mirror) considerReap(fs *workerFSState, task *WorkerTask) bool {
 	return fs.reaping
 }
 
-func (m *Mirror) reapFuse(state *workerFSState) (results *attr.FileSet, taskIds []int, reads []string) {
+func (m *Mirror) reapFuse(state *workerFSState) (results *attr.FileSet, taskIds []int, reads []string, externalReads []string) {
 	log.Printf("Reaping fuse FS %v", state.fs.id)
 
 	ids := state.taskIds[:]
-	results, reads = m.fillReply(state)
+	results, reads, externalReads = m.fillReply(state)
 
-	return results, ids, reads
+	return results, ids, reads, externalReads
 }
 
 func (m *Mirror) returnFS(state *workerFSState) {
@@ -218,6 +224,10 @@ func (m *Mirror) updateFiles(attrs []*attr.FileAttr) {
 func (m *Mirror) Run(req *WorkRequest, rep *WorkResponse) error {
 	m.worker.stats.Enter("run")
 
+	m.worker.stats.Enter("prefetch")
+	m.prefetch(req.Prefetch)
+	m.worker.stats.Exit("prefetch")
+
 	// Don't run m.updateFiles() as we don't want to issue
 	// unneeded cache invalidations.
 	task, err := m.newWorkerTask(req, rep)
@@ -233,6 +243,7 @@ func (m *Mirror) Run(req *WorkRequest, rep *WorkResponse) error {
 
 	log.Println(rep)
 	rep.WorkerId = fmt.Sprintf("%s: %s", Hostname, m.worker.listener.Addr().String())
+	_, rep.Draining = m.worker.state()
 	m.worker.stats.Exit("run")
 
 	if m.killed {
@@ -241,6 +252,27 @@ func (m *Mirror) Run(req *WorkRequest, rep *WorkResponse) error {
 	return nil
 }
 
+// Cancel kills running tasks.
+func (m *Mirror) Cancel(req *CancelRequest, rep *CancelResponse) error {
+	ids := map[int]bool{}
+	for _, id := range req.TaskIds {
+		ids[id] = true
+	}
+
+	m.fsMutex.Lock()
+	defer m.fsMutex.Unlock()
+	for fs := range m.activeFses {
+		for t := range fs.tasks {
+			if ids[t.req.TaskId] {
+				log.Printf("Cancelling task %d: %v", t.req.TaskId, t.req.Argv)
+				t.Kill()
+				rep.Killed++
+			}
+		}
+	}
+	return nil
+}
+
 const _DELETIONS = "DELETIONS"
 
 func (m *Mirror) newWorkerTask(req *WorkRequest, rep *WorkResponse) (*WorkerTask, error) {
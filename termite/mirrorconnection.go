@@ -7,6 +7,7 @@ import (
 	"log"
 	"math/rand"
 	"net/rpc"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -29,6 +30,10 @@ type mirrorConnection struct {
 	maxJobs       int
 	availableJobs int
 
+	// If set, the worker is draining. We send no new tasks, and
+	// drop the connection once running tasks complete.
+	draining bool
+
 	master        *Master
 	fileSetWaiter *attr.FileSetWaiter
 }
@@ -81,19 +86,33 @@ type mirrorConnections struct {
 
 	stats *stats.ServerStats
 
+	quarantine *quarantine
+
+	// Task outcomes to report to the coordinator.
+	outcomes outcomeCounter
+
 	// Protects all of the below.
 	sync.Mutex
 	workers        map[string]bool
 	mirrors        map[string]*mirrorConnection
 	lastActionTime time.Time
+
+	// Workers we are creating a mirror on, and a condition
+	// signalled when that finishes.
+	connecting map[string]bool
+	connected  *sync.Cond
+
+	// Tasks in pick that found no free job slot, while they
+	// connect to workers or wait for others to.
+	waiting int
 }
 
-func (c *mirrorConnections) fetchWorkers(last *time.Time) (newMap map[string]bool, err error) {
+func (c *mirrorConnections) fetchWorkers(last *time.Time) (newMap map[string]bool, draining []string, err error) {
 	newMap = map[string]bool{}
 	client, err := rpc.DialHTTP("tcp", c.coordinator)
 	if err != nil {
 		log.Println("fetchWorkers: dialing coordinator:", err)
-		return nil, err
+		return nil, nil, err
 	}
 	defer client.Close()
 	req := ListRequest{Latest: *last}
@@ -101,10 +120,17 @@ func (c *mirrorConnections) fetchWorkers(last *time.Time) (newMap map[string]boo
 	err = client.Call("Coordinator.List", &req, &rep)
 	if err != nil {
 		log.Println("coordinator rpc error:", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	for _, v := range rep.Registrations {
+		if v.Quarantined {
+			continue
+		}
+		if v.Draining {
+			draining = append(draining, v.Address)
+			continue
+		}
 		newMap[v.Address] = true
 	}
 	if len(newMap) == 0 {
@@ -112,13 +138,13 @@ func (c *mirrorConnections) fetchWorkers(last *time.Time) (newMap map[string]boo
 	}
 	*last = rep.LastChange
 
-	return newMap, nil
+	return newMap, draining, nil
 }
 
 func (c *mirrorConnections) refreshWorkers() {
 	last := time.Unix(0, 0)
 	for {
-		newWorkers, err := c.fetchWorkers(&last)
+		newWorkers, draining, err := c.fetchWorkers(&last)
 		if err != nil {
 			time.Sleep(10 * time.Second)
 			continue
@@ -126,26 +152,76 @@ func (c *mirrorConnections) refreshWorkers() {
 		//log.Printf("Got %d workers %v", len(newWorkers), last)
 		c.Mutex.Lock()
 		c.workers = newWorkers
+		for _, addr := range draining {
+			if mc := c.mirrors[addr]; mc != nil {
+				c.setDraining(mc)
+			}
+		}
 		c.Mutex.Unlock()
 	}
 }
 
+// How often to tell the coordinator about our demand for workers.
+const demandReportInterval = 10 * time.Second
+
+func (c *mirrorConnections) demandReport() *DemandReport {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	rep := &DemandReport{
+		Master:      fmt.Sprintf("%s:%s", Hostname, c.master.options.WritableRoot),
+		WantedJobs:  c.wantedMaxJobs,
+		GrantedJobs: c.maxJobs(),
+	}
+	// Besides the tasks blocked in pick, tasks sent to a mirror
+	// beyond its job slots wait on the worker.
+	rep.WaitingTasks = c.waiting
+	for addr, mc := range c.mirrors {
+		rep.Workers = append(rep.Workers, addr)
+		if mc.availableJobs < 0 {
+			rep.WaitingTasks -= mc.availableJobs
+		}
+	}
+	rep.Outcomes = c.outcomes.take()
+	return rep
+}
+
+// reportDemand periodically sends our demand to the coordinator, for
+// sizing the worker pool.
+func (c *mirrorConnections) reportDemand() {
+	for {
+		time.Sleep(demandReportInterval)
+		client, err := rpc.DialHTTP("tcp", c.coordinator)
+		if err != nil {
+			continue
+		}
+		err = client.Call("Coordinator.ReportDemand", c.demandReport(), &Empty{})
+		client.Close()
+		if err != nil {
+			log.Println("Coordinator.ReportDemand:", err)
+		}
+	}
+}
+
 func newMirrorConnections(m *Master, coordinator string, maxJobs int) *mirrorConnections {
 	c := &mirrorConnections{
 		master:        m,
+		quarantine:    newQuarantine(m.options.Quarantine),
 		wantedMaxJobs: maxJobs,
 		workers:       make(map[string]bool),
 		mirrors:       make(map[string]*mirrorConnection),
+		connecting:    make(map[string]bool),
 		coordinator:   coordinator,
 		keepAlive:     time.Minute,
 	}
+	c.connected = sync.NewCond(&c.Mutex)
 	c.refreshStats()
 	return c
 }
 
 func (c *mirrorConnections) refreshStats() {
 	c.stats = stats.NewServerStats()
-	c.stats.PhaseOrder = []string{"run", "send", "remote", "filewait"}
+	c.stats.PhaseOrder = []string{"run", "send", "verify", "remote", "filewait"}
 }
 
 func (c *mirrorConnections) periodicHouseholding() {
@@ -156,7 +232,7 @@ func (c *mirrorConnections) periodicHouseholding() {
 func (c *mirrorConnections) availableJobs() int {
 	a := 0
 	for _, mc := range c.mirrors {
-		if mc.availableJobs > 0 {
+		if mc.availableJobs > 0 && !mc.draining {
 			a += mc.availableJobs
 		}
 	}
@@ -167,6 +243,9 @@ func (c *mirrorConnections) availableJobs() int {
 func (c *mirrorConnections) maxJobs() int {
 	a := 0
 	for _, mc := range c.mirrors {
+		if mc.draining {
+			continue
+		}
 		a += mc.maxJobs
 	}
 	return a
@@ -181,9 +260,11 @@ func (c *mirrorConnections) maybeDropConnections() {
 		return
 	}
 
-	// Something is running.
-	if c.availableJobs() < c.maxJobs() {
-		return
+	// Something is running, maybe on a draining mirror.
+	for _, mc := range c.mirrors {
+		if mc.availableJobs < mc.maxJobs {
+			return
+		}
 	}
 
 	if c.lastActionTime.Add(c.keepAlive).After(time.Now()) {
@@ -225,13 +306,21 @@ func (c *mirrorConnections) find(name string) (*mirrorConnection, error) {
 	return found, nil
 }
 
-func (c *mirrorConnections) pick() (*mirrorConnection, error) {
+// pick returns a mirror for a task, preferably one whose worker is
+// not in avoid.
+func (c *mirrorConnections) pick(avoid map[string]bool) (*mirrorConnection, error) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
 
 	if c.availableJobs() <= 0 {
+		c.waiting++
 		c.tryConnect()
 
+		// Another task may be connecting to the workers.
+		for c.maxJobs() == 0 && len(c.connecting) > 0 {
+			c.connected.Wait()
+		}
+		c.waiting--
 		if c.maxJobs() == 0 {
 			// Didn't connect to anything.  Should
 			// probably direct the wrapper to compile
@@ -240,12 +329,28 @@ func (c *mirrorConnections) pick() (*mirrorConnection, error) {
 		}
 	}
 
+	mc := c.choose(avoid)
+	if mc == nil && len(avoid) > 0 {
+		mc = c.choose(nil)
+	}
+	if mc == nil {
+		return nil, errors.New("No workers available.")
+	}
+	mc.availableJobs--
+	return mc, nil
+}
+
+// choose returns the mirror with the most free job slots, skipping
+// workers in avoid.  Must be called with lock held.
+func (c *mirrorConnections) choose(avoid map[string]bool) *mirrorConnection {
 	maxAvail := -1e9
 	var maxAvailMirror *mirrorConnection
 	for _, v := range c.mirrors {
+		if v.draining || avoid[v.workerAddr] {
+			continue
+		}
 		if v.availableJobs > 0 {
-			v.availableJobs--
-			return v, nil
+			return v
 		}
 		l := float64(v.availableJobs) / float64(v.maxJobs)
 		if l > maxAvail {
@@ -253,9 +358,23 @@ func (c *mirrorConnections) pick() (*mirrorConnection, error) {
 			maxAvail = l
 		}
 	}
+	return maxAvailMirror
+}
 
-	maxAvailMirror.availableJobs--
-	return maxAvailMirror, nil
+// pickOther returns a mirror with a free job slot other than
+// exclude, without connecting to new workers.
+func (c *mirrorConnections) pickOther(exclude *mirrorConnection) (*mirrorConnection, error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	for _, v := range c.mirrors {
+		if v == exclude || v.draining || v.availableJobs <= 0 {
+			continue
+		}
+		v.availableJobs--
+		return v, nil
+	}
+	return nil, errors.New("no other worker available")
 }
 
 func (c *mirrorConnections) drop(mc *mirrorConnection, err error) {
@@ -264,6 +383,11 @@ func (c *mirrorConnections) drop(mc *mirrorConnection, err error) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
 	log.Printf("Dropping mirror %s. Reason: %s", mc.workerAddr, err)
+	c.closeMirror(mc)
+}
+
+// Must be called with lock held.
+func (c *mirrorConnections) closeMirror(mc *mirrorConnection) {
 	mc.rpcClient.Close()
 	mc.contentClient.Close()
 	mc.reverseConnection.Close()
@@ -272,19 +396,74 @@ func (c *mirrorConnections) drop(mc *mirrorConnection, err error) {
 	delete(c.workers, mc.workerAddr)
 }
 
+// setDraining stops sending tasks to the mirror, and drops it once it
+// is idle.  Must be called with lock held.
+func (c *mirrorConnections) setDraining(mc *mirrorConnection) {
+	if !mc.draining {
+		log.Printf("Worker %s is draining", mc.workerAddr)
+		mc.draining = true
+	}
+	c.maybeDropDrained(mc)
+}
+
+// Must be called with lock held.
+func (c *mirrorConnections) maybeDropDrained(mc *mirrorConnection) {
+	if mc.draining && mc.availableJobs >= mc.maxJobs && c.mirrors[mc.workerAddr] == mc {
+		log.Printf("Dropping drained mirror %s", mc.workerAddr)
+		c.master.attributes.RmClient(mc)
+		c.closeMirror(mc)
+	}
+}
+
+func (c *mirrorConnections) drain(mc *mirrorConnection) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.setDraining(mc)
+}
+
 func (c *mirrorConnections) jobDone(mc *mirrorConnection) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
 
 	c.lastActionTime = time.Now()
 	mc.availableJobs++
+	c.maybeDropDrained(mc)
+}
+
+// recordOutcome tracks task results per worker. If a worker fails
+// too often, it is quarantined: we stop sending it tasks, and won't
+// reconnect to it until the quarantine ends.
+func (c *mirrorConnections) recordOutcome(mc *mirrorConnection, failed bool) {
+	c.outcomes.add(mc.workerAddr, failed)
+	nfail := 0
+	if failed {
+		nfail = 1
+	}
+	if c.quarantine.record(mc.workerAddr, 1, nfail, time.Now()) {
+		log.Printf("Quarantining worker %s: too many failures", mc.workerAddr)
+		c.drain(mc)
+	}
+}
+
+// Must be called with lock held.
+func (c *mirrorConnections) quarantinedWorkers() []string {
+	var r []string
+	for addr := range c.quarantine.quarantined(time.Now()) {
+		r = append(r, addr)
+	}
+	sort.Strings(r)
+	return r
 }
 
 func (c *mirrorConnections) idleWorkerAddress() string {
 	cands := []string{}
+	now := time.Now()
 	for addr := range c.workers {
 		_, ok := c.mirrors[addr]
-		if ok {
+		if ok || c.connecting[addr] {
+			continue
+		}
+		if c.quarantine.isQuarantined(addr, now) {
 			continue
 		}
 		cands = append(cands, addr)
@@ -310,10 +489,13 @@ func (c *mirrorConnections) tryConnect() {
 		if addr == "" {
 			break
 		}
+		c.connecting[addr] = true
 		c.Mutex.Unlock()
 		log.Printf("Creating mirror on %v, requesting %d jobs", addr, wanted)
 		mc, err := c.master.createMirror(addr, wanted)
 		c.Mutex.Lock()
+		delete(c.connecting, addr)
+		c.connected.Broadcast()
 		if err != nil {
 			delete(c.workers, addr)
 			log.Println("nonfatal error creating mirror:", err)
@@ -26,7 +26,7 @@ func NewWorkerMirrors(w *Worker) *WorkerMirrors {
 	return wm
 }
 
-func (wm *WorkerMirrors) getMirror(rpcConn, revConn, contentConn, revContentConn io.ReadWriteCloser, reserveCount int, writableRoot string) (*Mirror, error) {
+func (wm *WorkerMirrors) getMirror(rpcConn, revConn, contentConn, revContentConn io.ReadWriteCloser, reserveCount int, writableRoot string, policy *MountPolicy) (*Mirror, error) {
 	if reserveCount <= 0 {
 		return nil, errors.New("must ask positive jobcount")
 	}
@@ -55,6 +55,7 @@ func (wm *WorkerMirrors) getMirror(rpcConn, revConn, contentConn, revContentConn
 	}
 
 	mirror.maxJobCount = reserveCount
+	mirror.mountPolicy = policy
 
 	key := fmt.Sprintf("todo%d", rand.Int63n(1<<60))
 	wm.mirrorMap[key] = mirror
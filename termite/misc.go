@@ -24,6 +24,12 @@ func SplitPath(name string) (dir, base string) {
 	return dir, base
 }
 
+// under returns true if name is dir, or inside dir.
+func under(name string, dir string) bool {
+	dir = strings.TrimRight(dir, "/")
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
 func RandomBytes(n int) []byte {
 	c := make([]byte, 0)
 	for i := 0; i < n; i++ {
@@ -191,6 +197,27 @@ func ParseCommand(cmd string) []string {
 	return result
 }
 
+// ShellQuote joins argv into a shell command line that ParseCommand
+// parses back into argv.
+func ShellQuote(argv []string) string {
+	var words []string
+	for _, a := range argv {
+		plain := a != ""
+		for _, c := range []byte(a) {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+				strings.IndexByte("-_./=+,:@%^", c) >= 0) {
+				plain = false
+				break
+			}
+		}
+		if !plain {
+			a = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+		words = append(words, a)
+	}
+	return strings.Join(words, " ")
+}
+
 func HasDirPrefix(path, prefix string) bool {
 	prefix = strings.TrimRight(prefix, string(filepath.Separator))
 	path = strings.TrimRight(path, string(filepath.Separator))
@@ -2,6 +2,7 @@ package termite
 
 import (
 	"log"
+	"strings"
 	"testing"
 )
 
@@ -116,3 +117,16 @@ func TestIntToExponent(t *testing.T) {
 		t.Error("4", e)
 	}
 }
+
+func TestShellQuote(t *testing.T) {
+	for _, argv := range [][]string{
+		{"gcc", "-c", "foo.c", "-DX=1"},
+		{"echo", "a b", "", "it's", "$HOME", "x;y", "a\\b"},
+	} {
+		cmd := ShellQuote(argv)
+		got := ParseCommand(cmd)
+		if strings.Join(got, "|") != strings.Join(argv, "|") || len(got) != len(argv) {
+			t.Errorf("ShellQuote(%q) = %q, parses as %q", argv, cmd, got)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package termite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// MountPolicy describes what the sandbox of a task contains, apart
+// from the file system of the master.  /proc, /sys and an empty /dev
+// are always present.
+type MountPolicy struct {
+	// Device nodes to bind from the worker, eg. "/dev/null".
+	Devices []string
+
+	// Directories of the worker to mount read-only at the same
+	// path, eg. a local ccache.
+	ReadOnly []string
+
+	// Writable scratch directories.
+	Tmpfs []TmpfsMount
+
+	// Top-level entries of the master file system that are not
+	// exposed to tasks.
+	Hide []string
+
+	// Path prefixes on the worker that masters may add to Devices
+	// and ReadOnly.  Only used in the worker's policy.
+	Allow []string
+}
+
+type TmpfsMount struct {
+	// Path inside the sandbox, relative to the root.
+	Path string
+
+	// Size, eg. "64k" or "10%". If empty, use the mkbox default.
+	Size string
+}
+
+// DefaultMountPolicy returns the policy used if the worker does not
+// specify one.
+func DefaultMountPolicy() *MountPolicy {
+	return &MountPolicy{
+		Devices: []string{
+			"/dev/null",
+			"/dev/zero",
+			"/dev/urandom", // maybe should use zero for determinism?
+		},
+		Tmpfs: []TmpfsMount{
+			{Path: "tmp"},
+			{Path: "var/tmp"},
+		},
+		Hide: []string{"tmp", "lost+found", "root"},
+	}
+}
+
+// ReadMountPolicy reads a policy in JSON format.
+func ReadMountPolicy(name string) (*MountPolicy, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p := &MountPolicy{}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+// Top-level entries that the sandbox always sets up itself.
+var sandboxBaseDirs = []string{"proc", "sys", "dev"}
+
+var tmpfsSizeRegexp = regexp.MustCompile("^[0-9]+[kmg%]?$")
+
+// check returns the policy violations of p. If allow is non-nil,
+// host paths must be under one of its prefixes.
+func (p *MountPolicy) check(allow []string) []string {
+	var errs []string
+	allowed := func(path string) bool {
+		if allow == nil {
+			return true
+		}
+		for _, a := range allow {
+			a = filepath.Clean(a)
+			if path == a || strings.HasPrefix(path, a+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	checkHostPath := func(kind, path string) bool {
+		if !filepath.IsAbs(path) || filepath.Clean(path) != path || path == "/" {
+			errs = append(errs, fmt.Sprintf("%s %q: must be a clean absolute path", kind, path))
+			return false
+		}
+		if !allowed(path) {
+			errs = append(errs, fmt.Sprintf("%s %q: not allowed on this worker", kind, path))
+			return false
+		}
+		return true
+	}
+
+	for _, d := range p.Devices {
+		if !checkHostPath("device", d) {
+			continue
+		}
+		if !strings.HasPrefix(d, "/dev/") {
+			errs = append(errs, fmt.Sprintf("device %q: not in /dev", d))
+			continue
+		}
+		fi, err := os.Stat(d)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("device %q: %v", d, err))
+		} else if fi.Mode()&os.ModeDevice == 0 {
+			errs = append(errs, fmt.Sprintf("device %q: not a device", d))
+		}
+	}
+	for _, r := range p.ReadOnly {
+		if !checkHostPath("read-only path", r) {
+			continue
+		}
+		top := strings.Split(r[1:], "/")[0]
+		for _, b := range sandboxBaseDirs {
+			if top == b {
+				errs = append(errs, fmt.Sprintf("read-only path %q: /%s is set up by the sandbox", r, b))
+			}
+		}
+		if fi, err := os.Stat(r); err != nil {
+			errs = append(errs, fmt.Sprintf("read-only path %q: %v", r, err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Sprintf("read-only path %q: not a directory", r))
+		}
+	}
+	for _, t := range p.Tmpfs {
+		if t.Path == "" || filepath.IsAbs(t.Path) || filepath.Clean(t.Path) != t.Path ||
+			strings.HasPrefix(t.Path, "..") {
+			errs = append(errs, fmt.Sprintf("tmpfs %q: must be a clean relative path", t.Path))
+		}
+		if t.Size != "" && !tmpfsSizeRegexp.MatchString(t.Size) {
+			errs = append(errs, fmt.Sprintf("tmpfs %q: invalid size %q", t.Path, t.Size))
+		}
+	}
+	for _, h := range p.Hide {
+		if h == "" || strings.Contains(h, "/") {
+			errs = append(errs, fmt.Sprintf("hide %q: must be a top-level name", h))
+		}
+	}
+	return errs
+}
+
+// extend returns the policy p with the additions of a master. It
+// returns an error listing the violations if the master asks for
+// something the worker does not allow.
+func (p *MountPolicy) extend(extra *MountPolicy) (*MountPolicy, error) {
+	if extra == nil {
+		return p, nil
+	}
+	if len(extra.Allow) > 0 {
+		return nil, fmt.Errorf("mount policy: masters cannot set Allow")
+	}
+	allow := p.Allow
+	if allow == nil {
+		allow = []string{}
+	}
+	if errs := extra.check(allow); len(errs) > 0 {
+		return nil, fmt.Errorf("mount policy: %s", strings.Join(errs, "; "))
+	}
+
+	r := *p
+	r.Devices = append(append([]string{}, p.Devices...), extra.Devices...)
+	r.ReadOnly = append(append([]string{}, p.ReadOnly...), extra.ReadOnly...)
+	r.Tmpfs = append(append([]TmpfsMount{}, p.Tmpfs...), extra.Tmpfs...)
+	r.Hide = append(append([]string{}, p.Hide...), extra.Hide...)
+	return &r, nil
+}
+
+// hidden returns the top-level entries of the master file system that
+// should not be mounted in the sandbox.
+func (p *MountPolicy) hidden() map[string]bool {
+	r := map[string]bool{}
+	for _, b := range sandboxBaseDirs {
+		r[b] = true
+	}
+	for _, h := range p.Hide {
+		r[h] = true
+	}
+	return r
+}
+
+// sandboxArgs builds mkbox arguments for a policy. Paths are relative
+// to the sandbox root.
+type sandboxArgs struct {
+	args []string
+
+	// Directories that exist in the sandbox.
+	dirs map[string]bool
+
+	// Host paths of the mounts. Directories made for the sandbox,
+	// like tmpfs mounts, have "".
+	mounts map[string]string
+}
+
+func newSandboxArgs(existing []string) *sandboxArgs {
+	a := &sandboxArgs{dirs: map[string]bool{}, mounts: map[string]string{}}
+	for _, e := range existing {
+		a.dirs[e] = true
+	}
+	return a
+}
+
+func (a *sandboxArgs) add(args ...string) {
+	a.args = append(a.args, args...)
+}
+
+// mkdirParents creates the parent directories of rel.
+func (a *sandboxArgs) mkdirParents(rel string) {
+	comps := strings.Split(rel, "/")
+	for i := 1; i < len(comps); i++ {
+		d := strings.Join(comps[:i], "/")
+		if !a.dirs[d] {
+			a.add("-D", d)
+			a.dirs[d] = true
+		}
+	}
+}
+
+func (a *sandboxArgs) bind(hostPath string) {
+	a.mkdirParents(hostPath[1:])
+	a.bindAt(hostPath, hostPath[1:], false)
+}
+
+// bindAt mounts hostPath at rel, whose parent must exist.
+func (a *sandboxArgs) bindAt(hostPath, rel string, readOnly bool) {
+	a.add("-b", hostPath+"="+rel)
+	if readOnly {
+		a.add("-r", rel)
+	}
+	a.dirs[rel] = true
+	a.mounts[rel] = hostPath
+}
+
+// source returns the host path that rel shows, or "" if rel is not
+// inside a bind mount, and can be created with -D.
+func (a *sandboxArgs) source(rel string) string {
+	for p := rel; p != "."; p = filepath.Dir(p) {
+		if h, ok := a.mounts[p]; ok {
+			if h == "" {
+				return ""
+			}
+			return filepath.Join(h, rel[len(p):])
+		}
+	}
+	return ""
+}
+
+// readOnly mounts the directory hostPath read-only at the same path,
+// on top of the master's tree. If the master does not have the mount
+// point, its parent is replaced by a tmpfs holding the entries of the
+// master's directory, so the mount point can be made.
+func (a *sandboxArgs) readOnly(hostPath string) error {
+	rel := hostPath[1:]
+	comps := strings.Split(rel, "/")
+	for i := 1; i <= len(comps); i++ {
+		p := strings.Join(comps[:i], "/")
+		src := a.source(p)
+		if src == "" {
+			if i < len(comps) && !a.dirs[p] {
+				a.add("-D", p)
+				a.dirs[p] = true
+			}
+			continue
+		}
+		fi, err := os.Lstat(src)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("read-only path %q: /%s is not a directory in the sandbox", hostPath, p)
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := strings.Join(comps[:i-1], "/")
+		if err := a.replace(parent, a.source(parent)); err != nil {
+			return err
+		}
+		if i < len(comps) {
+			a.add("-D", p)
+			a.dirs[p] = true
+		}
+	}
+	a.bindAt(hostPath, rel, true)
+	return nil
+}
+
+// replace puts a tmpfs on rel, and binds the entries of its host
+// directory src back read-only.
+func (a *sandboxArgs) replace(rel, src string) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	// No size means 16 inodes in mkbox.
+	a.add("-T", "1m", "-t", rel)
+	a.mounts[rel] = ""
+	for _, e := range entries {
+		p := rel + "/" + e.Name()
+		hostPath := filepath.Join(src, e.Name())
+		if e.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+			a.add("-L", target+"="+p)
+			continue
+		}
+		a.bindAt(hostPath, p, true)
+		if !e.IsDir() {
+			delete(a.dirs, p)
+		}
+	}
+	return nil
+}
+
+func (a *sandboxArgs) tmpfs(t TmpfsMount) {
+	a.mkdirParents(t.Path)
+	if t.Size != "" {
+		a.add("-T", t.Size)
+	}
+	a.add("-t", t.Path)
+	a.dirs[t.Path] = true
+	a.mounts[t.Path] = ""
+}
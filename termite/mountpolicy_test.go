@@ -0,0 +1,115 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMountPolicyExtend(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+	worker := DefaultMountPolicy()
+	worker.Allow = []string{dir}
+	if errs := worker.check(nil); len(errs) > 0 {
+		t.Fatalf("default policy: %v", errs)
+	}
+
+	p, err := worker.extend(&MountPolicy{
+		ReadOnly: []string{dir},
+		Tmpfs:    []TmpfsMount{{Path: "scratch", Size: "10m"}},
+	})
+	if err != nil {
+		t.Fatalf("extend: %v", err)
+	}
+	if len(p.ReadOnly) != 1 || len(p.Tmpfs) != 3 || len(worker.Tmpfs) != 2 {
+		t.Errorf("got %v", p)
+	}
+
+	_, err = worker.extend(&MountPolicy{
+		ReadOnly: []string{"/etc"},
+		Devices:  []string{"/dev/null"},
+		Tmpfs:    []TmpfsMount{{Path: "../x", Size: "lots"}},
+	})
+	if err == nil {
+		t.Fatal("extend succeeded for disallowed paths")
+	}
+	for _, want := range []string{`"/etc": not allowed`, `"/dev/null": not allowed`, `"../x": must be`, `invalid size "lots"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestSandboxArgs(t *testing.T) {
+	sb := newSandboxArgs([]string{"usr", "var", "dev"})
+	sb.bind("/dev/null")
+	sb.tmpfs(TmpfsMount{Path: "var/tmp"})
+	sb.tmpfs(TmpfsMount{Path: "opt/cache/scratch", Size: "1m"})
+
+	want := []string{
+		"-b", "/dev/null=dev/null",
+		"-t", "var/tmp",
+		"-D", "opt", "-D", "opt/cache",
+		"-T", "1m", "-t", "opt/cache/scratch",
+	}
+	if !reflect.DeepEqual(sb.args, want) {
+		t.Errorf("got %q, want %q", sb.args, want)
+	}
+
+	p := &MountPolicy{ReadOnly: []string{"/opt/cache"}, Hide: []string{"root"}}
+	h := p.hidden()
+	if h["opt"] || !h["root"] || !h["proc"] || h["usr"] {
+		t.Errorf("hidden: %v", h)
+	}
+}
+
+func TestSandboxArgsReadOnly(t *testing.T) {
+	master, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(master)
+	os.MkdirAll(master+"/usr/lib/bin", 0755)
+	os.MkdirAll(master+"/home", 0755)
+	ioutil.WriteFile(master+"/usr/lib/f", []byte("f"), 0644)
+	os.Symlink("f", master+"/usr/lib/l")
+
+	for _, c := range []struct {
+		path string
+		want []string
+	}{
+		{"/usr/lib", []string{"-b", "/usr/lib=usr/lib", "-r", "usr/lib"}},
+		{"/opt/cache/ccache", []string{
+			"-D", "opt", "-D", "opt/cache",
+			"-b", "/opt/cache/ccache=opt/cache/ccache", "-r", "opt/cache/ccache"}},
+		{"/home/ccache", []string{
+			"-T", "1m", "-t", "home",
+			"-b", "/home/ccache=home/ccache", "-r", "home/ccache"}},
+		{"/usr/lib/x/y", []string{
+			"-T", "1m", "-t", "usr/lib",
+			"-b", master + "/usr/lib/bin=usr/lib/bin", "-r", "usr/lib/bin",
+			"-b", master + "/usr/lib/f=usr/lib/f", "-r", "usr/lib/f",
+			"-L", "f=usr/lib/l",
+			"-D", "usr/lib/x",
+			"-b", "/usr/lib/x/y=usr/lib/x/y", "-r", "usr/lib/x/y"}},
+		{"/usr/lib/l/y", nil},
+	} {
+		sb := newSandboxArgs([]string{"dev"})
+		sb.bindAt(master+"/usr", "usr", true)
+		sb.bindAt(master+"/home", "home", true)
+		sb.args = nil
+
+		err := sb.readOnly(c.path)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %q, want error", c.path, sb.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+		} else if !reflect.DeepEqual(sb.args, c.want) {
+			t.Errorf("%s: got %q, want %q", c.path, sb.args, c.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package termite
+
+import (
+	"strings"
+)
+
+// Error messages that commands commonly print when they can't reach
+// the network.
+var networkErrorMessages = []string{
+	"network is unreachable",
+	"temporary failure in name resolution",
+	"could not resolve host",
+	"name or service not known",
+	"no address associated with hostname",
+	"dial tcp: lookup",
+}
+
+// networkError returns an explanation if stderr suggests that a task
+// failed because it tried to connect out of its network namespace.
+func networkError(stderr string) string {
+	for _, l := range strings.Split(stderr, "\n") {
+		lower := strings.ToLower(l)
+		for _, m := range networkErrorMessages {
+			if strings.Contains(lower, m) {
+				return "termite: task has no network access, and failed trying to connect out: " +
+					strings.TrimSpace(l)
+			}
+		}
+	}
+	return ""
+}
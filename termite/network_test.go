@@ -0,0 +1,18 @@
+package termite
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNetworkError(t *testing.T) {
+	if e := networkError("foo.c:1: error: expected ';'\n"); e != "" {
+		t.Errorf("compile error reported as network error: %q", e)
+	}
+
+	stderr := "Resolving example.com...\ncurl: (6) Could not resolve host: example.com\n"
+	e := networkError(stderr)
+	if !strings.Contains(e, "curl: (6) Could not resolve host: example.com") {
+		t.Errorf("got %q", e)
+	}
+}
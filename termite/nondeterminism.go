@@ -0,0 +1,167 @@
+package termite
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// To find nondeterministic commands, the master runs a sample of the
+// tasks twice: first on a second worker, where the results are
+// discarded, and then as usual. The real run's outputs are only
+// replayed after the check, so both see the same inputs. Both runs
+// get a file system of their own, so their FileSets can be compared.
+
+// How many reports on misbehaving tasks to keep for the status page.
+const maxTaskReports = 100
+
+type nondeterminismReport struct {
+	Time    time.Time
+	Command string
+	Dir     string
+	Workers []string
+	Diffs   []string
+}
+
+// shouldVerify decides whether a request is run twice.
+func (m *Master) shouldVerify(req *WorkRequest) bool {
+	// Stdin can only be consumed once.
+	if req.StdinConn != nil {
+		return false
+	}
+	if re := m.options.VerifyCommands; re != nil && re.MatchString(strings.Join(req.Argv, " ")) {
+		return true
+	}
+	return m.options.VerifyRate > 0 && rand.Float64() < m.options.VerifyRate
+}
+
+// runVerification runs a copy of the request on a worker other than
+// primary. It returns nil if that is not possible.
+func (m *Master) runVerification(primary *mirrorConnection, req *WorkRequest) *WorkResponse {
+	mirror, err := m.mirrors.pickOther(primary)
+	if err != nil {
+		log.Printf("Not verifying %v: %v", req.Argv, err)
+		return nil
+	}
+	defer m.mirrors.jobDone(mirror)
+
+	if err := m.attributes.Send(mirror); err != nil {
+		log.Printf("Not verifying %v: %v", req.Argv, err)
+		return nil
+	}
+
+	check := *req
+	check.TaskId = <-m.taskIds
+	check.Isolate = true
+	rep := &WorkResponse{}
+
+	log.Printf("Verifying task %d on %s: %v", req.TaskId, mirror.workerAddr, req.Argv)
+	m.mirrors.stats.Enter("verify")
+	err = mirror.rpcClient.Call("Mirror.Run", &check, rep)
+	m.mirrors.stats.Exit("verify")
+	if err != nil {
+		log.Printf("Verification of %v failed: %v", req.Argv, err)
+		return nil
+	}
+	if rep.FileSet == nil {
+		log.Printf("Verification of %v returned no files", req.Argv)
+		return nil
+	}
+	return rep
+}
+
+// compareRuns records the differences between the responses of two
+// runs of the same request.
+func (m *Master) compareRuns(req *WorkRequest, rep *WorkResponse, check *WorkResponse) {
+	var diffs []string
+	if rep.Exit != check.Exit {
+		diffs = append(diffs, fmt.Sprintf("exit status: %v vs %v", rep.Exit, check.Exit))
+	}
+	diffs = append(diffs, diffFileSets(rep.FileSet, check.FileSet)...)
+	if len(diffs) == 0 {
+		return
+	}
+
+	log.Printf("Nondeterministic command %v: %s", req.Argv, strings.Join(diffs, "; "))
+	rep.Nondeterminism = diffs
+
+	m.nondeterminismMu.Lock()
+	defer m.nondeterminismMu.Unlock()
+	m.nondeterminism = append(m.nondeterminism, &nondeterminismReport{
+		Time:    time.Now(),
+		Command: strings.Join(req.Argv, " "),
+		Dir:     req.Dir,
+		Workers: []string{rep.WorkerId, check.WorkerId},
+		Diffs:   diffs,
+	})
+	if len(m.nondeterminism) > maxTaskReports {
+		m.nondeterminism = m.nondeterminism[len(m.nondeterminism)-maxTaskReports:]
+	}
+}
+
+// nondeterminismReports returns the recent reports, newest first.
+func (m *Master) nondeterminismReports() []*nondeterminismReport {
+	m.nondeterminismMu.Lock()
+	defer m.nondeterminismMu.Unlock()
+	var result []*nondeterminismReport
+	for i := len(m.nondeterminism) - 1; i >= 0; i-- {
+		result = append(result, m.nondeterminism[i])
+	}
+	return result
+}
+
+// diffFileSets compares the contents, modes and link targets of two
+// FileSets. Ownership and timestamps are ignored.
+func diffFileSets(a, b *attr.FileSet) []string {
+	byPath := func(fset *attr.FileSet) map[string]*attr.FileAttr {
+		result := map[string]*attr.FileAttr{}
+		if fset != nil {
+			for _, f := range fset.Files {
+				result[f.Path] = f
+			}
+		}
+		return result
+	}
+	as, bs := byPath(a), byPath(b)
+
+	var names []string
+	for n := range as {
+		names = append(names, n)
+	}
+	for n := range bs {
+		if as[n] == nil {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []string
+	for _, n := range names {
+		fa, fb := as[n], bs[n]
+		var d string
+		switch {
+		case fb == nil:
+			d = "only changed in first run"
+		case fa == nil:
+			d = "only changed in second run"
+		case fa.Deletion() != fb.Deletion():
+			d = "deleted in one run only"
+		case fa.Deletion():
+		case fa.Mode != fb.Mode:
+			d = fmt.Sprintf("mode %o vs %o", fa.Mode, fb.Mode)
+		case fa.IsRegular() && fa.Hash != fb.Hash:
+			d = fmt.Sprintf("content %x vs %x", fa.Hash, fb.Hash)
+		case fa.IsSymlink() && fa.Link != fb.Link:
+			d = fmt.Sprintf("link %q vs %q", fa.Link, fb.Link)
+		}
+		if d != "" {
+			diffs = append(diffs, fmt.Sprintf("/%s: %s", n, d))
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,95 @@
+package termite
+
+import (
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+)
+
+func TestDiffFileSets(t *testing.T) {
+	file := func(path string, mode uint32, hash string) *attr.FileAttr {
+		return &attr.FileAttr{Path: path, Hash: hash, Attr: &fuse.Attr{Mode: mode}}
+	}
+	link := func(path string, target string) *attr.FileAttr {
+		return &attr.FileAttr{Path: path, Link: target, Attr: &fuse.Attr{Mode: syscall.S_IFLNK | 0777}}
+	}
+
+	then := time.Unix(1e9, 0)
+	same := file("same", syscall.S_IFREG|0644, "h1")
+	sameTimes := file("same", syscall.S_IFREG|0644, "h1")
+	sameTimes.Uid = 42
+	sameTimes.SetTimes(&then, &then, &then)
+
+	a := &attr.FileSet{Files: []*attr.FileAttr{
+		same,
+		file("content", syscall.S_IFREG|0644, "h1"),
+		file("mode", syscall.S_IFREG|0644, "h1"),
+		link("link", "a"),
+		{Path: "deleted"},
+		file("first", syscall.S_IFREG|0644, "h1"),
+	}}
+	b := &attr.FileSet{Files: []*attr.FileAttr{
+		sameTimes,
+		file("content", syscall.S_IFREG|0644, "h2"),
+		file("mode", syscall.S_IFREG|0755, "h1"),
+		link("link", "b"),
+		file("deleted", syscall.S_IFREG|0644, "h1"),
+		file("second", syscall.S_IFREG|0644, "h1"),
+	}}
+
+	diffs := diffFileSets(a, b)
+	got := map[string]bool{}
+	for _, d := range diffs {
+		got[strings.SplitN(d, ":", 2)[0]] = true
+	}
+	for _, n := range []string{"/content", "/mode", "/link", "/deleted", "/first", "/second"} {
+		if !got[n] {
+			t.Errorf("missing difference for %s: %v", n, diffs)
+		}
+	}
+	if got["/same"] || len(diffs) != 6 {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+
+	if diffs := diffFileSets(a, a); len(diffs) != 0 {
+		t.Errorf("differences with itself: %v", diffs)
+	}
+}
+
+func TestEndToEndVerify(t *testing.T) {
+	tc := newJobsTestCase(t, "", 2)
+	defer tc.Clean()
+	tc.StartWorker()
+	for i := 0; tc.coordinator.WorkerCount() < 2; i++ {
+		if i > 50 {
+			t.Fatal("second worker did not register")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	tc.master.options.VerifyCommands = regexp.MustCompile("date")
+
+	rep := tc.RunSuccess(WorkRequest{
+		Argv: []string{"/bin/sh", "-c", "date +%N > output.txt"},
+	})
+	if len(rep.Nondeterminism) == 0 {
+		t.Errorf("differing outputs not reported: %v", rep)
+	}
+
+	// A command that reads its own output sees the same input on
+	// both workers.
+	tc.master.options.VerifyCommands = regexp.MustCompile("log.txt")
+	for i := 0; i < 3; i++ {
+		rep = tc.RunSuccess(WorkRequest{
+			Argv: []string{"/bin/sh", "-c", "(cat log.txt 2>/dev/null; echo x) > new.txt && mv new.txt log.txt"},
+		})
+		if len(rep.Nondeterminism) != 0 {
+			t.Errorf("command reported as nondeterministic: %v", rep.Nondeterminism)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package termite
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Terminal describes the pseudo-terminal that a task runs on.
+type Terminal struct {
+	Rows uint16
+	Cols uint16
+}
+
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// TerminalSize returns the size of the terminal on fd, or nil if fd
+// is not a terminal.
+func TerminalSize(fd uintptr) *Terminal {
+	var ws winsize
+	if err := ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return nil
+	}
+	return &Terminal{Rows: ws.Row, Cols: ws.Col}
+}
+
+// lockedBuffer collects the output of a terminal, which may still
+// be written after the task exited.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// openPty allocates a pseudo-terminal of the given size. It returns
+// the master side, and the terminal for the task.
+func openPty(size *Terminal) (pty *os.File, tty *os.File, err error) {
+	pty, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			pty.Close()
+		}
+	}()
+
+	var unlock int32
+	if err := ioctl(pty.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		return nil, nil, fmt.Errorf("TIOCSPTLCK: %v", err)
+	}
+	var n uint32
+	if err := ioctl(pty.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		return nil, nil, fmt.Errorf("TIOCGPTN: %v", err)
+	}
+	tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ws := winsize{Row: size.Rows, Col: size.Cols}
+	if err := ioctl(tty.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws)); err != nil {
+		tty.Close()
+		return nil, nil, fmt.Errorf("TIOCSWINSZ: %v", err)
+	}
+	return pty, tty, nil
+}
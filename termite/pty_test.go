@@ -0,0 +1,65 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestOpenPty(t *testing.T) {
+	pty, tty, err := openPty(&Terminal{Rows: 30, Cols: 100})
+	if err != nil {
+		t.Skipf("openPty: %v", err)
+	}
+	defer pty.Close()
+
+	if got := TerminalSize(tty.Fd()); got == nil || *got != (Terminal{Rows: 30, Cols: 100}) {
+		t.Errorf("got size %v", got)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", "test -t 1 && echo tty")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	tty.Close()
+	cmd.Wait()
+
+	// Reading fails with EIO after the output.
+	out, _ := ioutil.ReadAll(pty)
+	if !strings.Contains(string(out), "tty") {
+		t.Errorf("got output %q", out)
+	}
+}
+
+func TestTerminalSizeNoTerminal(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if got := TerminalSize(w.Fd()); got != nil {
+		t.Errorf("pipe has terminal size %v", got)
+	}
+}
+
+func TestLockedBufferConcurrent(t *testing.T) {
+	b := &lockedBuffer{}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			b.Write([]byte("x"))
+		}
+		close(done)
+	}()
+	b.String()
+	<-done
+	if got := b.String(); got != strings.Repeat("x", 100) {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,336 @@
+package termite
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// In pump mode, the master scans the #include closure of C and C++
+// compiles, and sends the attributes of those headers with the
+// request. The worker then fetches them in bulk, rather than one
+// FUSE lookup at a time. The scan ignores macros and conditionals, so
+// it may find too many headers, or miss some; the latter are fetched
+// as usual.
+
+var compilerRegexp = regexp.MustCompile(`(^|-)(cc|c\+\+|gcc|g\+\+|clang|clang\+\+)(-[0-9.]+)?$`)
+
+var sourceRegexp = regexp.MustCompile(`\.(c|cc|cp|cpp|cxx|c\+\+|C|m|mm|S)$`)
+
+var includeRegexp = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*(include|include_next|import)[ \t]*([<"])([^>"\n]+)[>"]`)
+
+// Upper bound on the number of files to prefetch for one compile.
+const maxPumpFiles = 5000
+
+// How many files a worker fetches at the same time.
+const prefetchParallelism = 8
+
+var defaultIncludeDirs = []string{"/usr/local/include", "/usr/include"}
+
+// compileCommand holds what the include scan needs from a compiler
+// command line. All paths are absolute.
+type compileCommand struct {
+	dir     string
+	sources []string
+
+	// Files from -include and -imacros.
+	forced []string
+
+	// Search path for #include "..." after the directory of the
+	// including file, and for #include <...>.
+	quote []string
+	angle []string
+}
+
+type includeDirective struct {
+	name  string
+	quote bool
+	next  bool
+}
+
+// scannedFile caches the includes of a file with the given hash.
+type scannedFile struct {
+	hash     string
+	includes []includeDirective
+}
+
+// shellCommand returns the command of a shell invocation, such as
+// "sh -c cmd", or "sh -e -o pipefail -c cmd" under make's .SHELLFLAGS.
+func shellCommand(argv []string) (string, bool) {
+	n := len(argv)
+	if n < 3 || argv[n-2] != "-c" {
+		return "", false
+	}
+	for i := 1; i < n-2; i++ {
+		a := argv[i]
+		if a == "-o" || a == "+o" {
+			if i+1 >= n-2 {
+				return "", false
+			}
+			i++
+			continue
+		}
+		if len(a) < 2 || (a[0] != '-' && a[0] != '+') {
+			return "", false
+		}
+	}
+	return argv[n-1], true
+}
+
+// parseCompile recognizes gcc and clang command lines. It returns
+// nil for other commands.
+func parseCompile(argv []string, dir string) *compileCommand {
+	if len(argv) > 0 && !compilerRegexp.MatchString(filepath.Base(argv[0])) {
+		if cmd, ok := shellCommand(argv); ok {
+			argv = ParseCommand(cmd)
+		}
+	}
+	if len(argv) < 2 || !compilerRegexp.MatchString(filepath.Base(argv[0])) {
+		return nil
+	}
+
+	abs := func(p string) string {
+		if filepath.IsAbs(p) {
+			return filepath.Clean(p)
+		}
+		return filepath.Join(dir, p)
+	}
+
+	c := &compileCommand{dir: dir}
+	var iquote, ipath, isystem, idirafter []string
+	nostdinc := false
+	for i := 1; i < len(argv); i++ {
+		a := argv[i]
+
+		// value returns the argument of a flag, either joined
+		// as in -Idir, or separate as in -I dir.
+		value := func(flag string) (string, bool) {
+			if !strings.HasPrefix(a, flag) {
+				return "", false
+			}
+			if len(a) > len(flag) {
+				return a[len(flag):], true
+			}
+			if i+1 < len(argv) {
+				i++
+				return argv[i], true
+			}
+			return "", false
+		}
+
+		if v, ok := value("-iquote"); ok {
+			iquote = append(iquote, abs(v))
+		} else if v, ok := value("-isystem"); ok {
+			isystem = append(isystem, abs(v))
+		} else if v, ok := value("-idirafter"); ok {
+			idirafter = append(idirafter, abs(v))
+		} else if v, ok := value("-I"); ok {
+			ipath = append(ipath, abs(v))
+		} else if a == "-include" || a == "-imacros" {
+			if v, ok := value(a); ok {
+				c.forced = append(c.forced, v)
+			}
+		} else if a == "-nostdinc" {
+			nostdinc = true
+		} else if a == "-o" || a == "-x" || a == "-MF" || a == "-MT" || a == "-MQ" {
+			i++
+		} else if !strings.HasPrefix(a, "-") && sourceRegexp.MatchString(a) {
+			c.sources = append(c.sources, abs(a))
+		}
+	}
+	if len(c.sources) == 0 {
+		return nil
+	}
+
+	c.angle = append(c.angle, ipath...)
+	c.angle = append(c.angle, isystem...)
+	if !nostdinc {
+		c.angle = append(c.angle, defaultIncludeDirs...)
+	}
+	c.angle = append(c.angle, idirafter...)
+	c.quote = iquote
+	return c
+}
+
+// parseIncludes returns the #include directives of a file.
+func parseIncludes(content []byte) []includeDirective {
+	var result []includeDirective
+	for _, m := range includeRegexp.FindAllSubmatch(content, -1) {
+		result = append(result, includeDirective{
+			name:  string(m[3]),
+			quote: m[2][0] == '"',
+			next:  string(m[1]) == "include_next",
+		})
+	}
+	return result
+}
+
+// sourceFile returns the attributes of a regular file, or nil.
+func (m *Master) sourceFile(name string) *attr.FileAttr {
+	a := m.attributes.Get(strings.TrimLeft(name, "/"))
+	if a == nil || a.Deletion() || !a.IsRegular() || a.Hash == "" {
+		return nil
+	}
+	return a
+}
+
+// includes returns the #include directives of a file, from cache if
+// it did not change.
+func (m *Master) includes(a *attr.FileAttr) []includeDirective {
+	m.pumpMu.Lock()
+	if s := m.pumpScanned[a.Path]; s != nil && s.hash == a.Hash {
+		m.pumpMu.Unlock()
+		return s.includes
+	}
+	m.pumpMu.Unlock()
+
+	content, err := ioutil.ReadFile(m.contentStore.Path(a.Hash))
+	if err != nil {
+		log.Printf("include scan of %s: %v", a.Path, err)
+		return nil
+	}
+	includes := parseIncludes(content)
+
+	m.pumpMu.Lock()
+	defer m.pumpMu.Unlock()
+	if m.pumpScanned == nil {
+		m.pumpScanned = map[string]*scannedFile{}
+	}
+	m.pumpScanned[a.Path] = &scannedFile{hash: a.Hash, includes: includes}
+	return includes
+}
+
+// includeClosure returns the attributes of the sources of a compile
+// and the headers they include.
+func (m *Master) includeClosure(c *compileCommand) []*attr.FileAttr {
+	found := map[string]*attr.FileAttr{}
+	var queue []*attr.FileAttr
+	add := func(name string) bool {
+		if found[name] != nil {
+			return true
+		}
+		a := m.sourceFile(name)
+		if a == nil {
+			return false
+		}
+		found[name] = a
+		queue = append(queue, a)
+		return true
+	}
+
+	for _, s := range c.sources {
+		add(s)
+	}
+	for _, f := range c.forced {
+		if filepath.IsAbs(f) {
+			add(f)
+			continue
+		}
+		for _, d := range append([]string{c.dir}, c.quote...) {
+			if add(filepath.Join(d, f)) {
+				break
+			}
+		}
+	}
+
+	for len(queue) > 0 && len(found) < maxPumpFiles {
+		a := queue[0]
+		queue = queue[1:]
+		for _, inc := range m.includes(a) {
+			var dirs []string
+			if inc.quote {
+				dirs = append(dirs, filepath.Dir("/"+a.Path))
+				dirs = append(dirs, c.quote...)
+			}
+			dirs = append(dirs, c.angle...)
+			for _, d := range dirs {
+				// For #include_next, we don't know where the
+				// search starts, so take all candidates.
+				if add(filepath.Join(d, inc.name)) && !inc.next {
+					break
+				}
+			}
+		}
+	}
+
+	var result []*attr.FileAttr
+	for _, a := range found {
+		result = append(result, a)
+	}
+	return result
+}
+
+// preparePump adds the include closure of a compile to the request,
+// with the directories leading to it, parents first.
+func (m *Master) preparePump(req *WorkRequest) {
+	if !m.options.Pump || m.options.Backend != nil {
+		return
+	}
+	c := parseCompile(req.Argv, req.Dir)
+	if c == nil {
+		return
+	}
+
+	files := m.includeClosure(c)
+	dirs := map[string]bool{}
+	for _, f := range files {
+		for d := f.Path; d != ""; {
+			d, _ = SplitPath(d)
+			if dirs[d] {
+				break
+			}
+			dirs[d] = true
+		}
+	}
+	for d := range dirs {
+		if a := m.attributes.GetDir(d); a.IsDir() {
+			files = append(files, a)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	req.Prefetch = files
+}
+
+// prefetch adds the attributes of a request to the cache, and
+// fetches the contents, before the task runs.
+func (m *Mirror) prefetch(files []*attr.FileAttr) {
+	if len(files) == 0 {
+		return
+	}
+
+	// Entries we have are kept up to date by the master, so only
+	// add the others. That needs no kernel cache invalidation.
+	var missing []*attr.FileAttr
+	for _, f := range files {
+		if !m.rpcFs.attr.Have(f.Path) {
+			missing = append(missing, f)
+		}
+	}
+	m.rpcFs.updateFiles(missing)
+
+	var wg sync.WaitGroup
+	slots := make(chan bool, prefetchParallelism)
+	for _, f := range files {
+		if f.Hash == "" || m.rpcFs.cache.Has(f.Hash) {
+			continue
+		}
+		wg.Add(1)
+		slots <- true
+		go func(f *attr.FileAttr) {
+			defer wg.Done()
+			if _, err := m.rpcFs.contentClient.FetchOnce(f.Hash, int64(f.Size)); err != nil {
+				log.Printf("prefetch %s: %v", f.Path, err)
+			}
+			<-slots
+		}(f)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,71 @@
+package termite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCompile(t *testing.T) {
+	c := parseCompile([]string{"/usr/bin/x86_64-linux-gnu-gcc-12", "-c", "-Iinc", "-I", "/abs",
+		"-iquote", "q", "-isystem/sys", "-include", "config.h", "-o", "foo.o", "foo.c"}, "/src")
+	if c == nil {
+		t.Fatal("not recognized")
+	}
+	if want := []string{"/src/foo.c"}; !reflect.DeepEqual(c.sources, want) {
+		t.Errorf("sources %v, want %v", c.sources, want)
+	}
+	if want := []string{"/src/q"}; !reflect.DeepEqual(c.quote, want) {
+		t.Errorf("quote %v, want %v", c.quote, want)
+	}
+	want := append([]string{"/src/inc", "/abs", "/sys"}, defaultIncludeDirs...)
+	if !reflect.DeepEqual(c.angle, want) {
+		t.Errorf("angle %v, want %v", c.angle, want)
+	}
+	if want := []string{"config.h"}; !reflect.DeepEqual(c.forced, want) {
+		t.Errorf("forced %v, want %v", c.forced, want)
+	}
+
+	for _, argv := range [][]string{
+		{"/bin/sh", "-c", "clang++ -nostdinc -c a.cc"},
+		{"/bin/sh", "-e", "-c", "clang++ -nostdinc -c a.cc"},
+		{"/bin/bash", "-e", "-o", "pipefail", "-c", "clang++ -nostdinc -c a.cc"},
+	} {
+		if c := parseCompile(argv, "/src"); c == nil || len(c.angle) != 0 {
+			t.Errorf("%v: got %+v", argv, c)
+		}
+	}
+	if c := parseCompile([]string{"gcc", "-c", "a.c"}, "/src"); c == nil || !reflect.DeepEqual(c.sources, []string{"/src/a.c"}) {
+		t.Errorf("direct compile: got %+v", c)
+	}
+	for _, argv := range [][]string{
+		{"ld", "-o", "x", "a.o"},
+		{"gcc", "-o", "x", "a.o"},
+		{"/bin/sh", "-c", "gcc -c a.c > log"},
+		{"/bin/sh", "-e", "-o", "-c", "gcc -c a.c"},
+		{"/bin/sh", "script", "-c", "gcc -c a.c"},
+	} {
+		if c := parseCompile(argv, "/src"); c != nil {
+			t.Errorf("%v: recognized as compile: %+v", argv, c)
+		}
+	}
+}
+
+func TestParseIncludes(t *testing.T) {
+	got := parseIncludes([]byte(`#include <stdio.h>
+  #  include "foo/bar.h"
+#include_next <limits.h>
+#import "x.h"
+// #include "comment.h" is not at the start
+#define X "y.h"
+#include X
+`))
+	want := []includeDirective{
+		{name: "stdio.h"},
+		{name: "foo/bar.h", quote: true},
+		{name: "limits.h", next: true},
+		{name: "x.h", quote: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,191 @@
+package termite
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type QuarantineOptions struct {
+	// Fraction of failed tasks above which a worker is
+	// quarantined. Zero, the default, disables quarantining.
+	FailureRate float64
+
+	// Minimum number of tasks before we judge a worker.
+	MinTasks int
+
+	// Quarantine duration on the first offense. It doubles for
+	// each subsequent one, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Number of task outcomes that we remember per worker.
+const quarantineWindow = 20
+
+type workerHealth struct {
+	tasks    int
+	failures int
+
+	// Number of times the worker has been quarantined.
+	offenses int
+	until    time.Time
+}
+
+// quarantine tracks failure rates per worker, and excludes workers
+// that fail too often.
+type quarantine struct {
+	options QuarantineOptions
+
+	mu      sync.Mutex
+	workers map[string]*workerHealth
+}
+
+func newQuarantine(o QuarantineOptions) *quarantine {
+	if o.MinTasks <= 0 {
+		o.MinTasks = 5
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = time.Minute
+	}
+	if o.MaxBackoff < o.Backoff {
+		o.MaxBackoff = time.Hour
+	}
+	return &quarantine{
+		options: o,
+		workers: map[string]*workerHealth{},
+	}
+}
+
+// sandboxErrorRegexp matches the errors of mkbox and the userns
+// sandbox helper when they fail to set up the sandbox.
+var sandboxErrorRegexp = regexp.MustCompile(`^(mkbox\.c:[0-9]+: error: |` + sandboxArgv0 + `: )`)
+
+// workerFault returns true if the result of a task points to a
+// problem with the worker rather than the task: the sandbox failed to
+// start, or the task was killed by SIGKILL or SIGBUS before it wrote
+// anything. Crashes of the task itself, such as SIGSEGV, don't count.
+func workerFault(rep *WorkResponse) bool {
+	status := rep.Exit
+	if status.ExitStatus() == 255 && sandboxErrorRegexp.MatchString(rep.Stderr) {
+		return true
+	}
+	return status.Signaled() &&
+		(status.Signal() == syscall.SIGKILL || status.Signal() == syscall.SIGBUS) &&
+		rep.Stdout == "" && rep.Stderr == ""
+}
+
+// record registers the outcomes of tasks on a worker. It returns true
+// if the worker was quarantined as a result.
+func (q *quarantine) record(addr string, tasks, failures int, now time.Time) bool {
+	if q.options.FailureRate <= 0 || tasks == 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	h := q.workers[addr]
+	if h == nil {
+		h = &workerHealth{}
+		q.workers[addr] = h
+	}
+	if now.Before(h.until) {
+		return false
+	}
+	h.tasks += tasks
+	h.failures += failures
+	for h.tasks > quarantineWindow {
+		h.tasks /= 2
+		h.failures /= 2
+	}
+
+	if h.tasks < q.options.MinTasks ||
+		float64(h.failures) <= q.options.FailureRate*float64(h.tasks) {
+		return false
+	}
+
+	backoff := q.options.Backoff
+	for i := 0; i < h.offenses && backoff < q.options.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.options.MaxBackoff {
+		backoff = q.options.MaxBackoff
+	}
+	h.offenses++
+	h.until = now.Add(backoff)
+	h.tasks = 0
+	h.failures = 0
+	return true
+}
+
+func (q *quarantine) isQuarantined(addr string, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	h := q.workers[addr]
+	return h != nil && now.Before(h.until)
+}
+
+// quarantined returns the quarantined workers, with the end of their
+// quarantine.
+func (q *quarantine) quarantined(now time.Time) map[string]time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r := map[string]time.Time{}
+	for addr, h := range q.workers {
+		if now.Before(h.until) {
+			r[addr] = h.until
+		}
+	}
+	return r
+}
+
+// WorkerOutcome summarizes the tasks a master ran on a worker.
+type WorkerOutcome struct {
+	Address  string
+	Tasks    int
+	Failures int
+}
+
+// outcomeCounter accumulates outcomes until they are reported to the
+// coordinator.
+type outcomeCounter struct {
+	mu       sync.Mutex
+	outcomes map[string]*WorkerOutcome
+}
+
+func (c *outcomeCounter) add(addr string, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.outcomes == nil {
+		c.outcomes = map[string]*WorkerOutcome{}
+	}
+	o := c.outcomes[addr]
+	if o == nil {
+		o = &WorkerOutcome{Address: addr}
+		c.outcomes[addr] = o
+	}
+	o.Tasks++
+	if failed {
+		o.Failures++
+	}
+}
+
+// take returns the accumulated outcomes, and resets the counters.
+func (c *outcomeCounter) take() (r []WorkerOutcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range c.outcomes {
+		r = append(r, *o)
+	}
+	sort.Sort(outcomesByAddress(r))
+	c.outcomes = nil
+	return r
+}
+
+type outcomesByAddress []WorkerOutcome
+
+func (s outcomesByAddress) Len() int           { return len(s) }
+func (s outcomesByAddress) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s outcomesByAddress) Less(i, j int) bool { return s[i].Address < s[j].Address }
@@ -0,0 +1,89 @@
+package termite
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestQuarantineBackoff(t *testing.T) {
+	q := newQuarantine(QuarantineOptions{
+		FailureRate: 0.5,
+		MinTasks:    4,
+		Backoff:     time.Minute,
+		MaxBackoff:  3 * time.Minute,
+	})
+	now := time.Now()
+	if q.record("w", 3, 3, now) {
+		t.Fatal("quarantined before MinTasks")
+	}
+	if !q.record("w", 1, 1, now) {
+		t.Fatal("should quarantine")
+	}
+	if !q.isQuarantined("w", now.Add(59*time.Second)) {
+		t.Error("should be quarantined")
+	}
+	if q.isQuarantined("w", now.Add(time.Minute)) {
+		t.Error("quarantine should have expired")
+	}
+
+	now = now.Add(time.Minute)
+	if !q.record("w", 4, 4, now) {
+		t.Fatal("should quarantine again")
+	}
+	if !q.isQuarantined("w", now.Add(119*time.Second)) {
+		t.Error("backoff should double")
+	}
+
+	now = now.Add(2 * time.Minute)
+	q.record("w", 4, 4, now)
+	if got := q.quarantined(now)["w"]; !got.Equal(now.Add(3 * time.Minute)) {
+		t.Errorf("backoff should be capped: got %v", got.Sub(now))
+	}
+}
+
+func TestQuarantineHealthy(t *testing.T) {
+	q := newQuarantine(QuarantineOptions{FailureRate: 0.5})
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if q.record("w", 2, 1, now) {
+			t.Fatal("quarantined worker at the threshold")
+		}
+	}
+}
+
+func TestWorkerFault(t *testing.T) {
+	for _, c := range []struct {
+		rep    WorkResponse
+		expect bool
+	}{
+		{WorkResponse{Exit: 1 << 8}, false},
+		{WorkResponse{Exit: syscall.WaitStatus(syscall.SIGKILL)}, true},
+		{WorkResponse{Exit: syscall.WaitStatus(syscall.SIGBUS)}, true},
+		{WorkResponse{Exit: syscall.WaitStatus(syscall.SIGKILL), Stderr: "compiling foo.c\n"}, false},
+		{WorkResponse{Exit: syscall.WaitStatus(syscall.SIGSEGV)}, false},
+		{WorkResponse{Exit: syscall.WaitStatus(syscall.SIGABRT)}, false},
+		{WorkResponse{Exit: 126 << 8}, false},
+		{WorkResponse{Exit: 255 << 8, Stderr: "usage: foo\n"}, false},
+		{WorkResponse{Exit: 255 << 8, Stderr: "mkbox.c:163: error: open(dst) failed: r=-1 errno=75\n"}, true},
+		{WorkResponse{Exit: 255 << 8, Stderr: "termite-sandbox: pivot_root: invalid argument\n"}, true},
+	} {
+		if got := workerFault(&c.rep); got != c.expect {
+			t.Errorf("workerFault(%v, %q): got %v, want %v", c.rep.Exit, c.rep.Stderr, got, c.expect)
+		}
+	}
+}
+
+func TestOutcomeCounter(t *testing.T) {
+	c := outcomeCounter{}
+	c.add("b", false)
+	c.add("a", true)
+	c.add("a", false)
+	got := c.take()
+	if len(got) != 2 || got[0] != (WorkerOutcome{"a", 2, 1}) || got[1] != (WorkerOutcome{"b", 1, 0}) {
+		t.Errorf("got %v", got)
+	}
+	if len(c.take()) != 0 {
+		t.Errorf("take should reset")
+	}
+}
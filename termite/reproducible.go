@@ -0,0 +1,161 @@
+package termite
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/termite/attr"
+)
+
+// In reproducible mode, tasks see the same inputs each time they
+// run: /dev/urandom and /dev/random produce streams seeded from the
+// command, and SOURCE_DATE_EPOCH is set. The reaped files get uniform
+// ownership and timestamps from the master, rather than from the
+// workers' users and clocks.
+
+// The default SOURCE_DATE_EPOCH, 1980-01-01. Zip files can't hold
+// older dates.
+const DefaultSourceDateEpoch = 315532800
+
+// reproducibleSeed derives the random seed for a request from the
+// command, so reruns get the same numbers.
+func reproducibleSeed(req *WorkRequest) int64 {
+	h := fnv.New64a()
+	for _, l := range [][]string{req.Argv, req.Env, {req.Dir}} {
+		for _, s := range l {
+			io.WriteString(h, s)
+			h.Write([]byte{0})
+		}
+	}
+	return int64(h.Sum64())
+}
+
+// makeReproducible prepares the request for reproducible mode, if it
+// is enabled.
+func (m *Master) makeReproducible(req *WorkRequest) {
+	if !m.options.Reproducible {
+		return
+	}
+	req.Reproducible = true
+	req.RandomSeed = reproducibleSeed(req)
+	for _, e := range req.Env {
+		if strings.HasPrefix(e, "SOURCE_DATE_EPOCH=") {
+			return
+		}
+	}
+	req.Env = append(req.Env, fmt.Sprintf("SOURCE_DATE_EPOCH=%d", m.options.SourceDateEpoch))
+}
+
+// normalizeFileSet sets ownership and timestamps of the files to
+// those of the master.
+func (m *Master) normalizeFileSet(fset attr.FileSet) {
+	now := time.Now()
+	for _, f := range fset.Files {
+		if f.Deletion() {
+			continue
+		}
+		f.Uid = uint32(m.options.Uid)
+		f.Gid = uint32(m.options.Gid)
+		f.SetTimes(&now, &now, &now)
+	}
+}
+
+// randomNode is a file that gives an endless pseudo-random stream on
+// each open. The n-th open is seeded from the task's seed and n, so
+// a rerun reads the same data if it opens the devices in the same
+// order.
+type randomNode struct {
+	nodefs.Node
+	seed int64
+
+	mu    sync.Mutex
+	opens int64
+}
+
+func (n *randomNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0444
+	return fuse.OK
+}
+
+func (n *randomNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	n.mu.Lock()
+	n.opens++
+	seed := n.seed + n.opens
+	n.mu.Unlock()
+	return &nodefs.WithFlags{
+		File: &randomFile{
+			File: nodefs.NewDefaultFile(),
+			rand: rand.New(rand.NewSource(seed)),
+		},
+		// Read past the size, which is 0.
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+type randomFile struct {
+	nodefs.File
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func (f *randomFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rand.Read(dest)
+	return fuse.ReadResultData(dest), fuse.OK
+}
+
+// mountRandom mounts a file system in a new directory under dir,
+// holding a randomNode for seed. It returns the path of the file,
+// and a function to unmount it.
+func mountRandom(dir string, seed int64) (string, func(), error) {
+	mnt, err := ioutil.TempDir(dir, "termite-random")
+	if err != nil {
+		return "", nil, err
+	}
+	root := nodefs.NewDefaultNode()
+	conn := nodefs.NewFileSystemConnector(root, nil)
+	root.Inode().NewChild("random", false, &randomNode{
+		Node: nodefs.NewDefaultNode(),
+		seed: seed,
+	})
+
+	fuseOpts := fuse.MountOptions{}
+	if os.Geteuid() == 0 {
+		fuseOpts.AllowOther = true
+	}
+	server, err := fuse.NewServer(conn.RawFS(), mnt, &fuseOpts)
+	if err != nil {
+		os.Remove(mnt)
+		return "", nil, err
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		server.Unmount()
+		os.Remove(mnt)
+		return "", nil, err
+	}
+	unmount := func() {
+		if err := server.Unmount(); err != nil {
+			log.Printf("unmount %s: %v", mnt, err)
+			return
+		}
+		os.Remove(mnt)
+	}
+	return filepath.Join(mnt, "random"), unmount, nil
+}
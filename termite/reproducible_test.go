@@ -0,0 +1,124 @@
+package termite
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+)
+
+func TestMakeReproducible(t *testing.T) {
+	m := &Master{options: &MasterOptions{Reproducible: true, SourceDateEpoch: 42}}
+	req := &WorkRequest{Argv: []string{"cc", "-c", "a.c"}, Dir: "/src", Env: []string{"PATH=/bin"}}
+	m.makeReproducible(req)
+	if !req.Reproducible || len(req.Env) != 2 || req.Env[1] != "SOURCE_DATE_EPOCH=42" {
+		t.Errorf("got %v", req)
+	}
+
+	other := &WorkRequest{Argv: []string{"cc", "-c", "a.c"}, Dir: "/src", Env: []string{"PATH=/bin"}}
+	m.makeReproducible(other)
+	if other.RandomSeed != req.RandomSeed {
+		t.Errorf("seeds differ for the same command: %d %d", other.RandomSeed, req.RandomSeed)
+	}
+
+	set := &WorkRequest{Argv: []string{"cc"}, Env: []string{"SOURCE_DATE_EPOCH=1"}}
+	m.makeReproducible(set)
+	if len(set.Env) != 1 {
+		t.Errorf("SOURCE_DATE_EPOCH should not be overridden: %v", set.Env)
+	}
+}
+
+func TestMountRandom(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+
+	// readOpens reads n bytes from each of two opens.
+	readOpens := func(seed int64, n int) [][]byte {
+		name, unmount, err := mountRandom(dir, seed)
+		if err != nil {
+			t.Fatalf("mountRandom: %v", err)
+		}
+		defer unmount()
+		var r [][]byte
+		for i := 0; i < 2; i++ {
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			c := make([]byte, n)
+			_, err = io.ReadFull(f, c)
+			f.Close()
+			if err != nil {
+				t.Fatalf("read %d bytes: %v", n, err)
+			}
+			r = append(r, c)
+		}
+		return r
+	}
+
+	first := readOpens(1, 2<<20)
+	if bytes.Equal(first[0][:4096], first[1][:4096]) {
+		t.Error("opens gave the same data")
+	}
+	again := readOpens(1, 4096)
+	if !bytes.Equal(first[0][:4096], again[0]) || !bytes.Equal(first[1][:4096], again[1]) {
+		t.Error("same seed gave different data")
+	}
+	other := readOpens(2, 4096)
+	if bytes.Equal(first[0][:4096], other[0]) {
+		t.Error("different seeds gave the same data")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("mount points left: %v", entries)
+	}
+}
+
+func TestNormalizeFileSet(t *testing.T) {
+	m := &Master{options: &MasterOptions{Uid: 1000, Gid: 100}}
+	then := time.Unix(1e9, 123)
+	a := &attr.FileAttr{Path: "a", Attr: &fuse.Attr{Mode: syscall.S_IFREG | 0644}}
+	a.Uid, a.Gid = 3333, 3333
+	a.SetTimes(&then, &then, &then)
+	b := &attr.FileAttr{Path: "b", Attr: &fuse.Attr{Mode: syscall.S_IFDIR | 0755}}
+	del := &attr.FileAttr{Path: "c"}
+
+	m.normalizeFileSet(attr.FileSet{Files: []*attr.FileAttr{a, b, del}})
+	if a.Uid != 1000 || a.Gid != 100 {
+		t.Errorf("owner not normalized: %v", a.LongString())
+	}
+	if !a.ModTime().Equal(b.ModTime()) || a.ModTime().Equal(then) {
+		t.Errorf("times not normalized: %v %v", a.ModTime(), b.ModTime())
+	}
+	if !del.Deletion() {
+		t.Errorf("deletion changed: %v", del)
+	}
+}
+
+func TestEndToEndReproducibleRandom(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+	tc.master.options.Reproducible = true
+
+	req := WorkRequest{
+		Argv: []string{"/bin/sh", "-c",
+			"head -c 2000000 /dev/urandom | wc -c; head -c 16 /dev/urandom | od -x; head -c 16 /dev/random | od -x"},
+	}
+	rep := tc.RunSuccess(req)
+	lines := strings.Split(rep.Stdout, "\n")
+	if len(lines) < 5 || strings.TrimSpace(lines[0]) != "2000000" {
+		t.Fatalf("got %q", rep.Stdout)
+	}
+	if lines[1] == lines[3] {
+		t.Errorf("opens gave the same data: %q", rep.Stdout)
+	}
+	if again := tc.RunSuccess(req); again.Stdout != rep.Stdout {
+		t.Errorf("rerun gave %q, want %q", again.Stdout, rep.Stdout)
+	}
+}
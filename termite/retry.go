@@ -0,0 +1,221 @@
+package termite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FailureClass says why a task failed.
+type FailureClass string
+
+const (
+	// The command failed by itself, eg. a compile error. Running
+	// it again gives the same result.
+	FailureUser FailureClass = "user"
+
+	// Termite failed: RPC or FUSE errors, a worker that went
+	// away, or a sandbox that could not be set up.
+	FailureInfra FailureClass = "infra"
+
+	// The task ran out of memory, disk or CPU time on the worker.
+	FailureResource FailureClass = "resource"
+)
+
+// RetryRule says how to retry one class of failures.
+type RetryRule struct {
+	// How often to retry.
+	Attempts int
+
+	// How long to wait before the first retry, eg. "1s". The wait
+	// doubles for each further retry, up to MaxBackoff, if set.
+	Backoff    string
+	MaxBackoff string
+
+	// Retry on a worker where the task did not fail yet, if there
+	// is one.
+	OtherWorker bool
+}
+
+// RetryPolicy says how the master retries failed tasks.
+type RetryPolicy struct {
+	Infra    RetryRule
+	User     RetryRule
+	Resource RetryRule
+}
+
+// DefaultRetryPolicy retries infrastructure failures retryCount
+// times, and tasks that ran out of resources once, elsewhere.
+func DefaultRetryPolicy(retryCount int) *RetryPolicy {
+	return &RetryPolicy{
+		Infra: RetryRule{
+			Attempts:    retryCount,
+			OtherWorker: true,
+		},
+		Resource: RetryRule{
+			Attempts:    1,
+			Backoff:     "5s",
+			OtherWorker: true,
+		},
+	}
+}
+
+// ReadRetryPolicy reads a policy in JSON format.
+func ReadRetryPolicy(name string) (*RetryPolicy, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p := &RetryPolicy{}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+// check returns an error for malformed durations.
+func (p *RetryPolicy) check() error {
+	for _, c := range []FailureClass{FailureInfra, FailureUser, FailureResource} {
+		r := p.rule(c)
+		if r.Attempts < 0 {
+			return fmt.Errorf("%s: negative Attempts", c)
+		}
+		for _, d := range []string{r.Backoff, r.MaxBackoff} {
+			if d == "" {
+				continue
+			}
+			if _, err := time.ParseDuration(d); err != nil {
+				return fmt.Errorf("%s: %v", c, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *RetryPolicy) rule(c FailureClass) *RetryRule {
+	switch c {
+	case FailureInfra:
+		return &p.Infra
+	case FailureResource:
+		return &p.Resource
+	}
+	return &p.User
+}
+
+// backoff returns how long to wait before the given retry, counting
+// from 0.
+func (r *RetryRule) backoff(retry int) time.Duration {
+	if r.Backoff == "" {
+		return 0
+	}
+	d, _ := time.ParseDuration(r.Backoff)
+	var max time.Duration
+	if r.MaxBackoff != "" {
+		max, _ = time.ParseDuration(r.MaxBackoff)
+	}
+	for i := 0; i < retry; i++ {
+		if max > 0 && d >= max {
+			break
+		}
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+var resourceErrorRegexp = regexp.MustCompile(`(?i)(virtual memory exhausted|out of memory|cannot allocate memory|no space left on device|disk quota exceeded)`)
+
+// classifyFailure returns the class of a failed run, or "" if it
+// succeeded.
+func classifyFailure(err error, rep *WorkResponse) FailureClass {
+	status := rep.Exit
+	switch {
+	case err != nil:
+		return FailureInfra
+	case status == 0:
+		return ""
+	case strings.Contains(rep.Stderr, "termite: killed after timeout"):
+		// Killed on purpose, by a Timeout rule.
+		return FailureUser
+	case status.Signaled() && (status.Signal() == syscall.SIGKILL ||
+		status.Signal() == syscall.SIGXCPU || status.Signal() == syscall.SIGXFSZ):
+		// SIGKILL mostly comes from the OOM killer.
+		return FailureResource
+	case status.ExitStatus() == 128+int(syscall.SIGKILL):
+		// The same, through a shell.
+		return FailureResource
+	case resourceErrorRegexp.MatchString(rep.Stderr):
+		return FailureResource
+	case workerFault(rep):
+		// Crashes such as SIGSEGV or SIGABRT are most likely
+		// bugs in the command, and are not retried.
+		return FailureInfra
+	}
+	return FailureUser
+}
+
+// retryPolicy returns the policy from the options, or the default
+// for RetryCount.
+func (m *Master) retryPolicy() *RetryPolicy {
+	if m.options.Retry != nil {
+		return m.options.Retry
+	}
+	return DefaultRetryPolicy(m.options.RetryCount)
+}
+
+// runWithRetries runs a task, and retries it as the retry policy
+// says. The earlier attempts are recorded in rep.Retries.
+func (m *Master) runWithRetries(req *WorkRequest, rep *WorkResponse) error {
+	policy := m.retryPolicy()
+	avoid := map[string]bool{}
+	retries := map[FailureClass]int{}
+	var history []Attempt
+	for {
+		// Start afresh, so no output of the failed run remains.
+		*rep = WorkResponse{}
+		start := time.Now()
+		worker, err := m.runOnce(req, rep, avoid)
+		class := classifyFailure(err, rep)
+		rep.Failure = class
+		rep.Retries = history
+
+		rule := policy.rule(class)
+		n := retries[class]
+		if class == "" || n >= rule.Attempts || m.sessions.cancelled(req.Session) {
+			if err != nil && len(history) > 0 {
+				err = fmt.Errorf("%v (after %d retries)", err, len(history))
+			}
+			return err
+		}
+
+		a := Attempt{
+			Worker:   worker,
+			Failure:  class,
+			Exit:     rep.Exit,
+			Duration: time.Now().Sub(start),
+		}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		history = append(history, a)
+		retries[class]++
+		if rule.OtherWorker && worker != "" {
+			avoid[worker] = true
+		}
+
+		wait := rule.backoff(n)
+		log.Printf("Retrying task %d after %s failure on %q in %v; exit %v, error %v",
+			req.TaskId, class, worker, wait, rep.Exit, err)
+		time.Sleep(wait)
+	}
+}
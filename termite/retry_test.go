@@ -0,0 +1,84 @@
+package termite
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		rep    WorkResponse
+		expect FailureClass
+	}{
+		{nil, WorkResponse{}, ""},
+		{errors.New("connection reset"), WorkResponse{}, FailureInfra},
+		{nil, WorkResponse{Exit: 1 << 8, Stderr: "foo.c:1: error"}, FailureUser},
+		{nil, WorkResponse{Exit: syscall.WaitStatus(syscall.SIGKILL)}, FailureResource},
+		{nil, WorkResponse{Exit: 137 << 8}, FailureResource},
+		{nil, WorkResponse{Exit: 1 << 8, Stderr: "cc1plus: out of memory allocating 65536 bytes"}, FailureResource},
+		{nil, WorkResponse{Exit: syscall.WaitStatus(syscall.SIGSEGV)}, FailureUser},
+		{nil, WorkResponse{Exit: syscall.WaitStatus(syscall.SIGABRT), Stderr: "assertion failed"}, FailureUser},
+		{nil, WorkResponse{Exit: 126 << 8}, FailureUser},
+		{nil, WorkResponse{Exit: 255 << 8}, FailureUser},
+		{nil, WorkResponse{Exit: syscall.WaitStatus(syscall.SIGBUS)}, FailureInfra},
+		{nil, WorkResponse{
+			Exit:   255 << 8,
+			Stderr: "termite-sandbox: bind /usr: no such file or directory\n",
+		}, FailureInfra},
+		{nil, WorkResponse{
+			Exit:   syscall.WaitStatus(syscall.SIGKILL),
+			Stderr: "termite: killed after timeout of 1m0s\n",
+		}, FailureUser},
+	} {
+		if got := classifyFailure(c.err, &c.rep); got != c.expect {
+			t.Errorf("classifyFailure(%v, %v %q): got %q, want %q",
+				c.err, c.rep.Exit, c.rep.Stderr, got, c.expect)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r := RetryRule{Backoff: "1s", MaxBackoff: "3s"}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if got := r.backoff(i); got != want {
+			t.Errorf("backoff(%d): got %v, want %v", i, got, want)
+		}
+	}
+	if got := (&RetryRule{}).backoff(3); got != 0 {
+		t.Errorf("got %v for no backoff", got)
+	}
+}
+
+func TestRetryPolicyCheck(t *testing.T) {
+	p := DefaultRetryPolicy(3)
+	if err := p.check(); err != nil {
+		t.Errorf("default policy: %v", err)
+	}
+	if p.rule(FailureUser).Attempts != 0 || p.rule(FailureInfra).Attempts != 3 {
+		t.Errorf("got %+v", p)
+	}
+
+	p.Resource.Backoff = "5 parsecs"
+	if err := p.check(); err == nil {
+		t.Error("bad duration accepted")
+	}
+}
+
+func TestPickAvoid(t *testing.T) {
+	a := &mirrorConnection{workerAddr: "a", maxJobs: 1, availableJobs: 1}
+	b := &mirrorConnection{workerAddr: "b", maxJobs: 1, availableJobs: 1}
+	c := &mirrorConnections{
+		mirrors: map[string]*mirrorConnection{"a": a, "b": b},
+	}
+	for i := 0; i < 10; i++ {
+		if got := c.choose(map[string]bool{"a": true}); got != b {
+			t.Fatalf("got %v, want b", got)
+		}
+	}
+	if got := c.choose(map[string]bool{"a": true, "b": true}); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
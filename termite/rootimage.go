@@ -0,0 +1,442 @@
+package termite
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/termite/cba"
+)
+
+// Root images let a build use a pinned root file system (eg. a
+// toolchain), rather than the one of the master. An image is a tar
+// file, optionally gzipped, stored in the content store. Only the
+// top-level directory holding the writable root still comes from the
+// master.
+//
+// Workers unpack an image once, and bind its top-level directories
+// read-only where the master's would go. They are not layered under
+// the MemUnionFs of the task: tasks only write in the writable root,
+// which stays in the union, and outside of it the sandbox shows the
+// same read-only view, without passing the reads of the toolchain
+// through FUSE.
+
+// How long the hash of a root image is used before checking the
+// image for changes.
+var rootImageRecheck = 5 * time.Second
+
+type rootImage struct {
+	Hash string
+	Size int64
+
+	// Metadata of the image when it was hashed, and when that was
+	// last compared.
+	fingerprint string
+	checked     time.Time
+}
+
+// imageHashes caches the hashes of root images by path.
+type imageHashes struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	hashing map[string]bool
+	images  map[string]*rootImage
+}
+
+func newImageHashes() *imageHashes {
+	h := &imageHashes{
+		hashing: map[string]bool{},
+		images:  map[string]*rootImage{},
+	}
+	h.cond = sync.NewCond(&h.mu)
+	return h
+}
+
+// rootImageHash returns the hash and size of the image at path,
+// adding it to the content store if needed. Directories are stored
+// as a tar file.
+func (m *Master) rootImageHash(path string) (hash string, size int64, err error) {
+	h := m.imageHashes
+	h.mu.Lock()
+	for h.hashing[path] {
+		h.cond.Wait()
+	}
+	img := h.images[path]
+	if img != nil && time.Now().Sub(img.checked) < rootImageRecheck {
+		h.mu.Unlock()
+		return img.Hash, img.Size, nil
+	}
+	h.hashing[path] = true
+	h.mu.Unlock()
+
+	img, err = m.hashRootImage(path, img)
+
+	h.mu.Lock()
+	delete(h.hashing, path)
+	h.cond.Broadcast()
+	if err == nil {
+		h.images[path] = img
+	}
+	h.mu.Unlock()
+	if err != nil {
+		return "", 0, err
+	}
+	return img.Hash, img.Size, nil
+}
+
+// hashRootImage stores the image at path, unless it has not changed
+// since old was made.
+func (m *Master) hashRootImage(path string, old *rootImage) (*rootImage, error) {
+	fingerprint, err := imageFingerprint(path)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil && old.fingerprint == fingerprint {
+		img := *old
+		img.checked = time.Now()
+		return &img, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var hash string
+	if fi.IsDir() {
+		hash, err = saveTree(m.contentStore, path)
+	} else {
+		hash = m.contentStore.SavePath(path)
+		if hash == "" {
+			err = fmt.Errorf("could not save %s", path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi, err = os.Stat(m.contentStore.Path(hash)); err != nil {
+		return nil, err
+	}
+
+	log.Printf("root image %s has hash %x", path, hash)
+	return &rootImage{
+		Hash:        hash,
+		Size:        fi.Size(),
+		fingerprint: fingerprint,
+		checked:     time.Now(),
+	}, nil
+}
+
+// imageFingerprint summarizes the names, types, sizes and change
+// times of the files of an image, so we notice when it changes
+// without reading it.
+func imageFingerprint(path string) (string, error) {
+	h := md5.New()
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %o %d %d", p, fi.Mode(), fi.Size(), fi.ModTime().UnixNano())
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			fmt.Fprintf(h, " %d %d.%d", st.Ino, st.Ctim.Sec, st.Ctim.Nsec)
+		}
+		h.Write([]byte("\n"))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// resolveRootImage fills in the image hash for the request.
+func (m *Master) resolveRootImage(req *WorkRequest) error {
+	path := req.RootImage
+	if path == "" {
+		path = m.options.RootImage
+	}
+	if path == "" {
+		return nil
+	}
+	var err error
+	req.RootImageHash, req.RootImageSize, err = m.rootImageHash(path)
+	if err != nil {
+		return fmt.Errorf("root image %s: %v", path, err)
+	}
+	return nil
+}
+
+// saveTree stores the directory as a tar file. The entries are sorted
+// and timestamps are zeroed, so the hash only depends on the
+// contents.
+func saveTree(store *cba.Store, dir string) (string, error) {
+	hw := store.NewHashWriter()
+	tw := tar.NewWriter(hw)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if rel == "." {
+			return nil
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			// Sockets and the like.
+			return nil
+		}
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := hw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hw.Sum(), nil
+}
+
+// rootImages holds the unpacked images on a worker.
+type rootImages struct {
+	dir   string
+	store *cba.Store
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	unpacking map[string]bool
+	unpacked  map[string]string
+}
+
+func newRootImages(dir string, store *cba.Store) *rootImages {
+	ri := &rootImages{
+		dir:       dir,
+		store:     store,
+		unpacking: map[string]bool{},
+		unpacked:  map[string]string{},
+	}
+	ri.cond = sync.NewCond(&ri.mu)
+	return ri
+}
+
+// get returns the directory holding the image with the given hash,
+// calling fetch to get it into the content store if necessary.
+// Images are unpacked only once, and kept until the worker exits.
+func (ri *rootImages) get(hash string, fetch func() error) (string, error) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	for ri.unpacking[hash] {
+		ri.cond.Wait()
+	}
+	if d, ok := ri.unpacked[hash]; ok {
+		return d, nil
+	}
+	ri.unpacking[hash] = true
+	ri.mu.Unlock()
+
+	dir, err := ri.unpack(hash, fetch)
+
+	ri.mu.Lock()
+	delete(ri.unpacking, hash)
+	ri.cond.Broadcast()
+	if err != nil {
+		return "", err
+	}
+	ri.unpacked[hash] = dir
+	return dir, nil
+}
+
+func (ri *rootImages) unpack(hash string, fetch func() error) (string, error) {
+	dest := filepath.Join(ri.dir, fmt.Sprintf("%x", hash))
+	if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		// From a previous run.
+		return dest, nil
+	}
+	if !ri.store.Has(hash) {
+		if err := fetch(); err != nil {
+			return "", err
+		}
+	}
+	f, err := os.Open(ri.store.Path(hash))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(ri.dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(ri.dir, "unpack")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	log.Printf("unpacking root image %x", hash)
+	if err := untar(f, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("root image %x: %v", hash, err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return dest, nil
+}
+
+// untar extracts a tar file, which may be gzipped, into dir.
+func untar(input io.Reader, dir string) error {
+	br := bufio.NewReader(input)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// Set directory permissions at the end, so we can write
+	// into read-only directories.
+	dirModes := map[string]os.FileMode{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if name == "." {
+			continue
+		}
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("entry %q outside of image", hdr.Name)
+		}
+		if err := checkNoSymlinks(dir, filepath.Dir(name)); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, name)
+		mode := os.FileMode(hdr.Mode) & os.ModePerm
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+			dirModes[path] = mode
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target := filepath.Clean(strings.TrimLeft(hdr.Linkname, "/"))
+			if target == ".." || strings.HasPrefix(target, "../") {
+				return fmt.Errorf("link %q outside of image", hdr.Linkname)
+			}
+			if err := checkNoSymlinks(dir, target); err != nil {
+				return err
+			}
+			if err := os.Link(filepath.Join(dir, target), path); err != nil {
+				return err
+			}
+		default:
+			// Devices and fifos don't belong in a toolchain.
+			log.Printf("untar: skipping %q, type %c", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	// Deepest first, so we don't lock ourselves out.
+	var dirs []string
+	for d := range dirModes {
+		dirs = append(dirs, d)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		if err := os.Chmod(d, dirModes[d]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNoSymlinks returns an error if a component of rel below dir is
+// a symlink, as writing through it could escape dir.
+func checkNoSymlinks(dir, rel string) error {
+	p := dir
+	for _, c := range strings.Split(rel, "/") {
+		if c == "." {
+			continue
+		}
+		p = filepath.Join(p, c)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%q goes through a symlink", rel)
+		}
+	}
+	return nil
+}
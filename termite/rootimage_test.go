@@ -0,0 +1,104 @@
+package termite
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/stats"
+)
+
+func TestRootImageRoundTrip(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	os.MkdirAll(filepath.Join(src, "usr/bin"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "usr/bin/cc"), []byte("compiler"), 0755)
+	os.Symlink("usr/bin", filepath.Join(src, "bin"))
+
+	store := cba.NewStore(&cba.StoreOptions{Dir: filepath.Join(tmp, "store")}, stats.NewTimerStats())
+	hash, err := saveTree(store, src)
+	if err != nil {
+		t.Fatalf("saveTree: %v", err)
+	}
+	again, err := saveTree(store, src)
+	if err != nil || again != hash {
+		t.Errorf("hash not stable: %x %x (%v)", hash, again, err)
+	}
+
+	images := newRootImages(filepath.Join(tmp, "images"), store)
+	dir, err := images.get(hash, func() error {
+		t.Fatal("fetch called for hash in store")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "bin/cc"))
+	if err != nil || string(content) != "compiler" {
+		t.Errorf("got %q, %v", content, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "usr/bin/cc")); err != nil || fi.Mode()&0111 == 0 {
+		t.Errorf("mode not preserved: %v, %v", fi, err)
+	}
+}
+
+func TestUntarEscape(t *testing.T) {
+	for _, hdrs := range [][]tar.Header{
+		{{Name: "../evil", Typeflag: tar.TypeReg}},
+		{{Name: "lnk", Typeflag: tar.TypeSymlink, Linkname: "/etc"}, {Name: "lnk/passwd", Typeflag: tar.TypeReg}},
+		{{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+	} {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, h := range hdrs {
+			h := h
+			h.Mode = 0644
+			tw.WriteHeader(&h)
+		}
+		tw.Close()
+
+		dir, _ := ioutil.TempDir("", "termite")
+		if err := untar(buf, dir); err == nil {
+			t.Errorf("untar succeeded for %v", hdrs)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRootImageHashChanges(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(tmp)
+	defer func(d time.Duration) { rootImageRecheck = d }(rootImageRecheck)
+	rootImageRecheck = 0
+
+	src := filepath.Join(tmp, "src")
+	os.MkdirAll(filepath.Join(src, "usr/bin"), 0755)
+	cc := filepath.Join(src, "usr/bin/cc")
+	ioutil.WriteFile(cc, []byte("compiler"), 0755)
+
+	m := &Master{
+		contentStore: cba.NewStore(&cba.StoreOptions{Dir: filepath.Join(tmp, "store")}, stats.NewTimerStats()),
+		imageHashes:  newImageHashes(),
+	}
+	hash, _, err := m.rootImageHash(src)
+	if err != nil {
+		t.Fatalf("rootImageHash: %v", err)
+	}
+	if again, _, err := m.rootImageHash(src); err != nil || again != hash {
+		t.Errorf("hash changed without a change: %x %x (%v)", hash, again, err)
+	}
+
+	// A file deep in the tree changes, but the top directory does not.
+	ioutil.WriteFile(cc, []byte("compiler v2"), 0755)
+	changed, _, err := m.rootImageHash(src)
+	if err != nil || changed == hash {
+		t.Errorf("hash not updated: %x (%v)", changed, err)
+	}
+}
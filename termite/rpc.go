@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/termite/attr"
 	"github.com/hanwen/termite/stats"
@@ -45,6 +46,10 @@ type WorkerStatusResponse struct {
 	Version      string
 	MaxJobCount  int
 	Accepting    bool
+	Draining     bool
+
+	// SandboxMkbox or SandboxUserNS.
+	Sandbox string
 
 	// In chronological order.
 	CpuStats  []stats.CpuStat
@@ -56,6 +61,78 @@ type WorkerStatusResponse struct {
 	MemStat     stats.MemStat
 }
 
+type MasterStatusRequest struct {
+}
+
+type MasterStatusResponse struct {
+	Version      string
+	WritableRoot string
+	SourceRoot   string
+
+	// Number of regular files in the attribute cache, and their
+	// sizes as a histogram of powers of two.
+	FileCount         int
+	FileSizeHistogram []int
+
+	WantedMaxJobs int
+	ReservedJobs  int
+	AvailableJobs int
+
+	// Addresses of workers with a mirror, and all workers known
+	// through the coordinator.
+	Mirrors []string
+	Workers []string
+
+	// Workers we don't use because they failed too often.
+	Quarantined []string
+
+	RpcTimings  []string
+	PhaseNames  []string
+	PhaseCounts []int
+	MemStat     stats.MemStat
+
+	Sessions []SessionStatus
+}
+
+// SessionStatus describes a build session of the master.
+type SessionStatus struct {
+	Id          string
+	Start       time.Time
+	LastActive  time.Time
+	AnalysisDir string
+	MaxJobs     int
+
+	// Number of tasks.
+	Running int
+	Waiting int
+	Done    int
+	Failed  int
+
+	Cancelled bool
+}
+
+type SessionListResponse struct {
+	Sessions []SessionStatus
+}
+
+type CancelSessionRequest struct {
+	Session string
+}
+
+type CancelSessionResponse struct {
+	// Number of tasks killed on workers.
+	Killed int
+}
+
+// CancelRequest asks a worker to kill running tasks.
+type CancelRequest struct {
+	TaskIds []int
+}
+
+type CancelResponse struct {
+	Killed int
+}
+
 type Timing struct {
 	Name string
 	Dt   float64
@@ -77,8 +154,42 @@ type WorkResponse struct {
 	// Files from the backing store that were read.
 	Reads []string
 
+	// Files outside the writable root that were read, relative to
+	// the root. Only filled in with TrackReads.
+	ExternalReads []string
+
+	// ExternalReads not allowed by the master's hermeticity policy.
+	UndeclaredReads []string
+
 	// Worker where this was processed.
 	WorkerId string
+
+	// Set if the worker is draining, and wants no new tasks.
+	Draining bool
+
+	// Set if the task failed, and it looks like it tried to use
+	// the network while running without network access.
+	NetworkError string
+
+	// Differences found by rerunning the task on another worker,
+	// if it was verified. Filled in by the master.
+	Nondeterminism []string
+
+	// Why the task failed, if it did. Filled in by the master.
+	Failure FailureClass
+
+	// Earlier runs of the task that failed and were retried.
+	Retries []Attempt
+}
+
+// Attempt describes a failed run of a task.
+type Attempt struct {
+	// Address of the worker; empty for a backend.
+	Worker   string
+	Failure  FailureClass
+	Exit     syscall.WaitStatus
+	Error    string
+	Duration time.Duration
 }
 
 type WorkRequest struct {
@@ -106,6 +217,45 @@ type WorkRequest struct {
 	// If set, must run on this worker. Used for debugging.
 	Worker string
 
+	// If set, overrides WorkerOptions.ShareNetwork.
+	ShareNetwork *bool
+
+	// If set, overrides MasterOptions.RootImage.
+	RootImage string
+
+	// Content hash and size of the root image, filled in by the
+	// master.
+	RootImageHash string
+	RootImageSize int64
+
+	// Set by the master in reproducible mode: /dev/urandom and
+	// /dev/random are replaced with streams seeded by RandomSeed.
+	Reproducible bool
+	RandomSeed   int64
+
+	// If set, the task gets a file system of its own, so the
+	// returned FileSet holds only its changes.
+	Isolate bool
+
+	// If positive, the worker kills the task after this long.
+	Timeout time.Duration
+
+	// If set, the task runs on a pseudo-terminal of this size, for
+	// both stdout and stderr. With StdinId, the output is streamed
+	// back over that connection.
+	Terminal *Terminal
+
+	// Attributes of files the task will probably read, parents
+	// first. Filled in by the master in pump mode; the worker
+	// fetches them before starting the task.
+	Prefetch []*attr.FileAttr
+
+	// Build session of the task. If SessionJobs is positive, at
+	// most that many tasks of the session run at once; the first
+	// request of a session sets it.
+	Session     string
+	SessionJobs int
+
 	// The following is used with TrackReads and can be injected from the Makefile.
 	DeclaredDeps   []string
 	DeclaredTarget string
@@ -127,12 +277,21 @@ type CreateMirrorRequest struct {
 
 	// Max number of processes to reserve.
 	MaxJobCount int
+
+	// Additions to the worker's mount policy.
+	MountPolicy *MountPolicy
 }
 
 type CreateMirrorResponse struct {
 	GrantedJobCount int
 }
 
+type DrainRequest struct {
+}
+
+type DrainResponse struct {
+}
+
 type ShutdownRequest struct {
 	Restart bool
 	Kill    bool
@@ -150,3 +309,65 @@ type LogRequest struct {
 type LogResponse struct {
 	Data []byte
 }
+
+// TestRequest runs a test binary on the workers, split in shards.
+type TestRequest struct {
+	Binary string
+	Argv   []string
+	Env    []string
+	Dir    string
+
+	// Test filters to deal over the shards. Without filters, each
+	// shard gets the sharding variables of GoogleTest and Bazel,
+	// and the test binary picks its part of the tests.
+	Filters []string
+
+	// How a shard passes its filters to the binary: a format for
+	// the filters joined by FilterSeparator. The default is
+	// "--gtest_filter=%s" and ":".
+	FilterFormat    string
+	FilterSeparator string
+
+	// Number of shards. The default is one per filter.
+	Shards int
+
+	// If set, run only these shards, eg. to retry failed ones.
+	Only []int
+
+	// Where shards write their JUnit XML, as shard-N.xml, through
+	// $XML_OUTPUT_FILE and $GTEST_OUTPUT. Relative to Dir; the
+	// default is .termite-test-results.
+	ResultDir string
+
+	Session     string
+	SessionJobs int
+	Debug       bool
+}
+
+type TestShardResult struct {
+	Index    int
+	Filters  []string
+	Exit     syscall.WaitStatus
+	Failure  FailureClass
+	WorkerId string
+	Stdout   string
+	Stderr   string
+	Retries  int
+	Duration time.Duration
+
+	// Set if the shard could not run.
+	Error string
+
+	// JUnit XML written by the shard, if any.
+	Report []byte
+}
+
+type TestResponse struct {
+	// The shards that ran, and the failed ones among them.
+	Shards []TestShardResult
+	Failed []int
+
+	// JUnit XML for all shards. Shards that did not run now are
+	// taken from the ResultDir.
+	Report []byte
+}
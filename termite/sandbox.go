@@ -0,0 +1,473 @@
+package termite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// Sandbox modes for running tasks.
+const (
+	// Run tasks through the termite-mkbox binary.
+	SandboxMkbox = "mkbox"
+
+	// Build the sandbox ourselves in unprivileged user and mount
+	// namespaces. This does not need root.
+	SandboxUserNS = "userns"
+)
+
+// Owner of the files created by tasks, inside the sandbox.
+const (
+	sandboxUid = 3333
+	sandboxGid = 3333
+)
+
+// argv[0] under which the worker binary acts as the userns sandbox
+// helper.
+const sandboxArgv0 = "termite-sandbox"
+
+// MaybeRunSandbox runs the sandbox helper if the process was started
+// as such. It must be called at the start of main() of binaries that
+// run workers, before flag parsing. It does not return if the process
+// is a sandbox helper.
+func MaybeRunSandbox() {
+	if os.Args[0] != sandboxArgv0 {
+		return
+	}
+	err := runSandbox(os.Args[1:])
+	fmt.Fprintf(os.Stderr, "%s: %v\n", sandboxArgv0, err)
+
+	// Same as mkbox, so failures to set up look like a problem
+	// with the worker.
+	os.Exit(255)
+}
+
+// selectSandbox returns the sandbox mode to use.  If mode is empty,
+// it picks mkbox when running as root, and userns otherwise, falling
+// back to mkbox if the userns probe fails.
+func selectSandbox(mode string, mkbox string, tmpDir string) (string, error) {
+	if mode == "" {
+		if os.Geteuid() == 0 && mkbox != "" {
+			return SandboxMkbox, nil
+		}
+		err := probeUserNS(tmpDir)
+		if err == nil {
+			return SandboxUserNS, nil
+		}
+		if mkbox == "" {
+			return "", fmt.Errorf("userns sandbox unavailable: %v", err)
+		}
+		log.Printf("userns sandbox unavailable, using mkbox: %v", err)
+		return SandboxMkbox, nil
+	}
+
+	switch mode {
+	case SandboxMkbox:
+		if mkbox == "" {
+			return "", fmt.Errorf("no mkbox binary")
+		}
+	case SandboxUserNS:
+		if err := probeUserNS(tmpDir); err != nil {
+			return "", fmt.Errorf("userns sandbox unavailable: %v", err)
+		}
+	default:
+		return "", fmt.Errorf("unknown sandbox mode %q", mode)
+	}
+	return mode, nil
+}
+
+// probeUserNS checks that we can build a sandbox in an unprivileged
+// user namespace, and bind a FUSE file system into it.
+func probeUserNS(tmpDir string) error {
+	dir, err := ioutil.TempDir(tmpDir, "sandbox-probe")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	mnt := filepath.Join(dir, "mnt")
+	for _, d := range []string{root, mnt} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	fuseOpts := fuse.MountOptions{}
+	if os.Geteuid() == 0 {
+		fuseOpts.AllowOther = true
+	}
+	conn := nodefs.NewFileSystemConnector(nodefs.NewDefaultNode(), nil)
+	server, err := fuse.NewServer(conn.RawFS(), mnt, &fuseOpts)
+	if err != nil {
+		return fmt.Errorf("FUSE mount: %v", err)
+	}
+	go server.Serve()
+	defer server.Unmount()
+	if err := server.WaitMount(); err != nil {
+		return fmt.Errorf("FUSE mount: %v", err)
+	}
+
+	cmd := userNSCommand([]string{"-q", "-s", root, "-b", mnt + "=mnt", "-r", "mnt",
+		"-t", "tmp", "-r", "tmp", "-P"}, sandboxUid, sandboxGid, false)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v, output %q", err, out)
+	}
+	return nil
+}
+
+// Linux constants missing from package syscall.
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+
+	linuxCapabilityVersion3 = 0x20080522
+
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+)
+
+// userNSCommand returns a command that runs the sandbox helper in new
+// namespaces with the given mkbox style arguments, mapping uid and
+// gid to our own user. Unless shareNetwork is set, the command gets a
+// network namespace with only loopback. shareNetwork should match the
+// -n option in args.
+func userNSCommand(args []string, uid, gid int, shareNetwork bool) *exec.Cmd {
+	cmd := &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: append([]string{sandboxArgv0}, args...),
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: uid, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: gid, HostID: os.Getgid(), Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+
+		// We are not uid 0 inside the namespace, so we need
+		// ambient capabilities to keep mount and network
+		// privileges across exec of the helper.
+		AmbientCaps: []uintptr{capSysAdmin, capNetAdmin},
+	}
+	if !shareNetwork {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	return cmd
+}
+
+const stRelatime = 0x1000
+
+var mountPathUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// parseMountFlags returns the flags of the mount at the absolute
+// path, from the contents of /proc/self/mountinfo.
+func parseMountFlags(mountinfo string, path string) (uintptr, error) {
+	var flags uintptr
+	found := false
+	for _, line := range strings.Split(mountinfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || mountPathUnescaper.Replace(fields[4]) != path {
+			continue
+		}
+		// The last mount on path is the one we see.
+		found = true
+		flags = 0
+		for _, o := range strings.Split(fields[5], ",") {
+			switch o {
+			case "nosuid":
+				flags |= syscall.MS_NOSUID
+			case "nodev":
+				flags |= syscall.MS_NODEV
+			case "noexec":
+				flags |= syscall.MS_NOEXEC
+			case "noatime":
+				flags |= syscall.MS_NOATIME
+			case "nodiratime":
+				flags |= syscall.MS_NODIRATIME
+			case "relatime":
+				flags |= syscall.MS_RELATIME
+			}
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("no mount on %s", path)
+	}
+	return flags, nil
+}
+
+// readonlyRemountFlags returns the flags for remounting path read-only.
+// In a user namespace, we can't drop flags of mounts inherited from
+// the parent namespace, so we keep those and the atime setting. They
+// come from mountinfo, since FUSE file systems may not implement
+// statfs.
+func readonlyRemountFlags(path string) uintptr {
+	var flags uintptr = syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_REMOUNT | syscall.MS_BIND
+	if abs, err := filepath.Abs(path); err == nil {
+		if mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo"); err == nil {
+			if f, err := parseMountFlags(string(mountinfo), abs); err == nil {
+				return flags | f
+			}
+		}
+	}
+
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &st); err != nil {
+		return flags | syscall.MS_NOATIME
+	}
+
+	// The ST_ constants have the same values as the MS_ ones,
+	// except for relatime.
+	flags |= uintptr(st.Flags) & (syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if st.Flags&stRelatime != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	return flags
+}
+
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// loopbackUp brings up the loopback interface in a new network
+// namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	req := ifreqFlags{}
+	copy(req.name[:], "lo")
+	if _, _, errNo := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errNo != 0 {
+		return errNo
+	}
+	req.flags |= syscall.IFF_UP
+	if _, _, errNo := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errNo != 0 {
+		return errNo
+	}
+	return nil
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+func dropCaps() error {
+	if _, _, errNo := syscall.RawSyscall6(syscall.SYS_PRCTL,
+		prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errNo != 0 {
+		return fmt.Errorf("prctl(PR_CAP_AMBIENT_CLEAR_ALL): %v", errNo)
+	}
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{}
+	if _, _, errNo := syscall.RawSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errNo != 0 {
+		return fmt.Errorf("capset: %v", errNo)
+	}
+	return nil
+}
+
+// runSandbox sets up the sandbox like termite-mkbox does, and execs
+// the binary. The process should already be in new user and mount
+// namespaces, with the uid and gid mapped by the parent. Only returns
+// on error.
+func runSandbox(args []string) error {
+	// Capabilities are per thread; make sure we exec from the
+	// thread where we dropped them.
+	runtime.LockOSThread()
+
+	verbose := true
+	shareNetwork := false
+	rootSet := false
+	probe := false
+	binary := ""
+	childDir := ""
+	tmpSize := ""
+
+	i := 0
+	for ; i < len(args); i++ {
+		opt := args[i]
+		if !strings.HasPrefix(opt, "-") || len(opt) != 2 {
+			break
+		}
+		arg := ""
+		if strings.IndexByte("bBdDgLrstTu", opt[1]) >= 0 {
+			if i+1 >= len(args) {
+				return fmt.Errorf("option %s needs an argument", opt)
+			}
+			i++
+			arg = args[i]
+		}
+
+		switch opt[1] {
+		case 'q':
+			verbose = false
+		case 'n':
+			shareNetwork = true
+		case 'P':
+			probe = true
+		case 's':
+			// Don't leak our mounts to the outside namespace.
+			syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+			if err := syscall.Mount(arg, arg, "", syscall.MS_BIND|syscall.MS_NOSUID, ""); err != nil {
+				return fmt.Errorf("bind %s: %v", arg, err)
+			}
+			if err := os.Chdir(arg); err != nil {
+				return err
+			}
+			rootSet = true
+		case 'B':
+			binary = arg
+		case 'b':
+			eq := strings.Index(arg, "=")
+			if eq < 0 {
+				return fmt.Errorf("argument must have '=': %s", arg)
+			}
+			src, dst := arg[:eq], arg[eq+1:]
+			if verbose {
+				fmt.Fprintf(os.Stderr, "mount: %s => %s\n", src, dst)
+			}
+			fi, err := os.Stat(src)
+			if err != nil {
+				return err
+			}
+			var flags uintptr = syscall.MS_BIND
+			if fi.IsDir() {
+				if _, err := os.Lstat(dst); err != nil {
+					if err := os.Mkdir(dst, 0755); err != nil {
+						return err
+					}
+				}
+				flags |= syscall.MS_REC
+			} else {
+				f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, 0666)
+				if err != nil {
+					return err
+				}
+				f.Close()
+			}
+			if err := syscall.Mount(src, dst, "", flags, ""); err != nil {
+				return fmt.Errorf("bind %s: %v", arg, err)
+			}
+		case 't':
+			if verbose {
+				fmt.Fprintf(os.Stderr, "tmp: %s\n", arg)
+			}
+			if _, err := os.Lstat(arg); err != nil {
+				if err := os.Mkdir(arg, 0755); err != nil {
+					return err
+				}
+			}
+			opts := "size=64k,nr_inodes=16,mode=755"
+			if tmpSize != "" {
+				opts = "size=" + tmpSize + ",mode=755"
+				tmpSize = ""
+			}
+			if err := syscall.Mount("sandbox-dev", arg, "tmpfs",
+				syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_NOATIME,
+				opts); err != nil {
+				return fmt.Errorf("tmpfs %s: %v", arg, err)
+			}
+		case 'T':
+			tmpSize = arg
+		case 'r':
+			if err := syscall.Mount(arg, arg, "", readonlyRemountFlags(arg), ""); err != nil {
+				return fmt.Errorf("remount %s readonly: %v", arg, err)
+			}
+		case 'u', 'g':
+			// Mapped by userNSCommand already.
+			if _, err := strconv.Atoi(arg); err != nil {
+				return fmt.Errorf("could not parse %s", arg)
+			}
+		case 'd':
+			childDir = arg
+		case 'D':
+			if err := os.Mkdir(arg, 0755); err != nil {
+				return err
+			}
+		case 'L':
+			eq := strings.Index(arg, "=")
+			if eq < 0 {
+				return fmt.Errorf("argument must have '=': %s", arg)
+			}
+			if err := os.Symlink(arg[:eq], arg[eq+1:]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("option %s unknown", opt)
+		}
+	}
+	argv := args[i:]
+
+	if !shareNetwork {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("loopback: %v", err)
+		}
+	}
+
+	if !rootSet {
+		return fmt.Errorf("-s option is mandatory")
+	}
+
+	// The sandbox becomes our new root. Stacking the old root on
+	// top of it and detaching that leaves no directory behind in
+	// the sandbox, which may hold the reaped tree.
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %v", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("umount old root: %v", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("/", "/", "", readonlyRemountFlags("/"), ""); err != nil {
+		return fmt.Errorf("remount / readonly: %v", err)
+	}
+	if childDir != "" {
+		if err := os.Chdir(childDir); err != nil {
+			return err
+		}
+	}
+
+	if err := dropCaps(); err != nil {
+		return err
+	}
+	if probe {
+		os.Exit(0)
+	}
+	if len(argv) == 0 {
+		return fmt.Errorf("no command")
+	}
+	if binary == "" {
+		binary = argv[0]
+	}
+	return syscall.Exec(binary, argv, os.Environ())
+}
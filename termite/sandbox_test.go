@@ -0,0 +1,78 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestMain lets the test binary act as the userns sandbox helper,
+// which is started as /proc/self/exe.
+func TestMain(m *testing.M) {
+	MaybeRunSandbox()
+	os.Exit(m.Run())
+}
+
+func skipWithoutUserNS(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "termite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = probeUserNS(tmp)
+	os.RemoveAll(tmp)
+	if err != nil {
+		t.Skipf("userns sandbox unsupported: %v", err)
+	}
+}
+
+func TestEndToEndUserNS(t *testing.T) {
+	skipWithoutUserNS(t)
+	tc := newSandboxTestCase(t, SandboxUserNS)
+	defer tc.Clean()
+
+	rep := tc.RunSuccess(WorkRequest{
+		Argv: []string{"/bin/sh", "-c", "id -u > output.txt; ls -a /"},
+	})
+	if strings.Contains(rep.Stdout, ".oldroot") {
+		t.Errorf("old root left in the sandbox: %q", rep.Stdout)
+	}
+	content, err := ioutil.ReadFile(tc.wd + "/output.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(content)); got != strconv.Itoa(sandboxUid) {
+		t.Errorf("got uid %q, want %d", got, sandboxUid)
+	}
+}
+
+func TestEndToEndReadOnlyKeepsMasterTree(t *testing.T) {
+	skipWithoutUserNS(t)
+	tc := newSandboxTestCase(t, SandboxUserNS)
+	defer tc.Clean()
+	// The policy is read when the master first connects.
+	tc.workers[0].options.MountPolicy.ReadOnly = []string{"/usr/share"}
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"/bin/sh", "-c", "ls /usr/bin/env && ls /usr/share/ > /dev/null"},
+	})
+}
+
+func TestParseMountFlags(t *testing.T) {
+	mountinfo := `28 1 254:0 / / rw,relatime - ext4 /dev/vda rw
+47 28 0:43 / /tmp/my\040mnt rw,nosuid,nodev,relatime - fuse.termite termite rw,user_id=0
+48 47 0:44 / /tmp/my\040mnt rw,nosuid,noexec,noatime - tmpfs tmpfs rw
+`
+	got, err := parseMountFlags(mountinfo, "/tmp/my mnt")
+	if want := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NOATIME); err != nil || got != want {
+		t.Errorf("got %x, %v; want %x", got, err, want)
+	}
+	if got, err := parseMountFlags(mountinfo, "/"); err != nil || got != syscall.MS_RELATIME {
+		t.Errorf("got %x, %v for /", got, err)
+	}
+	if _, err := parseMountFlags(mountinfo, "/tmp"); err == nil {
+		t.Error("found flags for a directory that is not a mount")
+	}
+}
@@ -0,0 +1,244 @@
+package termite
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A build session groups the tasks of one build, eg. one termite-make
+// invocation. The shell-wrapper takes the id from $TERMITE_SESSION.
+// Requests without one belong to the default session "".
+
+// Sessions without tasks are forgotten after this long.
+const sessionExpiry = time.Hour
+
+type session struct {
+	id          string
+	start       time.Time
+	analysisDir string
+
+	// If positive, at most this many tasks run at once.
+	maxJobs int
+
+	// Protected by sessions.mu.
+	lastActive time.Time
+	waiting    int
+	done       int
+	failed     int
+	cancelled  bool
+
+	// Running tasks by task id, and the mirror they run on, or nil
+	// if they have not been placed yet, or run on a backend.
+	running map[int]*mirrorConnection
+}
+
+type sessions struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	byId map[string]*session
+}
+
+func newSessions() *sessions {
+	s := &sessions{byId: map[string]*session{}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// session returns the session for a request, creating it if needed.
+func (m *Master) session(req *WorkRequest) *session {
+	ss := m.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s := ss.byId[req.Session]; s != nil {
+		s.lastActive = time.Now()
+		return s
+	}
+
+	now := time.Now()
+	s := &session{
+		id:         req.Session,
+		start:      now,
+		lastActive: now,
+		maxJobs:    req.SessionJobs,
+		running:    map[int]*mirrorConnection{},
+	}
+	if s.id != "" && m.options.AnalysisDir != "" {
+		d := filepath.Join(m.options.AnalysisDir,
+			now.Format(time.RFC3339)+"-"+strings.Replace(s.id, "/", "_", -1))
+		if err := os.MkdirAll(d, 0755); err != nil {
+			log.Printf("Analyze mkdir failed for session %q: %v", s.id, err)
+		} else {
+			s.analysisDir = d
+		}
+	}
+	ss.byId[s.id] = s
+	return s
+}
+
+// acquire waits for a job slot of the session for the task.
+func (ss *sessions) acquire(s *session, taskId int) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s.waiting++
+	for !s.cancelled && s.maxJobs > 0 && len(s.running) >= s.maxJobs {
+		ss.cond.Wait()
+	}
+	s.waiting--
+	if s.cancelled {
+		s.settle()
+		return fmt.Errorf("session %q was cancelled", s.id)
+	}
+	s.running[taskId] = nil
+	s.lastActive = time.Now()
+	return nil
+}
+
+// release ends a task of the session.
+func (ss *sessions) release(s *session, taskId int, failed bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(s.running, taskId)
+	s.done++
+	if failed {
+		s.failed++
+	}
+	s.lastActive = time.Now()
+	s.settle()
+	ss.cond.Broadcast()
+}
+
+// settle ends the cancellation once all tasks of the session have
+// stopped, so a later build can reuse the session id. Must hold
+// sessions.mu.
+func (s *session) settle() {
+	if s.cancelled && len(s.running) == 0 && s.waiting == 0 {
+		s.cancelled = false
+	}
+}
+
+// place records the mirror a task runs on, for cancellation.
+func (ss *sessions) place(id string, taskId int, mirror *mirrorConnection) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s := ss.byId[id]; s != nil {
+		if _, ok := s.running[taskId]; ok {
+			s.running[taskId] = mirror
+		}
+	}
+}
+
+// cancelled returns whether the session was cancelled.
+func (ss *sessions) cancelled(id string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s := ss.byId[id]
+	return s != nil && s.cancelled
+}
+
+// cancel makes waiting and new tasks of the session fail until its
+// running tasks have stopped, and returns them by mirror.
+func (ss *sessions) cancel(id string) (map[*mirrorConnection][]int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s := ss.byId[id]
+	if s == nil {
+		return nil, fmt.Errorf("no session %q", id)
+	}
+	s.cancelled = true
+	s.settle()
+	ss.cond.Broadcast()
+
+	tasks := map[*mirrorConnection][]int{}
+	for taskId, mirror := range s.running {
+		if mirror != nil {
+			tasks[mirror] = append(tasks[mirror], taskId)
+		}
+	}
+	return tasks, nil
+}
+
+// placeTask records the mirror a task runs on. If the session was
+// cancelled before, the task could not be killed, so it fails instead,
+// returning its job slot.
+func (m *Master) placeTask(req *WorkRequest, mirror *mirrorConnection) error {
+	m.sessions.place(req.Session, req.TaskId, mirror)
+	if m.sessions.cancelled(req.Session) {
+		m.mirrors.jobDone(mirror)
+		return fmt.Errorf("session %q was cancelled", req.Session)
+	}
+	return nil
+}
+
+// busy returns whether any session has running or waiting tasks.
+func (ss *sessions) busy() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, s := range ss.byId {
+		if len(s.running) > 0 || s.waiting > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// expire forgets sessions that have been idle for sessionExpiry.
+func (ss *sessions) expire(now time.Time) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for id, s := range ss.byId {
+		if len(s.running) == 0 && s.waiting == 0 && now.Sub(s.lastActive) > sessionExpiry {
+			delete(ss.byId, id)
+		}
+	}
+}
+
+// status lists the sessions, most recently started first.
+func (ss *sessions) status() []SessionStatus {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var result []SessionStatus
+	for _, s := range ss.byId {
+		result = append(result, SessionStatus{
+			Id:          s.id,
+			Start:       s.start,
+			LastActive:  s.lastActive,
+			AnalysisDir: s.analysisDir,
+			MaxJobs:     s.maxJobs,
+			Running:     len(s.running),
+			Waiting:     s.waiting,
+			Done:        s.done,
+			Failed:      s.failed,
+			Cancelled:   s.cancelled,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.After(result[j].Start)
+	})
+	return result
+}
+
+// CancelSession stops the tasks of a session. Tasks that run on a
+// backend are not stopped, but their session still fails.
+func (m *Master) CancelSession(id string) (int, error) {
+	tasks, err := m.sessions.cancel(id)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Cancelling session %q", id)
+	killed := 0
+	for mirror, ids := range tasks {
+		rep := CancelResponse{}
+		if err := mirror.rpcClient.Call("Mirror.Cancel", &CancelRequest{TaskIds: ids}, &rep); err != nil {
+			log.Printf("Mirror.Cancel on %s: %v", mirror.workerAddr, err)
+			continue
+		}
+		killed += rep.Killed
+	}
+	return killed, nil
+}
@@ -0,0 +1,114 @@
+package termite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionJobLimit(t *testing.T) {
+	m := &Master{options: &MasterOptions{}, sessions: newSessions()}
+	s := m.session(&WorkRequest{Session: "a", SessionJobs: 1})
+	if other := m.session(&WorkRequest{Session: "a", SessionJobs: 5}); other != s || s.maxJobs != 1 {
+		t.Fatalf("got session %v, max jobs %d", other, s.maxJobs)
+	}
+
+	if err := m.sessions.acquire(s, 1); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	acquired := make(chan error, 1)
+	go func() { acquired <- m.sessions.acquire(s, 2) }()
+	select {
+	case <-acquired:
+		t.Fatal("second task ran beyond the job limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m.sessions.release(s, 1, true)
+	if err := <-acquired; err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	m.sessions.release(s, 2, false)
+
+	st := m.sessions.status()
+	if len(st) != 1 || st[0].Done != 2 || st[0].Failed != 1 || st[0].Running != 0 {
+		t.Errorf("got status %+v", st)
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	m := &Master{options: &MasterOptions{}, sessions: newSessions()}
+	s := m.session(&WorkRequest{Session: "b", SessionJobs: 1})
+	m.sessions.acquire(s, 1)
+	m.sessions.place("b", 1, &mirrorConnection{workerAddr: "w"})
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- m.sessions.acquire(s, 2) }()
+	time.Sleep(10 * time.Millisecond)
+
+	tasks, err := m.sessions.cancel("b")
+	if err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if len(tasks) != 1 {
+		t.Errorf("got running tasks %v", tasks)
+	}
+	if err := <-acquired; err == nil {
+		t.Error("waiting task of cancelled session was started")
+	}
+	if !m.sessions.cancelled("b") || m.sessions.cancelled("") {
+		t.Error("cancelled() mismatch")
+	}
+	if err := m.sessions.acquire(s, 3); err == nil {
+		t.Error("new task of cancelled session was started")
+	}
+
+	// Once the killed task stopped, the session can be reused.
+	m.sessions.release(s, 1, true)
+	if m.sessions.cancelled("b") {
+		t.Error("session still cancelled after its tasks stopped")
+	}
+	if err := m.sessions.acquire(s, 4); err != nil {
+		t.Errorf("acquire after cancellation: %v", err)
+	}
+	if _, err := m.sessions.cancel("c"); err == nil {
+		t.Error("cancelling unknown session succeeded")
+	}
+}
+
+func TestMasterPlaceTask(t *testing.T) {
+	mc := &mirrorConnection{workerAddr: "w", maxJobs: 1}
+	m := &Master{
+		options:  &MasterOptions{},
+		sessions: newSessions(),
+		mirrors:  &mirrorConnections{mirrors: map[string]*mirrorConnection{"w": mc}},
+	}
+	s := m.session(&WorkRequest{Session: "b"})
+	m.sessions.acquire(s, 1)
+	m.sessions.acquire(s, 2)
+	if err := m.placeTask(&WorkRequest{Session: "b", TaskId: 1}, mc); err != nil {
+		t.Fatalf("placeTask: %v", err)
+	}
+
+	// Cancelled between pick and place: the task fails, and gives
+	// back its job slot.
+	m.sessions.cancel("b")
+	if err := m.placeTask(&WorkRequest{Session: "b", TaskId: 2}, mc); err == nil {
+		t.Error("task of cancelled session was placed")
+	}
+	if mc.availableJobs != 1 {
+		t.Errorf("got %d available jobs, want 1", mc.availableJobs)
+	}
+}
+
+func TestSessionExpire(t *testing.T) {
+	m := &Master{options: &MasterOptions{}, sessions: newSessions()}
+	busy := m.session(&WorkRequest{Session: "busy"})
+	m.session(&WorkRequest{Session: "idle"})
+	m.sessions.acquire(busy, 1)
+
+	m.sessions.expire(time.Now().Add(2 * sessionExpiry))
+	st := m.sessions.status()
+	if len(st) != 1 || st[0].Id != "busy" {
+		t.Errorf("got %+v", st)
+	}
+}
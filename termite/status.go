@@ -28,7 +28,8 @@ func (w *Worker) Status(req *WorkerStatusRequest, rep *WorkerStatusResponse) err
 	// TODO - pass WorkerOptions out.
 	rep.MaxJobCount = w.options.Jobs
 	rep.Version = Version()
-	rep.Accepting = w.accepting
+	rep.Accepting, rep.Draining = w.state()
+	rep.Sandbox = w.sandbox
 	rep.CpuStats = w.stats.CpuStats()
 	rep.DiskStats = w.stats.DiskStats()
 	rep.PhaseCounts = w.stats.PhaseCounts()
@@ -9,8 +9,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/termite/attr"
 	"github.com/hanwen/termite/fastpath"
@@ -21,15 +25,39 @@ type WorkerTask struct {
 	rep       *WorkResponse
 	stdinConn io.ReadWriteCloser
 	mirror    *Mirror
-	cmd       *exec.Cmd
 	taskInfo  string
+
+	// Protects process and killed, as Kill is called from
+	// Mirror.Cancel and timers while the task starts.
+	mu      sync.Mutex
+	process *os.Process
+	killed  bool
 }
 
 func (t *WorkerTask) Kill() {
-	if t.cmd.Process != nil {
-		pid := t.cmd.Process.Pid
-		err := syscall.Kill(pid, syscall.SIGQUIT)
-		log.Printf("Killed pid %d, result %v", pid, err)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.killed = true
+	if t.process != nil {
+		t.signal()
+	}
+}
+
+// signal kills the started process. Must hold t.mu.
+func (t *WorkerTask) signal() {
+	pid := t.process.Pid
+	err := syscall.Kill(pid, syscall.SIGQUIT)
+	log.Printf("Killed pid %d, result %v", pid, err)
+}
+
+// started records the task's process, and kills it if the task was
+// killed before it started.
+func (t *WorkerTask) started(p *os.Process) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.process = p
+	if t.killed {
+		t.signal()
 	}
 }
 
@@ -59,13 +87,14 @@ func (t *WorkerTask) Run() error {
 
 	t.mirror.worker.stats.Enter("reap")
 	if t.mirror.considerReap(fsState, t) {
-		t.rep.FileSet, t.rep.TaskIds, t.rep.Reads = t.mirror.reapFuse(fsState)
+		t.rep.FileSet, t.rep.TaskIds, t.rep.Reads, t.rep.ExternalReads = t.mirror.reapFuse(fsState)
 	} else {
 		t.mirror.returnFS(fsState)
 	}
 	if !t.req.TrackReads {
 		// TODO - don't even collect this data if TrackReads is unset.
 		t.rep.Reads = nil
+		t.rep.ExternalReads = nil
 	}
 	t.mirror.worker.stats.Exit("reap")
 
@@ -82,32 +111,91 @@ func (t *WorkerTask) runInFuse(state *workerFSState) error {
 		return err
 	}
 
-	args := []string{t.mirror.worker.options.Mkbox,
+	entries, code := state.fs.fuseFS.rpcFS.OpenDir("", nil)
+	if !code.Ok() {
+		return fmt.Errorf("OpenDir: %v", code)
+	}
+
+	policy := t.mirror.mountPolicy
+	hidden := policy.hidden()
+
+	// Top-level directories, and where they come from.
+	rootDir := state.fs.fuseFS.mount
+	if t.req.TrackReads {
+		rootDir = filepath.Join(rootDir, state.fs.rootMount)
+	}
+	sources := map[string]string{}
+	for _, e := range entries {
+		if !hidden[e.Name] {
+			sources[e.Name] = filepath.Join(rootDir, e.Name)
+		}
+	}
+	if t.req.RootImageHash != "" {
+		imageDir, err := t.mirror.worker.images.get(t.req.RootImageHash, func() error {
+			_, err := t.mirror.rpcFs.contentClient.FetchOnce(t.req.RootImageHash, t.req.RootImageSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		imageEntries, err := ioutil.ReadDir(imageDir)
+		if err != nil {
+			return err
+		}
+
+		// Only the directory holding the writable root comes
+		// from the master.
+		wrTop := strings.Split(state.fs.fuseFS.writableRoot, "/")[0]
+		for name := range sources {
+			if name != wrTop {
+				delete(sources, name)
+			}
+		}
+		for _, e := range imageEntries {
+			if !hidden[e.Name()] && e.Name() != wrTop {
+				sources[e.Name()] = filepath.Join(imageDir, e.Name())
+			}
+		}
+	}
+	var exported []string
+	for name := range sources {
+		exported = append(exported, name)
+	}
+	sort.Strings(exported)
+
+	sb := newSandboxArgs(append(exported, sandboxBaseDirs...))
+	sb.add(
 		"-q",
 		"-B", t.req.Binary,
 		"-s", dir,
 		"-b", "/sys=sys",
 		"-b", "/proc=proc",
 		"-t", "dev",
-		"-b", "/dev/null=dev/null",
-		"-b", "/dev/zero=dev/zero",
-		"-b", "/dev/urandom=dev/urandom", // maybe should use zero for determinism?
+	)
+	for _, d := range policy.Devices {
+		if t.req.Reproducible && (d == "/dev/urandom" || d == "/dev/random") {
+			continue
+		}
+		sb.bind(d)
 	}
-
-	entries, code := state.fs.fuseFS.rpcFS.OpenDir("", nil)
-	if !code.Ok() {
-		return fmt.Errorf("OpenDir: %v", code)
+	if t.req.Reproducible {
+		random, unmount, err := mountRandom(t.mirror.worker.options.TempDir, t.req.RandomSeed)
+		if err != nil {
+			return err
+		}
+		defer unmount()
+		sb.add("-b", random+"=dev/urandom",
+			"-b", random+"=dev/random")
 	}
 
 	// We can't mount root directly, so we mount the subdirs of the root.
-	for _, e := range entries {
-		if e.Name == "proc" || e.Name == "sys" || e.Name == "dev" || e.Name == "tmp" ||
-			e.Name == "lost+found" || e.Name == "root" {
-			continue
+	for _, name := range exported {
+		sb.bindAt(sources[name], name, true)
+	}
+	for _, ro := range policy.ReadOnly {
+		if err := sb.readOnly(ro); err != nil {
+			return err
 		}
-		args = append(args, "-b", fmt.Sprintf("/%s=%s", filepath.Join(
-			state.fs.fuseFS.mount, e.Name), e.Name),
-			"-r", e.Name)
 	}
 
 	wrRootMount := fmt.Sprintf("/%s=%s",
@@ -116,34 +204,49 @@ func (t *WorkerTask) runInFuse(state *workerFSState) error {
 
 	// setup the writable root.
 	if strings.HasPrefix(state.fs.fuseFS.writableRoot, "tmp") {
-		// we're in a test: use the system's /tmp dir
-		args = append(args,
+		// we're in a test: use the system's /tmp dir, and
+		// ignore the tmpfs mounts of the policy.
+		sb.add(
 			"-b", "/tmp=tmp",
 			"-b", "/var/tmp=var/tmp",
 			"-b", wrRootMount)
 	} else {
-		args = append(args,
-			"-b", wrRootMount,
-			// temp dirs must be last, because they might hold the
-			// FUSE mountpoint and we don't want to hide that.
-			"-t", "tmp",
-			"-t", "var/tmp")
+		sb.add("-b", wrRootMount)
+		// temp dirs must be last, because they might hold the
+		// FUSE mountpoint and we don't want to hide that.
+		for _, tmp := range policy.Tmpfs {
+			sb.tmpfs(tmp)
+		}
 	}
+	args := sb.args
 
 	args = append(args,
 		"-d", t.req.Dir,
-		"-u", "3333",
-		"-g", "3333",
+		"-u", strconv.Itoa(sandboxUid),
+		"-g", strconv.Itoa(sandboxGid),
 		"-r", "/dev",
 		"-r", "/sys",
 	)
 
+	shareNetwork := t.mirror.worker.options.ShareNetwork
+	if t.req.ShareNetwork != nil {
+		shareNetwork = *t.req.ShareNetwork
+	}
+	if shareNetwork {
+		args = append(args, "-n")
+	}
+
 	args = append(args, t.req.Argv...)
-	t.cmd = &exec.Cmd{
-		Path: args[0],
-		Args: args,
+	var cmd *exec.Cmd
+	if t.mirror.worker.sandbox == SandboxUserNS {
+		cmd = userNSCommand(args, sandboxUid, sandboxGid, shareNetwork)
+	} else {
+		args = append([]string{t.mirror.worker.options.Mkbox}, args...)
+		cmd = &exec.Cmd{
+			Path: args[0],
+			Args: args,
+		}
 	}
-	cmd := t.cmd
 	cmd.Env = t.req.Env
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
@@ -151,9 +254,56 @@ func (t *WorkerTask) runInFuse(state *workerFSState) error {
 		cmd.Stdin = t.stdinConn
 	}
 
-	if err := cmd.Start(); err != nil {
+	var pty, tty *os.File
+	if t.req.Terminal != nil {
+		pty, tty, err = openPty(t.req.Terminal)
+		if err != nil {
+			return err
+		}
+		defer pty.Close()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+	}
+
+	err = cmd.Start()
+	if tty != nil {
+		tty.Close()
+	}
+	if err != nil {
 		return err
 	}
+	t.started(cmd.Process)
+
+	// Output on a terminal is streamed back over the stdin
+	// connection if there is one.
+	// Otherwise it is collected in termOut, which background
+	// processes may still write to after we read it.
+	var ptyDone chan struct{}
+	var termOut *lockedBuffer
+	if pty != nil {
+		ptyDone = make(chan struct{})
+		var out io.Writer
+		if t.stdinConn != nil {
+			out = t.stdinConn
+			go io.Copy(pty, t.stdinConn)
+		} else {
+			termOut = &lockedBuffer{}
+			out = termOut
+		}
+		go func() {
+			// Fails with EIO once the task closed the terminal.
+			io.Copy(out, pty)
+			close(ptyDone)
+		}()
+	}
+	var timer *time.Timer
+	if t.req.Timeout > 0 {
+		timer = time.AfterFunc(t.req.Timeout, t.Kill)
+	}
 	printCmd := fmt.Sprintf("%v", cmd.Args)
 	if t.req.Debug {
 		printCmd = fmt.Sprintf("%v", cmd)
@@ -161,11 +311,20 @@ func (t *WorkerTask) runInFuse(state *workerFSState) error {
 	t.taskInfo = fmt.Sprintf("%v, dir %v, fuse FS %v",
 		printCmd, cmd.Dir, state.fs.id)
 	err = cmd.Wait()
+	timedOut := timer != nil && !timer.Stop()
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		t.rep.Exit = exitErr.Sys().(syscall.WaitStatus)
 		err = nil
 	}
 
+	if ptyDone != nil {
+		// Background processes may keep the terminal open.
+		select {
+		case <-ptyDone:
+		case <-time.After(time.Second):
+		}
+	}
+
 	// No waiting: if the process exited, we kill the connection.
 	if t.stdinConn != nil {
 		t.stdinConn.Close()
@@ -173,14 +332,26 @@ func (t *WorkerTask) runInFuse(state *workerFSState) error {
 
 	// We could use a connection here too, but this is simpler.
 	t.rep.Stdout = stdout.String()
+	if termOut != nil {
+		t.rep.Stdout = termOut.String()
+	}
 	t.rep.Stderr = stderr.String()
+	if timedOut {
+		t.rep.Stderr += fmt.Sprintf("termite: killed after timeout of %v\n", t.req.Timeout)
+	}
+	if !shareNetwork && t.rep.Exit.ExitStatus() != 0 {
+		t.rep.NetworkError = networkError(t.rep.Stderr)
+		if t.rep.NetworkError != "" {
+			t.rep.Stderr += t.rep.NetworkError + "\n"
+		}
+	}
 
 	return err
 }
 
 // fillReply empties the unionFs and hashes files as needed.  It will
 // return the FS back the pool as soon as possible.
-func (t *Mirror) fillReply(state *workerFSState) (*attr.FileSet, []string) {
+func (t *Mirror) fillReply(state *workerFSState) (*attr.FileSet, []string, []string) {
 	fsResult := state.fs.reap()
 	t.returnFS(state)
 
@@ -229,5 +400,5 @@ func (t *Mirror) fillReply(state *workerFSState) (*attr.FileSet, []string) {
 		log.Fatalf("fillReply: Remove failed: %v", err)
 	}
 
-	return &fset, fsResult.reads
+	return &fset, fsResult.reads, fsResult.externalReads
 }
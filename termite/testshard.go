@@ -0,0 +1,337 @@
+package termite
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// A test run splits the tests of one binary into shards, and runs
+// each shard as a separate task. The shards write JUnit XML, which
+// the master merges into one report.
+
+const defaultTestResultDir = ".termite-test-results"
+
+// shardFilters deals the filters round-robin over n shards, so the
+// same filters always give the same shards.
+func shardFilters(filters []string, n int) [][]string {
+	shards := make([][]string, n)
+	for i, f := range filters {
+		shards[i%n] = append(shards[i%n], f)
+	}
+	return shards
+}
+
+// shardResultFile returns the name of the JUnit XML of a shard.
+func shardResultFile(resultDir string, index int) string {
+	return filepath.Join(resultDir, fmt.Sprintf("shard-%d.xml", index))
+}
+
+// shardRequest returns the task for one shard.
+func shardRequest(req *TestRequest, index int, filters []string, resultDir string) *WorkRequest {
+	shard := &WorkRequest{
+		Binary:      req.Binary,
+		Argv:        append([]string{}, req.Argv...),
+		Env:         append([]string{}, req.Env...),
+		Dir:         req.Dir,
+		Debug:       req.Debug,
+		Session:     req.Session,
+		SessionJobs: req.SessionJobs,
+
+		// Shards sharing a file system would have their XML
+		// reaped with another shard's task.
+		Isolate: true,
+	}
+	if len(req.Filters) > 0 {
+		format := req.FilterFormat
+		if format == "" {
+			format = "--gtest_filter=%s"
+		}
+		sep := req.FilterSeparator
+		if sep == "" {
+			sep = ":"
+		}
+		shard.Argv = append(shard.Argv, fmt.Sprintf(format, strings.Join(filters, sep)))
+	} else {
+		// Let the test binary pick its part of the tests.
+		total := strconv.Itoa(req.Shards)
+		idx := strconv.Itoa(index)
+		shard.Env = append(shard.Env,
+			"TEST_TOTAL_SHARDS="+total, "TEST_SHARD_INDEX="+idx,
+			"GTEST_TOTAL_SHARDS="+total, "GTEST_SHARD_INDEX="+idx)
+	}
+
+	result := shardResultFile(resultDir, index)
+	shard.Env = append(shard.Env,
+		"XML_OUTPUT_FILE="+result, "GTEST_OUTPUT=xml:"+result)
+	return shard
+}
+
+// reapedFile returns the content of a file written by a task, or nil.
+func (m *Master) reapedFile(fset *attr.FileSet, name string) []byte {
+	if fset == nil {
+		return nil
+	}
+	name = strings.TrimLeft(name, "/")
+	for _, f := range fset.Files {
+		if f.Path != name || f.Deletion() || !f.IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(m.contentStore.Path(f.Hash))
+		if err != nil {
+			log.Printf("reading result %s: %v", name, err)
+			return nil
+		}
+		return content
+	}
+	return nil
+}
+
+// runInMaster runs a file command, such as rm or mkdir, in the
+// master.
+func (m *Master) runInMaster(dir string, argv ...string) error {
+	req := &WorkRequest{Binary: argv[0], Argv: argv, Dir: dir}
+	rep := &WorkResponse{}
+	if !m.MaybeRunInMaster(req, rep) {
+		return fmt.Errorf("cannot run %v in master", argv)
+	}
+	if rep.Exit != 0 {
+		return fmt.Errorf("%v: %s", argv, rep.Stderr)
+	}
+	return nil
+}
+
+// RunTests runs the shards of a test binary, at most MaxJobs at a
+// time, and merges their JUnit XML.
+func (m *Master) RunTests(req *TestRequest, rep *TestResponse) error {
+	if req.Shards <= 0 || (len(req.Filters) > 0 && req.Shards > len(req.Filters)) {
+		req.Shards = len(req.Filters)
+	}
+	if req.Shards <= 0 {
+		req.Shards = 1
+	}
+	resultDir := req.ResultDir
+	if resultDir == "" {
+		resultDir = defaultTestResultDir
+	}
+	if !filepath.IsAbs(resultDir) {
+		resultDir = filepath.Join(req.Dir, resultDir)
+	}
+	resultDir = filepath.Clean(resultDir)
+	if !under(resultDir, m.options.WritableRoot) {
+		return fmt.Errorf("result directory %s is outside the writable root %s", resultDir, m.options.WritableRoot)
+	}
+	if err := m.runInMaster("/", "mkdir", "-p", resultDir); err != nil {
+		return err
+	}
+
+	run := req.Only
+	if len(run) == 0 {
+		for i := 0; i < req.Shards; i++ {
+			run = append(run, i)
+		}
+	}
+	for _, i := range run {
+		if i < 0 || i >= req.Shards {
+			return fmt.Errorf("shard %d out of range; have %d shards", i, req.Shards)
+		}
+		// Don't mistake an old report for the result.
+		if err := m.runInMaster("/", "rm", "-f", shardResultFile(resultDir, i)); err != nil {
+			return err
+		}
+	}
+
+	parallel := m.options.MaxJobs
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots := make(chan bool, parallel)
+	filters := shardFilters(req.Filters, req.Shards)
+	rep.Shards = make([]TestShardResult, len(run))
+	var wg sync.WaitGroup
+	for k, i := range run {
+		wg.Add(1)
+		go func(result *TestShardResult, index int) {
+			defer wg.Done()
+			slots <- true
+			defer func() { <-slots }()
+
+			shard := shardRequest(req, index, filters[index], resultDir)
+			m.applyEnvPolicy(shard)
+			shardRep := &WorkResponse{}
+			start := time.Now()
+			err := m.run(shard, shardRep)
+
+			*result = TestShardResult{
+				Index:    index,
+				Filters:  filters[index],
+				Exit:     shardRep.Exit,
+				Failure:  shardRep.Failure,
+				WorkerId: shardRep.WorkerId,
+				Stdout:   shardRep.Stdout,
+				Stderr:   shardRep.Stderr,
+				Retries:  len(shardRep.Retries),
+				Duration: time.Now().Sub(start),
+				Report:   m.reapedFile(shardRep.FileSet, shardResultFile(resultDir, index)),
+			}
+			if err != nil {
+				result.Error = err.Error()
+				result.Failure = FailureInfra
+			}
+		}(&rep.Shards[k], i)
+	}
+	wg.Wait()
+
+	reports := make([][]byte, req.Shards)
+	ran := make([]*TestShardResult, req.Shards)
+	for k := range rep.Shards {
+		s := &rep.Shards[k]
+		ran[s.Index] = s
+		if s.Error != "" || s.Exit != 0 {
+			rep.Failed = append(rep.Failed, s.Index)
+		}
+	}
+	for i := range reports {
+		if s := ran[i]; s != nil {
+			reports[i] = s.Report
+			if reports[i] == nil {
+				reports[i] = shardSuite(s)
+			}
+			continue
+		}
+		// Not run now: take the report of an earlier run.
+		content, err := ioutil.ReadFile(shardResultFile(resultDir, i))
+		if err != nil {
+			content = shardSuite(&TestShardResult{
+				Index: i,
+				Error: "no report from an earlier run",
+			})
+		}
+		reports[i] = content
+	}
+
+	var err error
+	rep.Report, err = mergeJUnit(reports)
+	return err
+}
+
+type junitSuite struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// junitDoc is a <testsuites> or a <testsuite> document.
+type junitDoc struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr   `xml:",any,attr"`
+	Inner   string       `xml:",innerxml"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Attrs   []xml.Attr   `xml:",any,attr"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+// shardSuite returns a JUnit XML suite for a shard that wrote none,
+// with the shard as one test.
+func shardSuite(s *TestShardResult) []byte {
+	var buf bytes.Buffer
+	failures := 0
+	if s.Error != "" || s.Exit != 0 {
+		failures = 1
+	}
+	fmt.Fprintf(&buf, `<testsuite name="termite-shard-%d" tests="1" failures="%d" errors="0" time="%.3f">`,
+		s.Index, failures, s.Duration.Seconds())
+	fmt.Fprintf(&buf, `<testcase classname="termite" name="shard-%d">`, s.Index)
+	if failures > 0 {
+		msg := s.Error
+		if msg == "" {
+			msg = fmt.Sprintf("exit %v, no JUnit XML", s.Exit)
+		}
+		buf.WriteString(`<failure message="`)
+		xml.EscapeText(&buf, []byte(msg))
+		buf.WriteString(`">`)
+		xml.EscapeText(&buf, []byte(s.Stderr))
+		buf.WriteString(`</failure>`)
+	}
+	buf.WriteString(`</testcase></testsuite>`)
+	return buf.Bytes()
+}
+
+// mergeJUnit combines JUnit XML reports into one <testsuites>
+// document, with the counts summed. A report that doesn't parse is
+// replaced by a failed suite for its shard.
+func mergeJUnit(reports [][]byte) ([]byte, error) {
+	var suites []junitSuite
+	for i, r := range reports {
+		parsed, err := parseJUnit(r)
+		if err != nil {
+			parsed, _ = parseJUnit(shardSuite(&TestShardResult{
+				Index: i,
+				Error: fmt.Sprintf("bad JUnit XML: %v", err),
+			}))
+		}
+		suites = append(suites, parsed...)
+	}
+
+	counts := map[string]int{}
+	var seconds float64
+	for _, s := range suites {
+		for _, a := range s.Attrs {
+			switch a.Name.Local {
+			case "tests", "failures", "errors", "skipped", "disabled":
+				n, _ := strconv.Atoi(a.Value)
+				counts[a.Name.Local] += n
+			case "time":
+				f, _ := strconv.ParseFloat(a.Value, 64)
+				seconds += f
+			}
+		}
+	}
+
+	merged := junitSuites{}
+	for _, n := range []string{"tests", "failures", "errors", "skipped", "disabled"} {
+		merged.Attrs = append(merged.Attrs, xml.Attr{
+			Name:  xml.Name{Local: n},
+			Value: strconv.Itoa(counts[n]),
+		})
+	}
+	merged.Attrs = append(merged.Attrs, xml.Attr{
+		Name:  xml.Name{Local: "time"},
+		Value: strconv.FormatFloat(seconds, 'f', 3, 64),
+	})
+	merged.Suites = suites
+
+	out, err := xml.MarshalIndent(&merged, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// parseJUnit returns the test suites of a JUnit XML report.
+func parseJUnit(report []byte) ([]junitSuite, error) {
+	var doc junitDoc
+	if err := xml.Unmarshal(report, &doc); err != nil {
+		return nil, err
+	}
+	switch doc.XMLName.Local {
+	case "testsuites":
+		return doc.Suites, nil
+	case "testsuite":
+		return []junitSuite{{doc.XMLName, doc.Attrs, doc.Inner}}, nil
+	}
+	return nil, fmt.Errorf("unknown element <%s>", doc.XMLName.Local)
+}
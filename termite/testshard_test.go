@@ -0,0 +1,138 @@
+package termite
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestShardFilters(t *testing.T) {
+	got := shardFilters([]string{"A.*", "B.*", "C.*", "D.*", "E.*"}, 2)
+	want := [][]string{{"A.*", "C.*", "E.*"}, {"B.*", "D.*"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestShardRequest(t *testing.T) {
+	req := &TestRequest{
+		Binary:  "/bin/foo_test",
+		Argv:    []string{"foo_test", "-v"},
+		Dir:     "/src",
+		Filters: []string{"A.*", "B.*", "C.*"},
+		Shards:  2,
+	}
+	shard := shardRequest(req, 0, []string{"A.*", "C.*"}, "/src/results")
+	if want := []string{"foo_test", "-v", "--gtest_filter=A.*:C.*"}; !reflect.DeepEqual(shard.Argv, want) {
+		t.Errorf("got argv %v, want %v", shard.Argv, want)
+	}
+	if len(req.Argv) != 2 {
+		t.Errorf("request argv was changed: %v", req.Argv)
+	}
+	if !shard.Isolate {
+		t.Errorf("shard does not run in its own file system")
+	}
+	env := strings.Join(shard.Env, " ")
+	if !strings.Contains(env, "XML_OUTPUT_FILE=/src/results/shard-0.xml") ||
+		strings.Contains(env, "GTEST_TOTAL_SHARDS") {
+		t.Errorf("got env %v", shard.Env)
+	}
+
+	req.Filters = nil
+	shard = shardRequest(req, 1, nil, "/src/results")
+	env = strings.Join(shard.Env, " ")
+	if len(shard.Argv) != 2 || !strings.Contains(env, "GTEST_SHARD_INDEX=1") ||
+		!strings.Contains(env, "TEST_TOTAL_SHARDS=2") {
+		t.Errorf("got argv %v, env %v", shard.Argv, shard.Env)
+	}
+}
+
+func TestMergeJUnit(t *testing.T) {
+	reports := [][]byte{
+		[]byte(`<?xml version="1.0"?>
+<testsuites tests="2" failures="1">
+  <testsuite name="A" tests="2" failures="1" time="1.5">
+    <testcase name="a1"/>
+    <testcase name="a2"><failure message="boom">a2 &lt;failed&gt;</failure></testcase>
+  </testsuite>
+</testsuites>`),
+		[]byte(`<testsuite name="B" tests="1" failures="0" time="0.5"><testcase name="b1"/></testsuite>`),
+		shardSuite(&TestShardResult{
+			Index:  2,
+			Exit:   syscall.WaitStatus(syscall.SIGSEGV),
+			Stderr: "Segmentation fault <core dumped>",
+		}),
+	}
+	out, err := mergeJUnit(reports)
+	if err != nil {
+		t.Fatalf("mergeJUnit: %v", err)
+	}
+
+	var doc junitDoc
+	if err := xml.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("Unmarshal %s: %v", out, err)
+	}
+	attrs := map[string]string{}
+	for _, a := range doc.Attrs {
+		attrs[a.Name.Local] = a.Value
+	}
+	if attrs["tests"] != "4" || attrs["failures"] != "2" || attrs["time"] != "2.000" {
+		t.Errorf("got attributes %v", attrs)
+	}
+	if len(doc.Suites) != 3 {
+		t.Fatalf("got %d suites", len(doc.Suites))
+	}
+	if !strings.Contains(doc.Suites[0].Inner, "a2 &lt;failed&gt;") ||
+		!strings.Contains(doc.Suites[2].Inner, "Segmentation fault &lt;core dumped&gt;") {
+		t.Errorf("got %s", out)
+	}
+
+	// A bad report counts as a failed shard.
+	out, err = mergeJUnit([][]byte{reports[1], []byte("<html/>"), []byte("<testsuite")})
+	if err != nil {
+		t.Fatalf("mergeJUnit: %v", err)
+	}
+	doc = junitDoc{}
+	if err := xml.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("Unmarshal %s: %v", out, err)
+	}
+	if len(doc.Suites) != 3 || !strings.Contains(doc.Suites[1].Inner, "unknown element &lt;html&gt;") {
+		t.Errorf("got %s", out)
+	}
+	for _, a := range doc.Attrs {
+		if a.Name.Local == "failures" && a.Value != "2" {
+			t.Errorf("got %s failures, want 2", a.Value)
+		}
+	}
+}
+
+func TestEndToEndShardsOnOneWorker(t *testing.T) {
+	tc := newJobsTestCase(t, "", 2)
+	defer tc.Clean()
+
+	// The shards overlap, so they run on the worker together.
+	script := `sleep 1; echo "<testsuite name=\"shard$TEST_SHARD_INDEX\" tests=\"1\"></testsuite>" > $XML_OUTPUT_FILE`
+	req := &TestRequest{
+		Binary: tc.FindBin("sh"),
+		Argv:   []string{"/bin/sh", "-c", script},
+		Env:    testEnv(),
+		Dir:    tc.wd,
+		Shards: 2,
+	}
+	rep := &TestResponse{}
+	if err := tc.master.RunTests(req, rep); err != nil {
+		t.Fatalf("RunTests: %v", err)
+	}
+	for _, s := range rep.Shards {
+		if s.Exit != 0 || s.Report == nil {
+			t.Errorf("shard %d: exit %v, report %q, stderr %q", s.Index, s.Exit, s.Report, s.Stderr)
+		}
+	}
+	for _, name := range []string{"shard0", "shard1"} {
+		if !strings.Contains(string(rep.Report), name) {
+			t.Errorf("report misses %s: %s", name, rep.Report)
+		}
+	}
+}
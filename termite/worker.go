@@ -11,7 +11,9 @@ import (
 	"net/rpc"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hanwen/termite/cba"
@@ -28,9 +30,18 @@ type Worker struct {
 	stopListener   chan int
 	canRestart     bool
 	options        *WorkerOptions
-	accepting      bool
 	httpStatusPort int
 	mirrors        *WorkerMirrors
+
+	// The sandbox mode in use.
+	sandbox string
+
+	images *rootImages
+
+	// Protects accepting and draining.
+	stateMu   sync.Mutex
+	accepting bool
+	draining  bool
 }
 
 type User struct {
@@ -76,6 +87,22 @@ type WorkerOptions struct {
 
 	// full path to mkbox binary
 	Mkbox string
+
+	// If set, tasks use the network of the worker. Otherwise, they
+	// run in an empty network namespace with only loopback.
+	ShareNetwork bool
+
+	// What to mount in the sandbox. If nil, use
+	// DefaultMountPolicy().
+	MountPolicy *MountPolicy
+
+	// How to build the sandbox for tasks: SandboxMkbox or
+	// SandboxUserNS. If empty, probe for a mode that works.
+	Sandbox string
+
+	// How long to wait for masters to finish when draining,
+	// before shutting down anyway.
+	DrainTimeout time.Duration
 }
 
 func NewWorker(options *WorkerOptions) *Worker {
@@ -90,12 +117,28 @@ func NewWorker(options *WorkerOptions) *Worker {
 	if options.LameDuckPeriod == 0 {
 		options.LameDuckPeriod = 5 * time.Second
 	}
+	if options.DrainTimeout == 0 {
+		options.DrainTimeout = 30 * time.Minute
+	}
 
 	if fi, _ := os.Stat(options.TempDir); fi == nil || !fi.IsDir() {
 		log.Fatalf("directory %s does not exist, or is not a dir", options.TempDir)
 	}
 	// TODO - check that we can do renames from temp to cache.
 
+	sandbox, err := selectSandbox(options.Sandbox, options.Mkbox, options.TempDir)
+	if err != nil {
+		log.Fatalf("sandbox: %v", err)
+	}
+	log.Printf("using %s sandbox", sandbox)
+
+	if options.MountPolicy == nil {
+		options.MountPolicy = DefaultMountPolicy()
+	}
+	if errs := options.MountPolicy.check(nil); len(errs) > 0 {
+		log.Fatalf("mount policy: %s", strings.Join(errs, "; "))
+	}
+
 	timings := stats.NewTimerStats()
 	cache := cba.NewStore(&options.StoreOptions, timings)
 
@@ -106,15 +149,34 @@ func NewWorker(options *WorkerOptions) *Worker {
 		options:        &copied,
 		accepting:      true,
 		canRestart:     true,
+		sandbox:        sandbox,
 	}
-	w.stats.PhaseOrder = []string{"run", "fuse", "reap"}
+	w.stats.PhaseOrder = []string{"run", "prefetch", "fuse", "reap"}
 	w.mirrors = NewWorkerMirrors(w)
+	w.images = newRootImages(filepath.Join(options.TempDir, "termite-images"), cache)
 	w.stopListener = make(chan int, 1)
 	return w
 }
 
+// state returns whether the worker accepts new mirrors, and whether
+// it is draining.
+func (w *Worker) state() (accepting, draining bool) {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	return w.accepting, w.draining
+}
+
+func (w *Worker) stopAccepting() {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	w.accepting = false
+}
+
 func (w *Worker) PeriodicHouseholding() {
-	for w.accepting {
+	for {
+		if accepting, _ := w.state(); !accepting {
+			break
+		}
 		w.Report()
 		if w.options.HeapLimit > 0 {
 			heap := stats.GetMemStat().Total()
@@ -158,12 +220,34 @@ func (ws *WorkerService) Shutdown(req *ShutdownRequest, rep *ShutdownResponse) e
 	return w.Shutdown(req, rep)
 }
 
+func (ws *WorkerService) Drain(req *DrainRequest, rep *DrainResponse) error {
+	w := (*Worker)(ws)
+	return w.Drain(req, rep)
+}
+
 func (ws *WorkerService) Status(req *WorkerStatusRequest, rep *WorkerStatusResponse) error {
 	w := (*Worker)(ws)
 	return w.Status(req, rep)
 }
 
+func (w *Worker) address() string {
+	return fmt.Sprintf("%v:%d", cname, w.options.Port)
+}
+
 func (w *Worker) Report() {
+	_, draining := w.state()
+	req := RegistrationRequest{
+		Address:        w.address(),
+		Name:           fmt.Sprintf("%s:%d", Hostname, w.options.Port),
+		Version:        Version(),
+		HttpStatusPort: w.httpStatusPort,
+		MaxJobs:        w.options.Jobs,
+		Draining:       draining,
+	}
+	w.callCoordinator("Coordinator.Register", &req)
+}
+
+func (w *Worker) callCoordinator(method string, req interface{}) {
 	if w.options.Coordinator == "" {
 		return
 	}
@@ -172,22 +256,17 @@ func (w *Worker) Report() {
 		log.Println("dialing coordinator:", err)
 		return
 	}
+	defer client.Close()
 
-	req := RegistrationRequest{
-		Address:        fmt.Sprintf("%v:%d", cname, w.options.Port),
-		Name:           fmt.Sprintf("%s:%d", Hostname, w.options.Port),
-		Version:        Version(),
-		HttpStatusPort: w.httpStatusPort,
-	}
 	rep := Empty{}
-	err = client.Call("Coordinator.Register", &req, &rep)
+	err = client.Call(method, req, &rep)
 	if err != nil {
 		log.Println("coordinator rpc error:", err)
 	}
 }
 
 func (w *Worker) CreateMirror(req *CreateMirrorRequest, rep *CreateMirrorResponse) error {
-	if !w.accepting {
+	if accepting, _ := w.state(); !accepting {
 		return errors.New("Worker is shutting down.")
 	}
 	pending := w.listener.Pending()
@@ -195,7 +274,15 @@ func (w *Worker) CreateMirror(req *CreateMirrorRequest, rep *CreateMirrorRespons
 	revConn := pending.accept(req.RevRpcId)
 	contentConn := pending.accept(req.ContentId)
 	revContentConn := pending.accept(req.RevContentId)
-	mirror, err := w.mirrors.getMirror(rpcConn, revConn, contentConn, revContentConn, req.MaxJobCount, req.WritableRoot)
+
+	policy, err := w.options.MountPolicy.extend(req.MountPolicy)
+	if err != nil {
+		log.Printf("rejecting mirror for %s: %v", req.WritableRoot, err)
+	}
+	var mirror *Mirror
+	if err == nil {
+		mirror, err = w.mirrors.getMirror(rpcConn, revConn, contentConn, revContentConn, req.MaxJobCount, req.WritableRoot, policy)
+	}
 	if err != nil {
 		rpcConn.Close()
 		revConn.Close()
@@ -213,8 +300,12 @@ func (w *Worker) RunWorkerServer() {
 
 	_, portString, _ := net.SplitHostPort(listener.Addr().String())
 	fmt.Sscanf(portString, "%d", &w.options.Port)
+	// The reports carry the status port, so listen first.
+	statusListener := w.listenStatus(w.options.Port, w.options.PortRetry)
 	go w.PeriodicHouseholding()
-	go w.serveStatus(w.options.Port, w.options.PortRetry)
+	if statusListener != nil {
+		go w.serveStatus(statusListener)
+	}
 
 	w.listener = newWorkerListener(listener, w.options.Secret)
 
@@ -308,6 +399,44 @@ func (w *Worker) Shutdown(req *ShutdownRequest, rep *ShutdownResponse) error {
 	return nil
 }
 
+// Drain stops accepting new mirrors, and signals masters to stop
+// sending tasks. Once all masters have gone, the worker unregisters
+// from the coordinator and exits.
+func (w *Worker) Drain(req *DrainRequest, rep *DrainResponse) error {
+	log.Printf("Received Drain RPC")
+	w.stateMu.Lock()
+	if w.draining {
+		w.stateMu.Unlock()
+		return nil
+	}
+	if !w.accepting {
+		w.stateMu.Unlock()
+		return errors.New("Worker is shutting down.")
+	}
+	w.draining = true
+	w.accepting = false
+	w.stateMu.Unlock()
+
+	w.Report()
+	go w.waitDrained()
+	return nil
+}
+
+func (w *Worker) waitDrained() {
+	deadline := time.Now().Add(w.options.DrainTimeout)
+	for len(w.mirrors.mirrors()) > 0 {
+		if time.Now().After(deadline) {
+			log.Println("Drain timed out; shutting down remaining mirrors.")
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	log.Println("Drained; unregistering.")
+	w.callCoordinator("Coordinator.Unregister", &UnregisterRequest{Address: w.address()})
+	w.shutdown(false, false)
+}
+
 func (w *Worker) shutdown(restart bool, aggressive bool) {
 	if restart && w.canRestart {
 		w.canRestart = false
@@ -317,7 +446,7 @@ func (w *Worker) shutdown(restart bool, aggressive bool) {
 		// the new worker is up
 		time.Sleep(2 * time.Second)
 	}
-	w.accepting = false
+	w.stopAccepting()
 	go func() {
 		w.mirrors.shutdown(aggressive)
 
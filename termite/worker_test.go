@@ -75,6 +75,17 @@ func pickPort(t *testing.T) int {
 }
 
 func NewTestCase(t *testing.T) *testCase {
+	return newSandboxTestCase(t, "")
+}
+
+// newSandboxTestCase starts a worker with the given sandbox mode.
+func newSandboxTestCase(t *testing.T, sandbox string) *testCase {
+	return newJobsTestCase(t, sandbox, 1)
+}
+
+// newJobsTestCase starts a worker and a master that run jobs tasks
+// at a time.
+func newJobsTestCase(t *testing.T, sandbox string, jobs int) *testCase {
 	tc := new(testCase)
 	tc.tester = t
 	tc.secret = RandomBytes(20)
@@ -93,6 +104,19 @@ func NewTestCase(t *testing.T) *testCase {
 	tc.coordinatorPort = pickPort(t)
 	go tc.coordinator.ServeHTTP(tc.coordinatorPort)
 	coordinatorAddr := fmt.Sprintf("localhost:%d", tc.coordinatorPort)
+	// The master backs off for a while if it can't reach the
+	// coordinator.
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", coordinatorAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i > 50 {
+			t.Fatalf("coordinator does not listen: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
 	mkbox, err := filepath.Abs("../bin/mkbox/mkbox")
 	if err != nil {
 		t.Fatalf("filepath.Abs(\"mkbox\"): %v", err)
@@ -104,11 +128,12 @@ func NewTestCase(t *testing.T) *testCase {
 		StoreOptions: cba.StoreOptions{
 			Dir: tc.tmp + "/worker-cache",
 		},
-		Jobs:           1,
+		Jobs:           jobs,
 		ReportInterval: 100 * time.Millisecond,
 		Coordinator:    coordinatorAddr,
 		PortRetry:      10,
 		Mkbox:          mkbox,
+		Sandbox:        sandbox,
 	}
 
 	tc.wd = tc.tmp + "/wd"
@@ -122,7 +147,7 @@ func NewTestCase(t *testing.T) *testCase {
 			WritableRoot:  tc.wd,
 			RetryCount:    2,
 			Secret:        tc.secret,
-			MaxJobs:       1,
+			MaxJobs:       jobs,
 			Coordinator:   coordinatorAddr,
 			KeepAlive:     500 * time.Millisecond,
 			Period:        500 * time.Millisecond,
@@ -268,7 +293,7 @@ func TestEndToEndKeepalive(t *testing.T) {
 	defer tc.Clean()
 
 	req := WorkRequest{
-		Argv: []string{"touch", "output.txt"},
+		Argv: []string{"/bin/sh", "-c", "echo > output.txt"},
 	}
 
 	tc.RunSuccess(req)
@@ -288,6 +313,164 @@ func TestEndToEndKeepalive(t *testing.T) {
 	}
 }
 
+func TestEndToEndDrain(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"/bin/sh", "-c", "echo > output.txt"},
+	})
+
+	// Running tasks complete.
+	w := tc.workers[0]
+	done := make(chan WorkResponse, 1)
+	go func() {
+		done <- tc.Run(WorkRequest{
+			Argv: []string{"/bin/sh", "-c", "sleep 1; echo > output2.txt"},
+		}, false)
+	}()
+	for i := 0; !workerBusy(w); i++ {
+		if i > 50 {
+			t.Fatal("task did not start")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := w.Drain(&DrainRequest{}, &DrainResponse{}); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	rep := <-done
+	if rep.Exit.ExitStatus() != 0 {
+		t.Fatalf("task failed while draining: %v", rep)
+	}
+	if !rep.Draining {
+		t.Errorf("response should signal draining")
+	}
+	if _, err := os.Lstat(tc.wd + "/output2.txt"); err != nil {
+		t.Errorf("output of the running task: %v", err)
+	}
+
+	for i := 0; tc.coordinator.WorkerCount() > 0; i++ {
+		if i > 50 {
+			t.Fatal("drained worker did not unregister")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := w.CreateMirror(&CreateMirrorRequest{}, &CreateMirrorResponse{}); err == nil {
+		t.Errorf("draining worker accepted new mirror")
+	}
+}
+
+func TestEndToEndCancelSession(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	w := tc.workers[0]
+	done := make(chan WorkResponse, 1)
+	start := time.Now()
+	go func() {
+		done <- tc.Run(WorkRequest{
+			Argv:    []string{"/bin/sh", "-c", "sleep 10"},
+			Session: "s",
+		}, false)
+	}()
+	for i := 0; !workerBusy(w); i++ {
+		if i > 50 {
+			t.Fatal("task did not start")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	killed, err := tc.master.CancelSession("s")
+	if err != nil || killed != 1 {
+		t.Fatalf("CancelSession: %d, %v", killed, err)
+	}
+	if rep := <-done; rep.Exit.ExitStatus() == 0 {
+		t.Errorf("cancelled task succeeded: %v", rep)
+	}
+	if d := time.Now().Sub(start); d > 5*time.Second {
+		t.Errorf("cancelled task ran for %v", d)
+	}
+
+	// A later build can reuse the session.
+	tc.RunSuccess(WorkRequest{
+		Argv:    []string{"/bin/sh", "-c", "echo > output.txt"},
+		Session: "s",
+	})
+}
+
+// runTogether runs overlapping tasks that write file-i.txt, and
+// returns their responses.
+func (tc *testCase) runTogether(isolate ...bool) []WorkResponse {
+	reps := make([]WorkResponse, len(isolate))
+	var wg sync.WaitGroup
+	for i, iso := range isolate {
+		wg.Add(1)
+		go func(i int, iso bool) {
+			defer wg.Done()
+			reps[i] = tc.RunSuccess(WorkRequest{
+				Argv:    []string{"/bin/sh", "-c", fmt.Sprintf("sleep 1; echo > file-%d.txt", i)},
+				Isolate: iso,
+			})
+		}(i, iso)
+	}
+	wg.Wait()
+	return reps
+}
+
+func TestEndToEndIsolate(t *testing.T) {
+	tc := newJobsTestCase(t, "", 2)
+	defer tc.Clean()
+
+	// Without Isolate, the tasks share a file system, whose
+	// results come back with one of them.
+	reps := tc.runTogether(false, false)
+	if len(reps[0].TaskIds)+len(reps[1].TaskIds) != 2 || len(reps[0].TaskIds) == 1 {
+		t.Fatalf("tasks did not share a file system: %v, %v", reps[0].TaskIds, reps[1].TaskIds)
+	}
+
+	reps = tc.runTogether(false, true)
+	for i, rep := range reps {
+		if len(rep.TaskIds) != 1 || rep.FileSet == nil {
+			t.Errorf("task %d: got results for tasks %v", i, rep.TaskIds)
+			continue
+		}
+		for _, f := range rep.FileSet.Files {
+			if strings.HasPrefix(filepath.Base(f.Path), "file-") && filepath.Base(f.Path) != fmt.Sprintf("file-%d.txt", i) {
+				t.Errorf("task %d: got output %s", i, f.Path)
+			}
+		}
+	}
+}
+
+// workerBusy returns whether w is running a task.
+func workerBusy(w *Worker) bool {
+	rep := WorkerStatusResponse{}
+	w.Status(&WorkerStatusRequest{}, &rep)
+	for _, m := range rep.MirrorStatus {
+		for _, fs := range m.Fses {
+			if len(fs.Tasks) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestEndToEndTerminal(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	// A background process may keep the terminal open after the
+	// task exited.
+	rep := tc.RunSuccess(WorkRequest{
+		Argv:     []string{"sh", "-c", "test -t 1 && echo tty; sleep 2 &"},
+		Terminal: &Terminal{Rows: 24, Cols: 80},
+	})
+	if !strings.Contains(rep.Stdout, "tty") {
+		t.Errorf("got stdout %q", rep.Stdout)
+	}
+}
+
 func TestEndToEndFullPath(t *testing.T) {
 	tc := NewTestCase(t)
 	defer tc.Clean()
@@ -518,7 +701,7 @@ func TestEndToEndShutdown(t *testing.T) {
 	tc.master.options.RetryCount = 0
 
 	req := WorkRequest{
-		Argv: []string{"touch", "file.txt"},
+		Argv: []string{"/bin/sh", "-c", "echo > file.txt"},
 	}
 	tc.RunSuccess(req)
 
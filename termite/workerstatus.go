@@ -43,11 +43,13 @@ func serveStatus(worker *Worker, w http.ResponseWriter, r *http.Request) {
 	}
 
 	addr := fmt.Sprintf("%s:%d", cname, worker.listener.Addr().(*net.TCPAddr).Port)
-	fmt.Fprintf(w, "<p>Worker %s (<a href=\"http://%s:%d\">status</a>)<p>Version %s<p>Jobs %d\n",
-		addr, cname, worker.httpStatusPort, status.Version, status.MaxJobCount)
+	fmt.Fprintf(w, "<p>Worker %s (<a href=\"http://%s:%d\">status</a>)<p>Version %s<p>Jobs %d, %s sandbox\n",
+		addr, cname, worker.httpStatusPort, status.Version, status.MaxJobCount, status.Sandbox)
 	fmt.Fprintf(w, "<p><a href=\"/log?host=%s\">Worker log %s</a>\n", addr, addr)
 
-	if !status.Accepting {
+	if status.Draining {
+		fmt.Fprintf(w, "<b>draining</b>")
+	} else if !status.Accepting {
 		fmt.Fprintf(w, "<b>shutting down</b>")
 	}
 	stats.CpuStatsWriteHttp(w, status.CpuStats, status.DiskStats)
@@ -93,7 +95,9 @@ func mirrorStatusHtml(w http.ResponseWriter, s MirrorStatusResponse) {
 	fmt.Fprintf(w, "</ul>\n")
 }
 
-func (w *Worker) serveStatus(port, delta int) {
+// listenStatus opens the port for the status pages, so we can
+// report it to the coordinator before serving.
+func (w *Worker) listenStatus(port, delta int) net.Listener {
 	var l net.Listener
 	var err error
 	if delta < 1 {
@@ -109,11 +113,15 @@ func (w *Worker) serveStatus(port, delta int) {
 
 	if err != nil || l == nil {
 		log.Println("status serve:", err)
-		return
+		return nil
 	}
 
 	w.httpStatusPort = l.Addr().(*net.TCPAddr).Port
 	log.Printf("Serving status on port %d", w.httpStatusPort)
+	return l
+}
+
+func (w *Worker) serveStatus(l net.Listener) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(wr http.ResponseWriter, r *http.Request) {
 		serveStatus(w, wr, r)
@@ -121,13 +129,22 @@ func (w *Worker) serveStatus(port, delta int) {
 	mux.HandleFunc("/log", func(wr http.ResponseWriter, r *http.Request) {
 		serveLog(w, wr, r)
 	})
+	mux.HandleFunc(jsonApiPrefix+"status", func(wr http.ResponseWriter, r *http.Request) {
+		serveJSONStatus(w, wr, r)
+	})
+	mux.HandleFunc(jsonApiPrefix+"mirrors", func(wr http.ResponseWriter, r *http.Request) {
+		serveJSONMirrors(w, wr, r)
+	})
+	mux.HandleFunc("/metrics", func(wr http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, wr, r)
+	})
 
 	mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 	mux.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
 	mux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
 	mux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 
-	err = http.Serve(l, mux)
+	err := http.Serve(l, mux)
 	if err != nil {
 		log.Println("status serve:", err)
 		return